@@ -50,6 +50,7 @@ func (s *ShibuyaAPI) collectionConfigGetHandler(w http.ResponseWriter, req *http
 			CollectionID: collection.ID,
 			Tests:        eps,
 			CSVSplit:     collection.CSVSplit,
+			Properties:   collection.Properties,
 		},
 	}
 	content, err := yaml.Marshal(e)
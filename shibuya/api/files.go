@@ -0,0 +1,50 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+)
+
+// streamFormFile finds the file in the multipart body and returns it without buffering the file
+// in memory or on disk, so large data files can be uploaded directly to the object storage.
+// Reading more than the max upload size fails with *http.MaxBytesError.
+func streamFormFile(w http.ResponseWriter, r *http.Request, field string) (io.ReadCloser, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, config.SC.ObjectStorage.MaxUploadSize<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return part, part.FileName(), nil
+		}
+		part.Close()
+	}
+}
+
+// parseCSVSettings reads the csv settings of a data file from the form
+func parseCSVSettings(r *http.Request) (model.CSVSettings, error) {
+	cs := model.CSVSettings{
+		Split:     r.Form.Get("split"),
+		SplitMode: r.Form.Get("split_mode"),
+	}
+	if kh := r.Form.Get("keep_header"); kh != "" {
+		keepHeader, err := strconv.ParseBool(kh)
+		if err != nil {
+			return cs, makeInvalidRequestError("keep_header should be a boolean")
+		}
+		cs.KeepHeader = keepHeader
+	}
+	if err := cs.Validate(); err != nil {
+		return cs, makeInvalidRequestError(err.Error())
+	}
+	return cs, nil
+}
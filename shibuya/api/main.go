@@ -1,19 +1,22 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/rakutentech/shibuya/shibuya/config"
 	"github.com/rakutentech/shibuya/shibuya/controller"
+	"github.com/rakutentech/shibuya/shibuya/engines/jmx"
 	"github.com/rakutentech/shibuya/shibuya/model"
 	"github.com/rakutentech/shibuya/shibuya/object_storage"
 	"github.com/rakutentech/shibuya/shibuya/scheduler"
@@ -39,6 +42,12 @@ type JSONMessage struct {
 	Message string `json:"message"`
 }
 
+// TestFileRejection is returned when the uploaded test plan has errors
+type TestFileRejection struct {
+	Message string       `json:"message"`
+	Issues  []*jmx.Issue `json:"issues"`
+}
+
 func (s *ShibuyaAPI) jsonise(w http.ResponseWriter, status int, content interface{}) {
 	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
@@ -61,15 +70,27 @@ func (s *ShibuyaAPI) makeFailMessage(w http.ResponseWriter, message string, stat
 func (s *ShibuyaAPI) handleErrorsFromExt(w http.ResponseWriter, err error) error {
 	var (
 		dbe                   *model.DBError
+		qe                    *model.QuotaExceededError
 		noResourcesFoundError *scheduler.NoResourcesFoundErr
+		jarNotAllowedError    *model.JarNotAllowedError
+		maxBytesError         *http.MaxBytesError
 	)
 	switch {
 	case errors.As(err, &dbe):
 		s.makeFailMessage(w, dbe.Error(), http.StatusNotFound)
 		return nil
+	case errors.As(err, &qe):
+		s.makeFailMessage(w, qe.Error(), http.StatusForbidden)
+		return nil
 	case errors.As(err, &noResourcesFoundError):
 		s.makeFailMessage(w, noResourcesFoundError.Message, http.StatusNotFound)
 		return nil
+	case errors.As(err, &jarNotAllowedError):
+		s.makeFailMessage(w, jarNotAllowedError.Error(), http.StatusForbidden)
+		return nil
+	case errors.As(err, &maxBytesError):
+		s.makeFailMessage(w, fmt.Sprintf("The file is bigger than %d MB", maxBytesError.Limit>>20), http.StatusRequestEntityTooLarge)
+		return nil
 	}
 	return err
 }
@@ -137,6 +158,132 @@ func (s *ShibuyaAPI) projectGetHandler(w http.ResponseWriter, r *http.Request, p
 	s.jsonise(w, http.StatusOK, project)
 }
 
+func (s *ShibuyaAPI) resourcePolicyGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	project, err := getProject(params.ByName("project_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if r := hasProjectOwnership(project, account); !r {
+		s.handleErrors(w, makeProjectOwnershipError())
+		return
+	}
+	rp, err := model.GetResourcePolicy(project.ID)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if rp == nil {
+		rp = &model.ResourcePolicy{ProjectID: project.ID, Images: []string{}}
+	}
+	s.jsonise(w, http.StatusOK, rp)
+}
+
+func (s *ShibuyaAPI) resourcePolicyUpdateHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can change the resource policy"))
+		return
+	}
+	project, err := getProject(params.ByName("project_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	rp := &model.ResourcePolicy{
+		ProjectID: project.ID,
+		MinCPU:    r.Form.Get("min_cpu"),
+		MaxCPU:    r.Form.Get("max_cpu"),
+		MinMem:    r.Form.Get("min_mem"),
+		MaxMem:    r.Form.Get("max_mem"),
+		Images:    []string{},
+	}
+	for _, image := range strings.Split(r.Form.Get("images"), ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			rp.Images = append(rp.Images, image)
+		}
+	}
+	if err := rp.Validate(); err != nil {
+		s.handleErrors(w, makeInvalidRequestError(err.Error()))
+		return
+	}
+	if err := model.SetResourcePolicy(rp); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+}
+
+func (s *ShibuyaAPI) allowedJarsGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	project, err := getProject(params.ByName("project_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if r := hasProjectOwnership(project, account); !r {
+		s.handleErrors(w, makeProjectOwnershipError())
+		return
+	}
+	jars, err := model.GetAllowedJars(project.ID)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, jars)
+}
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (s *ShibuyaAPI) allowedJarAddHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can allow jars"))
+		return
+	}
+	project, err := getProject(params.ByName("project_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	checksum := strings.ToLower(strings.TrimSpace(r.Form.Get("checksum")))
+	if !checksumPattern.MatchString(checksum) {
+		s.handleErrors(w, makeInvalidRequestError("checksum should be the sha256 of the jar in hex"))
+		return
+	}
+	aj := &model.AllowedJar{
+		ProjectID: project.ID,
+		Checksum:  checksum,
+		Name:      r.Form.Get("name"),
+		AddedBy:   account.Name,
+	}
+	if err := model.AllowJar(aj); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+func (s *ShibuyaAPI) allowedJarDeleteHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can remove allowed jars"))
+		return
+	}
+	project, err := getProject(params.ByName("project_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := model.DisallowJar(project.ID, params.ByName("checksum")); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
 func (s *ShibuyaAPI) projectUpdateHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	s.jsonise(w, http.StatusNotImplemented, nil)
 }
@@ -229,8 +376,9 @@ func (s *ShibuyaAPI) planUpdateHandler(w http.ResponseWriter, _ *http.Request, _
 }
 
 type AdminCollectionResponse struct {
-	RunningCollections []*model.RunningPlan `json:"running_collections"`
-	NodePools          smodel.AllNodesInfo  `json:"node_pools"`
+	RunningCollections []*model.RunningPlan  `json:"running_collections"`
+	NodePools          smodel.AllNodesInfo   `json:"node_pools"`
+	LaunchQueue        []*model.QueuedLaunch `json:"launch_queue"`
 }
 
 func (s *ShibuyaAPI) collectionAdminGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -239,11 +387,110 @@ func (s *ShibuyaAPI) collectionAdminGetHandler(w http.ResponseWriter, r *http.Re
 		s.handleErrors(w, err)
 		return
 	}
+	queue, err := model.GetLaunchQueue(config.SC.Context)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
 	acr := new(AdminCollectionResponse)
 	acr.RunningCollections = collections
+	acr.LaunchQueue = queue
+	nodePools, err := s.ctr.Scheduler.GetNodesInfo()
+	if err != nil && !errors.Is(err, scheduler.FeatureUnavailable) {
+		s.handleErrors(w, err)
+		return
+	}
+	acr.NodePools = nodePools
 	s.jsonise(w, http.StatusOK, acr)
 }
 
+type QuotaResponse struct {
+	*model.Quota
+	Usage *model.QuotaUsage `json:"usage"`
+}
+
+func (s *ShibuyaAPI) quotasGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can manage the quotas"))
+		return
+	}
+	quotas, err := model.GetQuotas()
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	resp := []*QuotaResponse{}
+	for _, q := range quotas {
+		usage, err := model.GetQuotaUsage(q.Scope, q.ScopeID)
+		if err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+		resp = append(resp, &QuotaResponse{Quota: q, Usage: usage})
+	}
+	s.jsonise(w, http.StatusOK, resp)
+}
+
+func (s *ShibuyaAPI) quotaUpdateHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can manage the quotas"))
+		return
+	}
+	scope := params.ByName("scope")
+	if !model.IsValidQuotaScope(scope) {
+		s.handleErrors(w, makeInvalidResourceError("scope"))
+		return
+	}
+	r.ParseForm()
+	// Only the limits in the form are changed
+	quota, err := model.GetQuota(scope, params.ByName("scope_id"))
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if quota == nil {
+		quota = &model.Quota{
+			Scope:   scope,
+			ScopeID: params.ByName("scope_id"),
+		}
+	}
+	limits := map[string]*int64{
+		"max_engines":     &quota.MaxEngines,
+		"max_vu":          &quota.MaxVU,
+		"max_monthly_vuh": &quota.MaxMonthlyVUH,
+	}
+	for name, limit := range limits {
+		v := r.Form.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			s.handleErrors(w, makeInvalidResourceError(name))
+			return
+		}
+		*limit = n
+	}
+	if err := model.SetQuota(quota); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+}
+
+func (s *ShibuyaAPI) quotaDeleteHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	account := r.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		s.handleErrors(w, makeNoPermissionErr("Only admins can manage the quotas"))
+		return
+	}
+	if err := model.DeleteQuota(params.ByName("scope"), params.ByName("scope_id")); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+}
+
 func (s *ShibuyaAPI) planCreateHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	account := r.Context().Value(accountKey).(*model.Account)
 	r.ParseForm()
@@ -309,13 +556,40 @@ func (s *ShibuyaAPI) planFilesUploadHandler(w http.ResponseWriter, r *http.Reque
 		s.handleErrors(w, err)
 		return
 	}
-	r.ParseMultipartForm(100 << 20) //parse 100 MB of data
-	file, handler, err := r.FormFile("planFile")
+	file, filename, err := streamFormFile(w, r, "planFile")
 	if err != nil {
 		s.handleErrors(w, makeInvalidRequestError("Something wrong with file you uploaded"))
 		return
 	}
-	err = plan.StoreFile(file, handler.Filename)
+	account := r.Context().Value(accountKey).(*model.Account)
+	// Test plans are small enough to be validated in memory before being stored
+	if strings.HasSuffix(filename, ".jmx") {
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			s.handleErrors(w, makeInvalidRequestError("Something wrong with file you uploaded"))
+			return
+		}
+		issues, err := validateTestFile(plan, content)
+		if err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+		if jmx.HasErrors(issues) {
+			s.jsonise(w, http.StatusBadRequest, &TestFileRejection{
+				Message: "The test plan cannot be run by shibuya",
+				Issues:  issues,
+			})
+			return
+		}
+		if err := plan.StoreFile(io.NopCloser(bytes.NewReader(content)), filename, account.Name); err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+		s.jsonise(w, http.StatusOK, issues)
+		return
+	}
+	err = plan.StoreFile(file, filename, account.Name)
 	if err != nil {
 		// TODO need to handle the upload error here
 		s.handleErrors(w, err)
@@ -324,12 +598,63 @@ func (s *ShibuyaAPI) planFilesUploadHandler(w http.ResponseWriter, r *http.Reque
 	w.Write([]byte("success"))
 }
 
-func (s *ShibuyaAPI) planFilesGetHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	s.jsonise(w, http.StatusNotImplemented, nil)
+func validateTestFile(plan *model.Plan, content []byte) ([]*jmx.Issue, error) {
+	issues, err := plan.ValidateTestFile(content)
+	if errors.Is(err, jmx.ErrInvalidTestPlan) {
+		return nil, makeInvalidRequestError(err.Error())
+	}
+	return issues, err
 }
 
-func (s *ShibuyaAPI) collectionFilesGetHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	s.jsonise(w, http.StatusNotImplemented, nil)
+func (s *ShibuyaAPI) planValidationHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	plan, err := hasPlanOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if plan.TestFile == nil {
+		s.handleErrors(w, makeInvalidRequestError("plan does not have a test file"))
+		return
+	}
+	content, err := object_storage.Download(object_storage.Client.Storage, plan.TestFile.Filepath)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	issues, err := validateTestFile(plan, content)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, issues)
+}
+
+func (s *ShibuyaAPI) planFilesGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	plan, err := hasPlanOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	files, err := plan.GetFilesInfo()
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, files)
+}
+
+func (s *ShibuyaAPI) collectionFilesGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	files, err := collection.GetFilesInfo()
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, files)
 }
 
 func (s *ShibuyaAPI) collectionFilesUploadHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -338,13 +663,13 @@ func (s *ShibuyaAPI) collectionFilesUploadHandler(w http.ResponseWriter, r *http
 		s.handleErrors(w, err)
 		return
 	}
-	r.ParseMultipartForm(100 << 20) //parse 100 MB of data
-	file, handler, err := r.FormFile("collectionFile")
+	file, filename, err := streamFormFile(w, r, "collectionFile")
 	if err != nil {
 		s.handleErrors(w, makeInvalidRequestError("Something wrong with file you uploaded"))
 		return
 	}
-	err = collection.StoreFile(file, handler.Filename)
+	account := r.Context().Value(accountKey).(*model.Account)
+	err = collection.StoreFile(file, filename, account.Name)
 	if err != nil {
 		s.handleErrors(w, err)
 		return
@@ -392,6 +717,140 @@ func (s *ShibuyaAPI) planFilesDeleteHandler(w http.ResponseWriter, r *http.Reque
 	w.Write([]byte("Deleted successfully"))
 }
 
+func (s *ShibuyaAPI) planFileVersionsGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	plan, err := hasPlanOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("plan file name cannot be empty"))
+		return
+	}
+	versions, err := plan.GetFileVersions(filename)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, versions)
+}
+
+func (s *ShibuyaAPI) planFileRollbackHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	plan, err := hasPlanOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	filename := r.Form.Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("plan file name cannot be empty"))
+		return
+	}
+	version, err := strconv.Atoi(r.Form.Get("version"))
+	if err != nil || version < 0 {
+		s.handleErrors(w, makeInvalidRequestError("version should be a non-negative integer"))
+		return
+	}
+	if err := plan.RollbackFile(filename, version); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+func (s *ShibuyaAPI) collectionFileVersionsGetHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("Collection file name cannot be empty"))
+		return
+	}
+	versions, err := collection.GetFileVersions(filename)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	s.jsonise(w, http.StatusOK, versions)
+}
+
+func (s *ShibuyaAPI) collectionFileRollbackHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	filename := r.Form.Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("Collection file name cannot be empty"))
+		return
+	}
+	version, err := strconv.Atoi(r.Form.Get("version"))
+	if err != nil || version < 0 {
+		s.handleErrors(w, makeInvalidRequestError("version should be a non-negative integer"))
+		return
+	}
+	if err := collection.RollbackFile(filename, version); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+func (s *ShibuyaAPI) planFileCSVSettingsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	plan, err := hasPlanOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	filename := r.Form.Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("plan file name cannot be empty"))
+		return
+	}
+	cs, err := parseCSVSettings(r)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := plan.UpdateFileCSVSettings(filename, cs); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+func (s *ShibuyaAPI) collectionFileCSVSettingsHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	r.ParseForm()
+	filename := r.Form.Get("filename")
+	if filename == "" {
+		s.handleErrors(w, makeInvalidRequestError("Collection file name cannot be empty"))
+		return
+	}
+	cs, err := parseCSVSettings(r)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := collection.UpdateFileCSVSettings(filename, cs); err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
 func (s *ShibuyaAPI) collectionCreateHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	account := r.Context().Value(accountKey).(*model.Account)
 	r.ParseForm()
@@ -457,6 +916,14 @@ func (s *ShibuyaAPI) collectionGetHandler(w http.ResponseWriter, r *http.Request
 	s.jsonise(w, http.StatusOK, collection)
 }
 
+func (s *ShibuyaAPI) engineImagesGetHandler(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	images := config.SC.ExecutorConfig.JmeterContainer.Images
+	if images == nil {
+		images = []*config.EngineImage{}
+	}
+	s.jsonise(w, http.StatusOK, images)
+}
+
 func hasInvalidDiff(curr, updated []*model.ExecutionPlan) (bool, string) {
 	if len(updated) != len(curr) {
 		return true, "You cannot add/remove plans while have engines deployed"
@@ -476,6 +943,9 @@ func hasInvalidDiff(curr, updated []*model.ExecutionPlan) (bool, string) {
 		if currPlan.Concurrency != item.Concurrency {
 			return true, "You cannot change concurrency while having engines deployed"
 		}
+		if currPlan.Image != item.Image {
+			return true, "You cannot change the engine image while having engines deployed"
+		}
 	}
 	return false, ""
 }
@@ -546,15 +1016,45 @@ func (s *ShibuyaAPI) collectionUploadHandler(w http.ResponseWriter, r *http.Requ
 		s.handleErrors(w, err)
 		return
 	}
-	if len(runningPlans) > 0 {
+	pendingPlans, err := model.GetPendingPlansByCollection(collection.ID)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if len(runningPlans) > 0 || len(pendingPlans) > 0 {
 		s.handleErrors(w, makeInvalidRequestError("You cannot change the collection during testing period"))
 		return
 	}
+	resourcePolicy, err := model.GetResourcePolicy(project.ID)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := model.ValidateProperties(e.Content.Properties); err != nil {
+		s.handleErrors(w, makeInvalidRequestError(err.Error()))
+		return
+	}
+	if err := model.ValidatePlanSchedule(e.Content.Tests); err != nil {
+		s.handleErrors(w, makeInvalidRequestError(err.Error()))
+		return
+	}
 	for _, ep := range e.Content.Tests {
+		if err := model.ValidateProperties(ep.Properties); err != nil {
+			s.handleErrors(w, makeInvalidRequestError(err.Error()))
+			return
+		}
 		if ep.Engines <= 0 {
 			s.handleErrors(w, makeInvalidRequestError("You cannot configure a plan with zero engine"))
 			return
 		}
+		if ep.RPS < 0 {
+			s.handleErrors(w, makeInvalidRequestError("You cannot configure a plan with negative rps"))
+			return
+		}
+		if err := ep.ValidateResources(resourcePolicy, config.SC.ExecutorConfig.JmeterContainer); err != nil {
+			s.handleErrors(w, makeInvalidRequestError(err.Error()))
+			return
+		}
 	}
 	if s.ctr.Scheduler.PodReadyCount(collection.ID) > 0 {
 		currentPlans, err := collection.GetExecutionPlans()
@@ -574,6 +1074,43 @@ func (s *ShibuyaAPI) collectionUploadHandler(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// collectionEstimateHandler estimates the usage of the collection before it's deployed. A config can be posted
+// as collectionYAML to estimate it before uploading, otherwise the current config of the collection is used.
+func (s *ShibuyaAPI) collectionEstimateHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	var eps []*model.ExecutionPlan
+	if r.Method == http.MethodPost {
+		e := new(model.ExecutionWrapper)
+		r.ParseMultipartForm(1 << 20) //parse 1 MB of data
+		file, _, err := r.FormFile("collectionYAML")
+		if err != nil {
+			s.handleErrors(w, makeInvalidResourceError("file"))
+			return
+		}
+		raw, err := io.ReadAll(file)
+		if err != nil {
+			s.handleErrors(w, makeInvalidRequestError("invalid file"))
+			return
+		}
+		if err := yaml.Unmarshal(raw, e); err != nil {
+			s.handleErrors(w, makeInvalidRequestError(err.Error()))
+			return
+		}
+		eps = e.Content.Tests
+	} else {
+		eps, err = collection.GetExecutionPlans()
+		if err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+	}
+	s.jsonise(w, http.StatusOK, model.EstimateUsage(eps, config.SC.Context))
+}
+
 func (s *ShibuyaAPI) collectionEnginesDetailHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	collection, err := hasCollectionOwnership(r, params)
 	if err != nil {
@@ -594,8 +1131,15 @@ func (s *ShibuyaAPI) collectionDeploymentHandler(w http.ResponseWriter, r *http.
 		s.handleErrors(w, err)
 		return
 	}
-	if err := s.ctr.DeployCollection(collection); err != nil {
+	account := r.Context().Value(accountKey).(*model.Account)
+	ql, err := s.ctr.DeployCollection(collection, account.Name)
+	if err != nil {
 		var dbe *model.DBError
+		var qe *model.QuotaExceededError
+		if errors.As(err, &qe) {
+			s.handleErrors(w, err)
+			return
+		}
 		if errors.As(err, &dbe) {
 			s.handleErrors(w, makeInvalidRequestError(err.Error()))
 			return
@@ -603,6 +1147,10 @@ func (s *ShibuyaAPI) collectionDeploymentHandler(w http.ResponseWriter, r *http.
 		s.handleErrors(w, makeInternalServerError(err.Error()))
 		return
 	}
+	// The launch is queued and will be started once the capacity is available
+	if ql != nil {
+		s.jsonise(w, http.StatusAccepted, ql)
+	}
 }
 
 func (s *ShibuyaAPI) collectionTriggerHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -629,6 +1177,40 @@ func (s *ShibuyaAPI) collectionTermHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (s *ShibuyaAPI) collectionPauseHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := s.ctr.PauseCollection(collection); err != nil {
+		var dbe *model.DBError
+		if errors.As(err, &dbe) {
+			s.handleErrors(w, makeInvalidRequestError(err.Error()))
+			return
+		}
+		s.handleErrors(w, makeInternalServerError(err.Error()))
+		return
+	}
+}
+
+func (s *ShibuyaAPI) collectionResumeHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	if err := s.ctr.ResumeCollection(collection); err != nil {
+		var dbe *model.DBError
+		if errors.As(err, &dbe) {
+			s.handleErrors(w, makeInvalidRequestError(err.Error()))
+			return
+		}
+		s.handleErrors(w, makeInternalServerError(err.Error()))
+		return
+	}
+}
+
 func (s *ShibuyaAPI) collectionStatusHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	collection, err := hasCollectionOwnership(r, params)
 	if err != nil {
@@ -675,6 +1257,102 @@ func (s *ShibuyaAPI) planLogHandler(w http.ResponseWriter, r *http.Request, para
 	s.jsonise(w, http.StatusOK, m)
 }
 
+// Lines of the engine logs longer than this end the stream of the engine
+const maxLogLineSize = 1024 * 1024
+
+// planLogStreamHandler streams the logs of one engine of the plan, or all of them when engine_id is
+// not given, as server sent events. Every line is prefixed by the engine ID. The stream keeps following
+// the engines unless follow is false. Lines below the level are filtered out.
+func (s *ShibuyaAPI) planLogStreamHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	collection, err := hasCollectionOwnership(r, params)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	planID, err := strconv.Atoi(params.ByName("plan_id"))
+	if err != nil {
+		s.handleErrors(w, makeInvalidResourceError("plan_id"))
+		return
+	}
+	q := r.URL.Query()
+	engineID := scheduler.AllEngines
+	if e := q.Get("engine_id"); e != "" {
+		engineID, err = strconv.Atoi(e)
+		if err != nil || engineID < 0 {
+			s.handleErrors(w, makeInvalidResourceError("engine_id"))
+			return
+		}
+	}
+	level := q.Get("level")
+	if !utils.IsValidLogLevel(level) {
+		s.handleErrors(w, makeInvalidRequestError("level should be one of TRACE, DEBUG, INFO, WARN, ERROR and FATAL"))
+		return
+	}
+	follow := q.Get("follow") != "false"
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+	logs, err := s.ctr.Scheduler.StreamEngineLogs(r.Context(), collection.ID, int64(planID), engineID, follow)
+	if err != nil {
+		s.handleErrors(w, makeInvalidRequestError(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Events are sent as they are formatted
+	events := make(chan string)
+	var wg sync.WaitGroup
+	for id, rc := range logs {
+		wg.Add(1)
+		go func(id int, rc io.ReadCloser) {
+			defer wg.Done()
+			defer rc.Close()
+			send := func(event string) bool {
+				select {
+				case events <- event:
+					return true
+				case <-r.Context().Done():
+					return false
+				}
+			}
+			filter := utils.NewLogLevelFilter(level)
+			scanner := bufio.NewScanner(rc)
+			// Stack traces and responses logged by the test plans can be longer than the default limit
+			scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineSize)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if level != "" && !filter.Keep(line) {
+					continue
+				}
+				if !send(fmt.Sprintf("data:[engine-%d] %s\n\n", id, line)) {
+					return
+				}
+			}
+			if r.Context().Err() != nil {
+				return
+			}
+			// Followed engines keep the stream open until the client goes away
+			if err := scanner.Err(); err != nil {
+				send(fmt.Sprintf("event:stream_error\ndata:[engine-%d] The log stream ended: %v\n\n", id, err))
+			} else if follow {
+				send(fmt.Sprintf("event:stream_error\ndata:[engine-%d] The log stream ended as the engine closed it\n\n", id))
+			}
+		}(id, rc)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	for event := range events {
+		fmt.Fprint(w, event)
+		flusher.Flush()
+	}
+}
+
 func (s *ShibuyaAPI) streamCollectionMetrics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	collection, err := hasCollectionOwnership(r, params)
 	if err != nil {
@@ -728,17 +1406,21 @@ func (s *ShibuyaAPI) runDeleteHandler(w http.ResponseWriter, _ *http.Request, _
 func (s *ShibuyaAPI) fileDownloadHandler(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	kind := params.ByName("kind")
 	id := params.ByName("id")
-	name := params.ByName("name")
+	// name can include the version of the file, e.g. /v2/a.csv
+	name := strings.TrimPrefix(params.ByName("name"), "/")
 	filename := fmt.Sprintf("%s/%s/%s", kind, id, name)
 
-	data, err := object_storage.Client.Storage.Download(filename)
+	rc, err := object_storage.Client.Storage.Open(filename)
 	if err != nil {
 		s.jsonise(w, http.StatusNotFound, "not found")
 		return
 	}
-	r := bytes.NewReader(data)
+	defer rc.Close()
 	w.Header().Add("Content-Disposition", "Attachment")
-	http.ServeContent(w, req, filename, time.Now(), r)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Error(err)
+	}
 }
 
 type Route struct {
@@ -757,14 +1439,23 @@ func (s *ShibuyaAPI) InitRoutes() Routes {
 		&Route{"delete_project", "DELETE", "/api/projects/:project_id", s.projectDeleteHandler},
 		&Route{"get_project", "GET", "/api/projects/:project_id", s.projectGetHandler},
 		&Route{"update_project", "PUT", "/api/projects/:project_id", s.projectUpdateHandler},
+		&Route{"get_resource_policy", "GET", "/api/projects/:project_id/resource_policy", s.resourcePolicyGetHandler},
+		&Route{"update_resource_policy", "PUT", "/api/projects/:project_id/resource_policy", s.resourcePolicyUpdateHandler},
+		&Route{"get_allowed_jars", "GET", "/api/projects/:project_id/jars", s.allowedJarsGetHandler},
+		&Route{"allow_jar", "PUT", "/api/projects/:project_id/jars", s.allowedJarAddHandler},
+		&Route{"disallow_jar", "DELETE", "/api/projects/:project_id/jars/:checksum", s.allowedJarDeleteHandler},
 
 		&Route{"create_plan", "POST", "/api/plans", s.planCreateHandler},
 		&Route{"get_plan", "GET", "/api/plans/:plan_id", s.planGetHandler},
 		&Route{"update_plan", "PUT", "/api/plans/:plan_id", s.planUpdateHandler},
 		&Route{"delete_plan", "DELETE", "/api/plans/:plan_id", s.planDeleteHandler},
 		&Route{"get_plan_files", "GET", "/api/plans/:plan_id/files", s.planFilesGetHandler},
+		&Route{"validate_plan", "GET", "/api/plans/:plan_id/validation", s.planValidationHandler},
 		&Route{"upload_plan_files", "PUT", "/api/plans/:plan_id/files", s.planFilesUploadHandler},
 		&Route{"delete_plan_files", "DELETE", "/api/plans/:plan_id/files", s.planFilesDeleteHandler},
+		&Route{"get_plan_file_versions", "GET", "/api/plans/:plan_id/files/versions", s.planFileVersionsGetHandler},
+		&Route{"rollback_plan_file", "PUT", "/api/plans/:plan_id/files/versions", s.planFileRollbackHandler},
+		&Route{"update_plan_file_csv_settings", "PUT", "/api/plans/:plan_id/files/csv_settings", s.planFileCSVSettingsHandler},
 
 		&Route{"create_collection", "POST", "/api/collections", s.collectionCreateHandler},
 		&Route{"delete_collection", "DELETE", "/api/collections/:collection_id", s.collectionDeleteHandler},
@@ -773,10 +1464,17 @@ func (s *ShibuyaAPI) InitRoutes() Routes {
 		&Route{"get_collection_files", "GET", "/api/collections/:collection_id/files", s.collectionFilesGetHandler},
 		&Route{"upload_collection_files", "PUT", "/api/collections/:collection_id/files", s.collectionFilesUploadHandler},
 		&Route{"delete_collection_files", "DELETE", "/api/collections/:collection_id/files", s.collectionFilesDeleteHandler},
+		&Route{"get_collection_file_versions", "GET", "/api/collections/:collection_id/files/versions", s.collectionFileVersionsGetHandler},
+		&Route{"rollback_collection_file", "PUT", "/api/collections/:collection_id/files/versions", s.collectionFileRollbackHandler},
+		&Route{"update_collection_file_csv_settings", "PUT", "/api/collections/:collection_id/files/csv_settings", s.collectionFileCSVSettingsHandler},
 		&Route{"get_collection_engines_detail", "GET", "/api/collections/:collection_id/engines_detail", s.collectionEnginesDetailHandler},
 		&Route{"deploy", "POST", "/api/collections/:collection_id/deploy", s.collectionDeploymentHandler},
+		&Route{"estimate_collection", "GET", "/api/collections/:collection_id/estimate", s.collectionEstimateHandler},
+		&Route{"estimate_collection_config", "POST", "/api/collections/:collection_id/estimate", s.collectionEstimateHandler},
 		&Route{"trigger", "POST", "/api/collections/:collection_id/trigger", s.collectionTriggerHandler},
 		&Route{"stop", "POST", "/api/collections/:collection_id/stop", s.collectionTermHandler},
+		&Route{"pause", "POST", "/api/collections/:collection_id/pause", s.collectionPauseHandler},
+		&Route{"resume", "POST", "/api/collections/:collection_id/resume", s.collectionResumeHandler},
 		&Route{"purge", "POST", "/api/collections/:collection_id/purge", s.collectionPurgeHandler},
 		&Route{"get_runs", "GET", "/api/collections/:collection_id/runs", s.runGetHandler},
 		&Route{"get_run", "GET", "/api/collections/:collection_id/runs/:run_id", s.runGetHandler},
@@ -785,21 +1483,23 @@ func (s *ShibuyaAPI) InitRoutes() Routes {
 		&Route{"status", "GET", "/api/collections/:collection_id/status", s.collectionStatusHandler},
 		&Route{"stream", "GET", "/api/collections/:collection_id/stream", s.streamCollectionMetrics},
 		&Route{"get_plan_log", "GET", "/api/collections/:collection_id/logs/:plan_id", s.planLogHandler},
+		&Route{"stream_plan_log", "GET", "/api/collections/:collection_id/logs/:plan_id/stream", s.planLogStreamHandler},
 		&Route{"upload_collection_config", "PUT", "/api/collections/:collection_id/config", s.collectionUploadHandler},
 		&Route{"get_collection_config", "GET", "/api/collections/:collection_id/config", s.collectionConfigGetHandler},
 
-		&Route{"files", "GET", "/api/files/:kind/:id/:name", s.fileDownloadHandler},
+		&Route{"files", "GET", "/api/files/:kind/:id/*name", s.fileDownloadHandler},
+		&Route{"engine_images", "GET", "/api/engines/images", s.engineImagesGetHandler},
 
 		&Route{"usage_summary", "GET", "/api/usage/summary", s.usageSummaryHandler},
 		&Route{"usage_summary_by_sid", "GET", "/api/usage/summary_sid", s.usageSummaryHandlerBySid},
+		&Route{"usage_report", "GET", "/api/usage/report", s.usageReportHandler},
 
 		&Route{"admin_collections", "GET", "/api/admin/collections", s.collectionAdminGetHandler},
+		&Route{"admin_quotas", "GET", "/api/admin/quotas", s.quotasGetHandler},
+		&Route{"admin_update_quota", "PUT", "/api/admin/quotas/:scope/:scope_id", s.quotaUpdateHandler},
+		&Route{"admin_delete_quota", "DELETE", "/api/admin/quotas/:scope/:scope_id", s.quotaDeleteHandler},
 	}
 	for _, r := range routes {
-		// TODO! We don't require auth for usage endpoint for now.
-		if strings.Contains(r.Path, "usage") {
-			continue
-		}
 		r.HandlerFunc = s.authRequired(r.HandlerFunc)
 	}
 	return routes
@@ -2,7 +2,6 @@ package api
 
 import (
 	"context"
-	"errors"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -21,16 +20,23 @@ func authWithSession(r *http.Request) (*model.Account, error) {
 	return account, nil
 }
 
-// TODO add JWT token auth in the future
-func authWithToken(_ *http.Request) (*model.Account, error) {
-	return nil, errors.New("No token presented")
+func authWithToken(r *http.Request) (*model.Account, error) {
+	account := model.GetAccountByToken(r)
+	if account == nil {
+		return nil, makeLoginError()
+	}
+	return account, nil
 }
 
 func (s *ShibuyaAPI) authRequired(next httprouter.Handle) httprouter.Handle {
 	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		var account *model.Account
 		var err error
-		account, err = authWithSession(r)
+		if model.HasBearerToken(r) {
+			account, err = authWithToken(r)
+		} else {
+			account, err = authWithSession(r)
+		}
 		if err != nil {
 			s.handleErrors(w, err)
 			return
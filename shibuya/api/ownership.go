@@ -31,3 +31,19 @@ func hasCollectionOwnership(r *http.Request, params httprouter.Params) (*model.C
 	}
 	return collection, nil
 }
+
+func hasPlanOwnership(r *http.Request, params httprouter.Params) (*model.Plan, error) {
+	plan, err := getPlan(params.ByName("plan_id"))
+	if err != nil {
+		return nil, err
+	}
+	account := r.Context().Value(accountKey).(*model.Account)
+	project, err := model.GetProject(plan.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	if r := hasProjectOwnership(project, account); !r {
+		return nil, makeProjectOwnershipError()
+	}
+	return plan, nil
+}
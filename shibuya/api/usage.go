@@ -1,7 +1,10 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -19,6 +22,13 @@ func (s *ShibuyaAPI) usageSummaryHandler(w http.ResponseWriter, req *http.Reques
 		s.handleErrors(w, err)
 		return
 	}
+	account := req.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		if err := summary.FilterByAccount(account); err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+	}
 	s.jsonise(w, http.StatusOK, summary)
 }
 
@@ -27,6 +37,18 @@ func (s *ShibuyaAPI) usageSummaryHandlerBySid(w http.ResponseWriter, req *http.R
 	st := qs.Get("started_time")
 	et := qs.Get("end_time")
 	sid := qs.Get("sid")
+	account := req.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		ok, err := account.CanSeeSIDUsage(sid)
+		if err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+		if !ok {
+			s.handleErrors(w, makeNoPermissionErr("You don't have permission to see the usage of this SID"))
+			return
+		}
+	}
 	history, err := model.GetUsageSummaryBySid(sid, st, et)
 	if err != nil {
 		s.handleErrors(w, err)
@@ -34,3 +56,75 @@ func (s *ShibuyaAPI) usageSummaryHandlerBySid(w http.ResponseWriter, req *http.R
 	}
 	s.jsonise(w, http.StatusOK, history)
 }
+
+// Formats accepted for the period of the usage report
+var usageReportTimeFormats = []string{model.MySQLFormat, "2006-01-02"}
+
+// parseUsageReportPeriod reads started_time and end_time of the usage report.
+// The period is from the beginning of the current month until now by default.
+func parseUsageReportPeriod(qs url.Values) (string, string, error) {
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	end := now
+	for name, t := range map[string]*time.Time{"started_time": &start, "end_time": &end} {
+		v := qs.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed := false
+		for _, format := range usageReportTimeFormats {
+			if p, err := time.ParseInLocation(format, v, now.Location()); err == nil {
+				*t, parsed = p, true
+				break
+			}
+		}
+		if !parsed {
+			return "", "", makeInvalidRequestError(fmt.Sprintf("%s should be like 2006-01-02 or 2006-01-02 15:04:05", name))
+		}
+	}
+	if !start.Before(end) {
+		return "", "", makeInvalidRequestError("started_time should be before end_time")
+	}
+	return start.Format(model.MySQLFormat), end.Format(model.MySQLFormat), nil
+}
+
+// usageReportHandler exports the usage broken down by project, collection, owner, sid and context.
+// The report is in csv unless format=json is given.
+func (s *ShibuyaAPI) usageReportHandler(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	qs := req.URL.Query()
+	st, et, err := parseUsageReportPeriod(qs)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	groupBy := qs.Get("group_by")
+	if groupBy == "" {
+		groupBy = model.GroupByMonth
+	}
+	if !model.IsValidReportGroup(groupBy) {
+		s.handleErrors(w, makeInvalidRequestError("group_by should be one of day, week and month"))
+		return
+	}
+	report, err := model.GetUsageReport(st, et, groupBy)
+	if err != nil {
+		s.handleErrors(w, err)
+		return
+	}
+	account := req.Context().Value(accountKey).(*model.Account)
+	if !account.IsAdmin() {
+		report, err = model.FilterUsageReportByAccount(report, account)
+		if err != nil {
+			s.handleErrors(w, err)
+			return
+		}
+	}
+	if qs.Get("format") == "json" {
+		s.jsonise(w, http.StatusOK, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage_%s.csv", groupBy))
+	if err := model.WriteUsageReportCSV(w, report); err != nil {
+		log.Error(err)
+	}
+}
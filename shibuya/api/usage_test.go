@@ -0,0 +1,57 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUsageReportPeriod(t *testing.T) {
+	now := time.Now()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format(model.MySQLFormat)
+	cases := []struct {
+		name        string
+		startedTime string
+		endTime     string
+		start       string
+		end         string
+		valid       bool
+	}{
+		{"dates", "2026-01-01", "2026-02-01", "2026-01-01 00:00:00", "2026-02-01 00:00:00", true},
+		{"times", "2026-01-01 10:00:00", "2026-01-01 11:30:00", "2026-01-01 10:00:00", "2026-01-01 11:30:00", true},
+		{"default start", "", "2999-01-01", startOfMonth, "2999-01-01 00:00:00", true},
+		{"invalid start", "01/01/2026", "2026-02-01", "", "", false},
+		{"invalid end", "2026-01-01", "2026-02-30", "", "", false},
+		{"end before start", "2026-02-01", "2026-01-01", "", "", false},
+		{"empty period", "2026-01-01", "2026-01-01", "", "", false},
+		{"start after now", "2999-01-01", "", "", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			qs := url.Values{}
+			if c.startedTime != "" {
+				qs.Set("started_time", c.startedTime)
+			}
+			if c.endTime != "" {
+				qs.Set("end_time", c.endTime)
+			}
+			start, end, err := parseUsageReportPeriod(qs)
+			if !c.valid {
+				assert.True(t, errors.Is(err, invalidRequestErr), "expected an invalid request error, got %v", err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.start, start)
+			assert.Equal(t, c.end, end)
+		})
+	}
+	// The period is until now by default
+	start, end, err := parseUsageReportPeriod(url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, startOfMonth, start)
+	assert.False(t, end < start)
+}
@@ -29,10 +29,18 @@ type LdapConfig struct {
 	LdapPort       string `json:"ldap_port"`
 }
 
+// APIToken lets scripts call the API without a session. The token is treated as a user in the ML.
+type APIToken struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	ML    []string `json:"ml"`
+}
+
 type AuthConfig struct {
-	AdminUsers []string `json:"admin_users"`
-	NoAuth     bool     `json:"no_auth"`
-	SessionKey string   `json:"session_key"`
+	AdminUsers []string    `json:"admin_users"`
+	NoAuth     bool        `json:"no_auth"`
+	SessionKey string      `json:"session_key"`
+	APITokens  []*APIToken `json:"api_tokens"`
 	*LdapConfig
 }
 
@@ -69,16 +77,53 @@ type ExecutorConfig struct {
 	NodeAffinity           []map[string]string `json:"node_affinity"`
 	Tolerations            []Toleration        `json:"tolerations"`
 	MaxEnginesInCollection int                 `json:"max_engines_in_collection"`
+	// Seconds the engines wait for the test to stop gracefully before forcing it
+	GracefulStopTimeout int `json:"graceful_stop_timeout"`
+	// Engines which can be launched at the same time in the cluster. Launches exceeding it will be queued.
+	// 0 means unlimited.
+	MaxEnginesInCluster int `json:"max_engines_in_cluster"`
+	// Seconds between all the engines being prepared and the test being started. The start requests are
+	// sent to the engines in this window so it should be longer with more engines.
+	StartLeadTime int `json:"start_lead_time"`
 }
 
 type ExecutorContainer struct {
 	Image string `json:"image"`
 	CPU   string `json:"cpu"`
 	Mem   string `json:"mem"`
+	Heap  string `json:"heap"` // JVM heap size of the engine, e.g. 512m. Empty means the JMeter default
 }
 
 type JmeterContainer struct {
 	*ExecutorContainer
+	// Class name prefixes of the plugins installed in the engine image, e.g. kg.apc.jmeter
+	Plugins []string `json:"plugins"`
+	// Engine images curated by the admins. Plans can pick one of them by name with image.
+	Images []*EngineImage `json:"images"`
+}
+
+type EngineImage struct {
+	Name          string   `json:"name"`
+	Image         string   `json:"image"`
+	JmeterVersion string   `json:"jmeter_version"`
+	Plugins       []string `json:"plugins"`
+}
+
+func (jc *JmeterContainer) FindImage(name string) *EngineImage {
+	for _, ei := range jc.Images {
+		if ei.Name == name {
+			return ei
+		}
+	}
+	return nil
+}
+
+// ResolveImage returns the image of a curated engine image picked by its name. Other images are returned as they are.
+func (jc *JmeterContainer) ResolveImage(image string) string {
+	if ei := jc.FindImage(image); ei != nil {
+		return ei.Image
+	}
+	return image
 }
 
 type DashboardConfig struct {
@@ -104,6 +149,13 @@ type ObjectStorage struct {
 	AuthFileName string `json:"auth_file_name"`
 	// This is the configuration file
 	ConfigMapName string `json:"config_map_name"`
+	// Uploads bigger than this are rejected, in MB
+	MaxUploadSize int64 `json:"max_upload_size"`
+}
+
+type NotificationConfig struct {
+	// Events such as a queued launch being started are posted to this url
+	WebhookUrl string `json:"webhook_url"`
 }
 
 type LogFormat struct {
@@ -122,6 +174,15 @@ type IngressConfig struct {
 	GCInterval string `json:"gc_period"`
 }
 
+// UsageRate is used to estimate the cost of a launch before deploying it
+type UsageRate struct {
+	Currency string  `json:"currency"`
+	VUH      float64 `json:"vuh"`       // price of one virtual user hour
+	NodeHour float64 `json:"node_hour"` // price of running one node for an hour
+	// Engines fitting in one node. 0 means nodes are not estimated
+	EnginesPerNode int `json:"engines_per_node"`
+}
+
 var defaultIngressConfig = IngressConfig{
 	Image:    "k8s.gcr.io/ingress-nginx/controller:v1.2.1",
 	Replicas: 1,
@@ -129,20 +190,34 @@ var defaultIngressConfig = IngressConfig{
 	Mem:      "1Gi",
 }
 
+// MetricsBus shares the metrics read from the engines with all the API replicas. The default provider,
+// local, only shares them within the process.
+type MetricsBus struct {
+	Provider string `json:"provider"`
+	// host:port of the broker
+	Url      string `json:"url"`
+	Password string `json:"password"`
+}
+
 type ShibuyaConfig struct {
-	ProjectHome      string           `json:"project_home"`
-	UploadFileHelp   string           `json:"upload_file_help"`
-	DistributedMode  bool             `json:"distributed_mode"`
-	DBConf           *MySQLConfig     `json:"db"`
-	ExecutorConfig   *ExecutorConfig  `json:"executors"`
-	DashboardConfig  *DashboardConfig `json:"dashboard"`
-	HttpConfig       *HttpConfig      `json:"http_config"`
-	AuthConfig       *AuthConfig      `json:"auth_config"`
-	ObjectStorage    *ObjectStorage   `json:"object_storage"`
-	LogFormat        *LogFormat       `json:"log_format"`
-	BackgroundColour string           `json:"bg_color"`
-	IngressConfig    *IngressConfig   `json:"ingress"`
-	EnableSid        bool             `json:"enable_sid"`
+	ProjectHome      string                `json:"project_home"`
+	UploadFileHelp   string                `json:"upload_file_help"`
+	DistributedMode  bool                  `json:"distributed_mode"`
+	DBConf           *MySQLConfig          `json:"db"`
+	ExecutorConfig   *ExecutorConfig       `json:"executors"`
+	DashboardConfig  *DashboardConfig      `json:"dashboard"`
+	HttpConfig       *HttpConfig           `json:"http_config"`
+	AuthConfig       *AuthConfig           `json:"auth_config"`
+	ObjectStorage    *ObjectStorage        `json:"object_storage"`
+	LogFormat        *LogFormat            `json:"log_format"`
+	BackgroundColour string                `json:"bg_color"`
+	IngressConfig    *IngressConfig        `json:"ingress"`
+	EnableSid        bool                  `json:"enable_sid"`
+	Notification     *NotificationConfig   `json:"notification"`
+	UsageRates       map[string]*UsageRate `json:"usage_rates"` // keyed by context
+	MetricsBus       *MetricsBus           `json:"metrics_bus"`
+	// Write the usage report of the previous month to the object storage
+	MonthlyUsageReport bool `json:"monthly_usage_report"`
 
 	// below are configs generated from above values
 	DevMode         bool
@@ -230,6 +305,18 @@ func loadConfig() *ShibuyaConfig {
 		if sc.ExecutorConfig.MaxEnginesInCollection == 0 {
 			sc.ExecutorConfig.MaxEnginesInCollection = 500
 		}
+		if sc.ExecutorConfig.GracefulStopTimeout == 0 {
+			sc.ExecutorConfig.GracefulStopTimeout = 60
+		}
+		if sc.ExecutorConfig.StartLeadTime == 0 {
+			sc.ExecutorConfig.StartLeadTime = 5
+		}
+	}
+	if sc.ObjectStorage != nil && sc.ObjectStorage.MaxUploadSize == 0 {
+		sc.ObjectStorage.MaxUploadSize = 1024
+	}
+	if sc.MetricsBus == nil {
+		sc.MetricsBus = &MetricsBus{}
 	}
 	if sc.IngressConfig.Lifespan == "" {
 		sc.IngressConfig.Lifespan = "30m"
@@ -43,6 +43,34 @@ var (
 		Help:      "Current number of threads running in JMeter",
 	}, []string{"collection_id", "plan_id", "run_id", "engine_no"})
 
+	// Both of the throughput gauges are reported by engines. Target RPS is only set when the plan
+	// is configured with a rps target.
+	TargetRPSGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "shibuya",
+		Name:      "target_rps_gauge",
+		Help:      "Target requests per second of an engine",
+	}, []string{"collection_id", "plan_id", "run_id", "engine_no"})
+
+	AchievedRPSGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "shibuya",
+		Name:      "achieved_rps_gauge",
+		Help:      "Requests per second achieved by an engine",
+	}, []string{"collection_id", "plan_id", "run_id", "engine_no"})
+
+	// Reported by engines after splitting the csv files so the distribution can be checked
+	CSVRowsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "shibuya",
+		Name:      "csv_rows_gauge",
+		Help:      "Rows of a csv file received by an engine",
+	}, []string{"collection_id", "plan_id", "run_id", "engine_no", "file"})
+
+	// Set by the controller when the engines are committed to start at the same time
+	StartSkewGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "shibuya",
+		Name:      "start_skew_seconds",
+		Help:      "How late an engine started the test compared to the requested time, by the clock of the controller",
+	}, []string{"collection_id", "plan_id", "run_id", "engine_no"})
+
 	CpuGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "shibuya",
 		Name:      "cpu_gauge",
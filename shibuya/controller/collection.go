@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/rakutentech/shibuya/shibuya/config"
 	enginesModel "github.com/rakutentech/shibuya/shibuya/engines/model"
@@ -15,6 +16,7 @@ func prepareCollection(collection *model.Collection) []*enginesModel.EngineDataC
 	planCount := len(collection.ExecutionPlans)
 	edc := enginesModel.EngineDataConfig{
 		EngineData: map[string]*model.ShibuyaFile{},
+		Properties: collection.Properties,
 	}
 	engineDataConfigs := edc.DeepCopies(planCount)
 	for i := 0; i < planCount; i++ {
@@ -24,8 +26,12 @@ func prepareCollection(collection *model.Collection) []*enginesModel.EngineDataC
 				Filepath:     d.Filepath,
 				TotalSplits:  1,
 				CurrentSplit: 0,
+				Version:      d.Version,
+				Checksum:     d.Checksum,
+				Rows:         d.Rows,
+				CSVSettings:  d.CSVSettings,
 			}
-			if collection.CSVSplit {
+			if d.ShouldSplit(collection.CSVSplit) {
 				sf.TotalSplits = planCount
 				sf.CurrentSplit = i
 			}
@@ -57,6 +63,10 @@ func (c *Controller) TermAndPurgeCollection(collection *model.Collection) (err e
 		}
 	}()
 	c.TermCollection(collection, true)
+	// Purging also cancels the launch if it's still waiting in the queue
+	if err = model.DequeueLaunch(collection.ID); err != nil {
+		return err
+	}
 	if err = c.Scheduler.PurgeCollection(collection.ID); err != nil {
 		return err
 	}
@@ -81,6 +91,7 @@ func (c *Controller) TriggerCollection(collection *model.Collection) error {
 		return err
 	}
 	engineDataConfigs := prepareCollection(collection)
+	plans := []*model.Plan{}
 	for _, ep := range collection.ExecutionPlans {
 		plan, err := model.GetPlan(ep.PlanID)
 		if err != nil {
@@ -89,44 +100,45 @@ func (c *Controller) TriggerCollection(collection *model.Collection) error {
 		if plan.TestFile == nil {
 			return fmt.Errorf("Triggering plan aborted. There is no Test file (.jmx) in this plan %d", plan.ID)
 		}
+		plans = append(plans, plan)
+	}
+	dataFiles := append([]*model.ShibuyaFile{}, collection.Data...)
+	for _, plan := range plans {
+		dataFiles = append(dataFiles, plan.Data...)
+	}
+	if err := model.CheckJars(collection.ProjectID, dataFiles); err != nil {
+		return err
 	}
 	runID, err := collection.StartRun()
 	if err != nil {
 		return err
 	}
-	errs := make(chan error, len(collection.ExecutionPlans))
-	defer close(errs)
-	for i, ep := range collection.ExecutionPlans {
-		go func(i int, ep *model.ExecutionPlan) {
-			// We wait for all the engines. Because we can only all the plan into running status
-			// When all the engines are triggered
-
-			pc := NewPlanController(ep, collection, c.Scheduler)
-			if err := pc.trigger(engineDataConfigs[i], runID); err != nil {
-				errs <- err
-				return
-			}
-			// We don't wait all the engines. Because stream establishment can take some time
-			// We don't want the UI to be freeze for long time
-			if err := pc.subscribe(&c.connectedEngines, c.readingEngines); err != nil {
-				errs <- err
-				return
-			}
-			if err := model.AddRunningPlan(collection.ID, ep.PlanID); err != nil {
-				errs <- err
-				return
-			}
-			errs <- nil
-		}(i, ep)
+	// Record the versions of the files so the run can be reproduced later
+	if err := model.AddRunFiles(runID, 0, collection.Data); err != nil {
+		log.Error(err)
 	}
-	triggerErrors := []error{}
-	for i := 0; i < len(collection.ExecutionPlans); i++ {
-		if err := <-errs; err != nil {
-			triggerErrors = append(triggerErrors, err)
+	for _, plan := range plans {
+		if err := model.AddRunFiles(runID, plan.ID, append([]*model.ShibuyaFile{plan.TestFile}, plan.Data...)); err != nil {
+			log.Error(err)
+		}
+	}
+	// Plans with a start delay or a dependency are started later by checkPendingPlans. Every plan is
+	// pending until its engines are running so the dependent plans can tell whether it's finished.
+	if err := model.DeletePendingPlans(collection.ID); err != nil {
+		return err
+	}
+	immediatePlans := []int{}
+	for i, ep := range collection.ExecutionPlans {
+		if err := model.AddPendingPlan(collection.ID, runID, ep, !ep.IsDeferred()); err != nil {
+			return err
+		}
+		if !ep.IsDeferred() {
+			immediatePlans = append(immediatePlans, i)
 		}
 	}
+	triggerErrors := c.startPlans(collection, immediatePlans, engineDataConfigs, runID)
 	collection.NewRun(runID)
-	if len(triggerErrors) == len(collection.ExecutionPlans) {
+	if len(immediatePlans) > 0 && len(triggerErrors) == len(immediatePlans) {
 		// every plan in collection has error
 		c.TermCollection(collection, true)
 	}
@@ -136,7 +148,82 @@ func (c *Controller) TriggerCollection(collection *model.Collection) error {
 	return nil
 }
 
+// startPlans starts the execution plans at the indexes in two phases. All the engines first prepare the test
+// data, which can take a while for big files. Then they start at the same time so the ramp up is not skewed.
+// The plans are removed from the pending plans whether they are started or not. The plans waiting for a plan
+// which fails to start are cancelled.
+func (c *Controller) startPlans(collection *model.Collection, indexes []int,
+	engineDataConfigs []*enginesModel.EngineDataConfig, runID int64) []error {
+	type preparedPlan struct {
+		pc      *PlanController
+		engines []shibuyaEngine
+		err     error
+	}
+	prepared := make(chan *preparedPlan, len(indexes))
+	defer close(prepared)
+	for _, i := range indexes {
+		go func(i int, ep *model.ExecutionPlan) {
+			pc := NewPlanController(ep, collection, c.Scheduler)
+			engines, err := pc.prepareEngines(engineDataConfigs[i], runID)
+			prepared <- &preparedPlan{pc, engines, err}
+		}(i, collection.ExecutionPlans[i])
+	}
+	preparedPlans := []*preparedPlan{}
+	triggerErrors := []error{}
+	for range indexes {
+		pp := <-prepared
+		if pp.err != nil {
+			c.cancelDependentPlans(collection.ID, pp.pc.ep.PlanID)
+			model.DeletePendingPlan(collection.ID, pp.pc.ep.PlanID)
+			triggerErrors = append(triggerErrors, pp.err)
+			continue
+		}
+		preparedPlans = append(preparedPlans, pp)
+	}
+	startAt := time.Now().Add(time.Duration(config.SC.ExecutorConfig.StartLeadTime) * time.Second)
+	errs := make(chan error, len(preparedPlans))
+	defer close(errs)
+	for _, pp := range preparedPlans {
+		go func(pp *preparedPlan) {
+			defer model.DeletePendingPlan(collection.ID, pp.pc.ep.PlanID)
+			err := c.commitPlan(collection, pp.pc, pp.engines, runID, startAt)
+			if err != nil {
+				c.cancelDependentPlans(collection.ID, pp.pc.ep.PlanID)
+			}
+			errs <- err
+		}(pp)
+	}
+	for range preparedPlans {
+		if err := <-errs; err != nil {
+			triggerErrors = append(triggerErrors, err)
+		}
+	}
+	return triggerErrors
+}
+
+func (c *Controller) commitPlan(collection *model.Collection, pc *PlanController, engines []shibuyaEngine,
+	runID int64, startAt time.Time) error {
+	// We wait for all the engines. Because we can only all the plan into running status
+	// When all the engines are triggered
+	if err := pc.commit(engines, runID, startAt); err != nil {
+		return err
+	}
+	// We don't wait all the engines. Because stream establishment can take some time
+	// We don't want the UI to be freeze for long time
+	// When another replica reads the engines, it subscribes to them once the plan is running.
+	if c.readsEngines() {
+		if err := pc.subscribe(&c.connectedEngines, c.readingEngines); err != nil {
+			return err
+		}
+	}
+	return model.AddRunningPlan(collection.ID, pc.ep.PlanID)
+}
+
 func (c *Controller) TermCollection(collection *model.Collection, force bool) (e error) {
+	// Plans which have not started yet are cancelled
+	if err := model.DeletePendingPlans(collection.ID); err != nil {
+		return err
+	}
 	eps, err := collection.GetExecutionPlans()
 	if err != nil {
 		return err
@@ -150,8 +237,8 @@ func (c *Controller) TermCollection(collection *model.Collection, force bool) (e
 		wg.Add(1)
 		go func(ep *model.ExecutionPlan) {
 			defer wg.Done()
-			pc := NewPlanController(ep, collection, nil) // we don't need scheduler here
-			if err := pc.term(force, &c.connectedEngines); err != nil {
+			pc := NewPlanController(ep, collection, c.Scheduler)
+			if err := pc.term(force, currRunID, &c.connectedEngines); err != nil {
 				log.Error(err)
 				e = err
 			}
@@ -163,3 +250,90 @@ func (c *Controller) TermCollection(collection *model.Collection, force bool) (e
 	collection.RunFinish(currRunID)
 	return e
 }
+
+func (c *Controller) changeCollectionSampling(collection *model.Collection, pause bool) error {
+	eps, err := collection.GetExecutionPlans()
+	if err != nil {
+		return err
+	}
+	runningPlans, err := model.GetRunningPlansByCollection(collection.ID)
+	if err != nil {
+		return err
+	}
+	running := make(map[int64]bool)
+	for _, rp := range runningPlans {
+		running[rp.PlanID] = true
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	samplingErrors := []error{}
+	for _, ep := range eps {
+		// Finished plans have no samplers to pause
+		if !running[ep.PlanID] {
+			continue
+		}
+		wg.Add(1)
+		go func(ep *model.ExecutionPlan) {
+			defer wg.Done()
+			pc := NewPlanController(ep, collection, c.Scheduler)
+			if err := pc.changeSampling(pause); err != nil {
+				mu.Lock()
+				samplingErrors = append(samplingErrors, err)
+				mu.Unlock()
+			}
+		}(ep)
+	}
+	wg.Wait()
+	if len(samplingErrors) > 0 {
+		return fmt.Errorf("Changing sampling errors %v", samplingErrors)
+	}
+	return nil
+}
+
+// PauseCollection stops all the engines of the current run from sending requests
+// without terminating the test. The paused period is recorded in the run history.
+// The pause is recorded first so concurrent requests are rejected before the engines are signalled.
+func (c *Controller) PauseCollection(collection *model.Collection) error {
+	runID, err := collection.GetCurrentRun()
+	if err != nil {
+		return err
+	}
+	if runID == 0 {
+		return &model.DBError{Message: "There is no running test in the collection"}
+	}
+	if err := model.PauseRun(runID); err != nil {
+		return err
+	}
+	if err := c.changeCollectionSampling(collection, true); err != nil {
+		// Some engines might be paused already
+		if err := c.changeCollectionSampling(collection, false); err != nil {
+			log.Error(err)
+		}
+		if err := model.CancelRunPause(runID); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Controller) ResumeCollection(collection *model.Collection) error {
+	runID, err := collection.GetCurrentRun()
+	if err != nil {
+		return err
+	}
+	if runID == 0 {
+		return &model.DBError{Message: "There is no running test in the collection"}
+	}
+	if err := model.ResumeRun(runID); err != nil {
+		return err
+	}
+	if err := c.changeCollectionSampling(collection, false); err != nil {
+		// The run stays paused so resuming can be retried
+		if err := model.CancelRunResume(runID); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -24,14 +26,18 @@ import (
 )
 
 type shibuyaEngine interface {
-	trigger(edc *enginesModel.EngineDataConfig) error
+	prepare(edc *enginesModel.EngineDataConfig) error
+	commit(startAt time.Time) (*enginesModel.StartResult, error)
 	deploy(scheduler.EngineScheduler) error
 	subscribe(runID int64) error
 	progress() bool
 	readMetrics() chan *shibuyaMetric
 	reachable(*scheduler.K8sClientManager) bool
 	closeStream()
-	terminate(force bool) error
+	subscribedRun() (collectionID, runID int64)
+	terminate(force bool) (*enginesModel.StopResult, error)
+	pause() error
+	resume() error
 	EngineID() int
 	updateEngineUrl(url string)
 }
@@ -46,6 +52,11 @@ var engineHttpClient = &http.Client{
 	Timeout: 30 * time.Second,
 }
 
+// The engines start Jmeter before replying to the prepare request
+var prepareHttpClient = &http.Client{
+	Timeout: engineHttpClient.Timeout + enginesModel.TestStartTimeout,
+}
+
 type shibuyaMetric struct {
 	threads      float64
 	latency      float64
@@ -81,7 +92,7 @@ func sendTriggerRequest(url string, edc *enginesModel.EngineDataConfig) (*http.R
 	json.NewEncoder(body).Encode(&edc)
 	req, _ := http.NewRequest("POST", url, body)
 	req.Header.Set("Content-Type", "application/json")
-	return engineHttpClient.Do(req)
+	return prepareHttpClient.Do(req)
 }
 
 func (be *baseEngine) EngineID() int {
@@ -138,36 +149,88 @@ func (be *baseEngine) reachable(manager *scheduler.K8sClientManager) bool {
 	return manager.ServiceReachable(be.engineUrl)
 }
 
+// closeStream can also be called on the engines which are not subscribed, e.g. when the plan is
+// terminated by a replica not reading the engines.
 func (be *baseEngine) closeStream() {
+	if be.stream == nil {
+		return
+	}
 	be.cancel()
 	be.stream.Close()
 }
 
-func (be *baseEngine) terminate(force bool) error {
+func (be *baseEngine) subscribedRun() (int64, int64) {
+	return be.collectionID, be.runID
+}
+
+func (be *baseEngine) terminate(force bool) (*enginesModel.StopResult, error) {
 	// If it's force, it means we are purging the collection
 	// In this case, we don't send the stop request to test containers
 	if force {
-		return nil
+		return nil, nil
 	}
 	base := be.makeBaseUrl()
 	stopUrl := fmt.Sprintf(base, be.engineUrl, "stop")
-	resp, err := engineHttpClient.Post(stopUrl, "application/x-www-form-urlencoded", nil)
+	timeout := config.SC.ExecutorConfig.GracefulStopTimeout
+	// The engine only replies after the test is stopped, which can take the whole graceful timeout
+	// plus the shutdown window in the worst case.
+	stopHttpClient := &http.Client{
+		Timeout: time.Duration(timeout)*time.Second + enginesModel.ShutdownWindow + engineHttpClient.Timeout,
+	}
+	resp, err := stopHttpClient.PostForm(stopUrl, url.Values{"timeout": {strconv.Itoa(timeout)}})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	be.closeStream()
-	return nil
+	// Engines reply with an empty body when the test is already finished
+	result := new(enginesModel.StopResult)
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func (be *baseEngine) sendSamplingRequest(action string) error {
+	base := be.makeBaseUrl()
+	url := fmt.Sprintf(base, be.engineUrl, action)
+	return utils.Retry(func() error {
+		resp, err := engineHttpClient.Post(url, "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// The engine has already finished the test. There is nothing to pause or resume
+		if resp.StatusCode == http.StatusNotFound {
+			log.Printf("%s is not running. Skip %s", be.engineUrl, action)
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Engine failed to %s: %d %s", action, resp.StatusCode, resp.Status)
+		}
+		return nil
+	}, nil)
+}
+
+func (be *baseEngine) pause() error {
+	return be.sendSamplingRequest("pause")
+}
+
+func (be *baseEngine) resume() error {
+	return be.sendSamplingRequest("resume")
 }
 
 func (be *baseEngine) deploy(manager scheduler.EngineScheduler) error {
 	return manager.DeployEngine(be.projectID, be.collectionID, be.planID, be.ID, be.ExecutorContainer)
 }
 
-func (be *baseEngine) trigger(edc *enginesModel.EngineDataConfig) error {
+var errEngineRejected = errors.New("Engine rejected the test")
+
+// prepare makes the engine download and prepare the test data. The test is started by commit.
+func (be *baseEngine) prepare(edc *enginesModel.EngineDataConfig) error {
 	engineUrl := be.engineUrl
 	base := be.makeBaseUrl()
-	url := fmt.Sprintf(base, engineUrl, "start")
+	url := fmt.Sprintf(base, engineUrl, "prepare")
 	return utils.Retry(func() error {
 		resp, err := sendTriggerRequest(url, edc)
 		if err != nil {
@@ -181,12 +244,60 @@ func (be *baseEngine) trigger(edc *enginesModel.EngineDataConfig) error {
 		if resp.StatusCode == http.StatusNotFound {
 			return fmt.Errorf("%w: Some test files are missing. Please stop collection re-upload them", sos.FileNotFoundError())
 		}
+		// The test plan cannot be run as it is so there is no point to retry
+		if resp.StatusCode == http.StatusBadRequest {
+			reason, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%w: %s", errEngineRejected, strings.TrimSpace(string(reason)))
+		}
 		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("Engine failed to trigger: %d %s", resp.StatusCode, resp.Status)
+			return fmt.Errorf("Engine failed to prepare: %d %s", resp.StatusCode, resp.Status)
 		}
-		log.Printf("%s is triggered", engineUrl)
+		log.Printf("%s is prepared", engineUrl)
 		return nil
-	}, sos.FileNotFoundError())
+	}, sos.FileNotFoundError(), errEngineRejected)
+}
+
+// commit makes the prepared engine start the test at startAt. The engine replies once the test is started.
+// The result is nil when the engine was already running. The clock offset of the engine is taken from when
+// the request was sent, so it also counts the latency of the request.
+func (be *baseEngine) commit(startAt time.Time) (*enginesModel.StartResult, error) {
+	engineUrl := be.engineUrl
+	base := be.makeBaseUrl()
+	commitUrl := fmt.Sprintf(base, engineUrl, "commit")
+	commitHttpClient := &http.Client{
+		Timeout: time.Until(startAt) + enginesModel.TestStartTimeout + engineHttpClient.Timeout,
+	}
+	var result *enginesModel.StartResult
+	err := utils.Retry(func() error {
+		sentTime := time.Now()
+		resp, err := commitHttpClient.PostForm(commitUrl, url.Values{"start_at": {strconv.FormatInt(startAt.UnixMilli(), 10)}})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			log.Printf("%s is already triggered", engineUrl)
+			return nil
+		}
+		if resp.StatusCode == http.StatusBadRequest {
+			reason, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%w: %s", errEngineRejected, strings.TrimSpace(string(reason)))
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Engine failed to start: %d %s", resp.StatusCode, resp.Status)
+		}
+		result = new(enginesModel.StartResult)
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return err
+		}
+		result.ClockOffset = result.ReceivedTime.Sub(sentTime)
+		return nil
+	}, errEngineRejected)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s is triggered", engineUrl)
+	return result, nil
 }
 
 func (be *baseEngine) readMetrics() chan *shibuyaMetric {
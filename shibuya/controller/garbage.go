@@ -21,7 +21,7 @@ func (c *Controller) CheckRunningThenTerminate() {
 					collection := j.collection
 					currRunID, err := collection.GetCurrentRun()
 					if currRunID != int64(0) {
-						pc.term(false, &c.connectedEngines)
+						pc.term(false, currRunID, &c.connectedEngines)
 						log.Printf("Plan %d is terminated.", j.ep.PlanID)
 					}
 					if err != nil {
@@ -30,6 +30,10 @@ func (c *Controller) CheckRunningThenTerminate() {
 					if t, err := collection.HasRunningPlan(); t || err != nil {
 						continue jobLoop
 					}
+					// The run is not finished while some plans are waiting for their start
+					if t, err := collection.HasPendingPlan(); t || err != nil {
+						continue jobLoop
+					}
 					collection.StopRun()
 					collection.RunFinish(currRunID)
 				}
@@ -38,6 +42,7 @@ func (c *Controller) CheckRunningThenTerminate() {
 	}
 	log.Printf("Getting all the running plans for %s", config.SC.Context)
 	for {
+		c.runChecks.waitForLeadership()
 		runningPlans, err := model.GetRunningPlans()
 		if err != nil {
 			log.Error(err)
@@ -111,6 +116,7 @@ func isCollectionStale(rh *model.RunHistory, launchTime time.Time) (bool, error)
 func (c *Controller) AutoPurgeDeployments() {
 	log.Info("Start the loop for purging idle engines")
 	for {
+		c.backgroundTasks.waitForLeadership()
 		deployedCollections, err := c.Scheduler.GetDeployedCollections()
 		if err != nil {
 			log.Error(err)
@@ -163,6 +169,7 @@ func (c *Controller) AutoPurgeProjectIngressController() {
 	}
 	log.Println(fmt.Sprintf("Project ingress lifespan is %v. And the GC Interval is %v", ingressLifespan, gcInterval))
 	for {
+		c.backgroundTasks.waitForLeadership()
 		deployedServices, err := c.Scheduler.GetDeployedServices()
 		if err != nil {
 			continue
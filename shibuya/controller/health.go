@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/rakutentech/shibuya/shibuya/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+// Replacing an engine does not help when the failure is caused by the configuration, for example a wrong image.
+// So we give up after some attempts and users can still see the failure reason in the engines detail.
+const maxEngineReplacements = 3
+
+// AutoReplaceFailedEngines watches the engines of all the launched collections. Engines can fail after
+// they are deployed, for example being evicted or crashlooping. Without replacing them, the collection
+// would never have all the engines deployed and users have to purge and launch again.
+func (c *Controller) AutoReplaceFailedEngines() {
+	log.Info("Start the loop for replacing failed engines")
+	// collection id -> engine key -> replacement attempts
+	replacements := make(map[int64]map[string]int)
+	for {
+		time.Sleep(30 * time.Second)
+		c.backgroundTasks.waitForLeadership()
+		deployedCollections, err := model.GetLaunchingCollectionByContext(config.SC.Context)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		launching := make(map[int64]map[string]int)
+		for _, collectionID := range deployedCollections {
+			attempts, ok := replacements[collectionID]
+			if !ok {
+				attempts = make(map[string]int)
+			}
+			launching[collectionID] = attempts
+			failedEngines, err := c.Scheduler.GetFailedEngines(collectionID)
+			if errors.Is(err, scheduler.FeatureUnavailable) {
+				log.Info("Scheduler does not support replacing failed engines")
+				return
+			}
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if len(failedEngines) == 0 {
+				continue
+			}
+			collection, err := model.GetCollection(collectionID)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			for _, fe := range failedEngines {
+				key := makePlanEngineKey(collectionID, fe.PlanID, fe.EngineID)
+				if attempts[key] >= maxEngineReplacements {
+					continue
+				}
+				ep, err := model.GetExecutionPlan(collectionID, fe.PlanID)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+				attempts[key] += 1
+				log.Printf("Engine %s is failed due to %s, replacing it. Attempt %d", key, fe.Reason, attempts[key])
+				pc := NewPlanController(ep, collection, c.Scheduler)
+				if err := c.Scheduler.DeployEngine(collection.ProjectID, collectionID, fe.PlanID, fe.EngineID,
+					pc.engineConfig()); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+		// Purged collections start with a fresh count when they are launched again
+		replacements = launching
+	}
+}
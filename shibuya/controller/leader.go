@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/rakutentech/shibuya/shibuya/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Another replica takes over the lease when the leader has not renewed it for this long
+	leaseTTL           = 30 * time.Second
+	leaseRenewInterval = 10 * time.Second
+
+	// Finishing the runs and starting the pending plans
+	runChecksLease = "run-checks"
+	// Purging idle engines and ingress controllers, replacing failed engines and the other periodic tasks
+	backgroundTasksLease = "background-tasks"
+)
+
+// leaderElector makes sure a group of background tasks is run by only one of the replicas at a time.
+// The leader keeps renewing a lease in the DB. When it stops, e.g. the replica is gone, another replica
+// takes the lease over after it expires.
+type leaderElector struct {
+	lease  string
+	holder string
+	leader atomic.Bool
+}
+
+func newLeaderElector(lease string) *leaderElector {
+	hostname, _ := os.Hostname()
+	return &leaderElector{
+		// Leases of different contexts are independent as their tasks work on different clusters
+		lease:  fmt.Sprintf("%s-%s", lease, config.SC.Context),
+		holder: fmt.Sprintf("%s-%s", hostname, utils.RandStringRunes(6)),
+	}
+}
+
+func (le *leaderElector) run() {
+	for {
+		acquired, err := model.AcquireLease(le.lease, le.holder, leaseTTL)
+		if err != nil {
+			// The lease cannot be renewed so another replica may take it over soon
+			log.Error(err)
+			acquired = false
+		}
+		if was := le.leader.Swap(acquired); was != acquired {
+			if acquired {
+				log.Infof("%s became the leader of %s", le.holder, le.lease)
+			} else {
+				log.Infof("%s is no longer the leader of %s", le.holder, le.lease)
+			}
+		}
+		time.Sleep(leaseRenewInterval)
+	}
+}
+
+func (le *leaderElector) isLeader() bool {
+	return le.leader.Load()
+}
+
+// waitForLeadership blocks the task until the replica is the leader. Tasks call it before every round
+// of their work so they stop soon after the leadership is lost.
+func (le *leaderElector) waitForLeadership() {
+	for !le.isLeader() {
+		time.Sleep(time.Second)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/rakutentech/shibuya/shibuya/model"
 	"github.com/rakutentech/shibuya/shibuya/scheduler"
 	smodel "github.com/rakutentech/shibuya/shibuya/scheduler/model"
-	"github.com/rakutentech/shibuya/shibuya/utils"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,7 +18,7 @@ type Controller struct {
 	StatusStore        sync.Map
 	ApiNewClients      chan *ApiMetricStream
 	ApiStreamClients   map[string]map[string]chan *ApiMetricStreamEvent
-	ApiMetricStreamBus chan *ApiMetricStreamEvent
+	ApiMetricStreamBus <-chan *ApiMetricStreamEvent
 	ApiClosingClients  chan *ApiMetricStream
 	readingEngines     chan shibuyaEngine
 	connectedEngines   sync.Map
@@ -27,6 +26,9 @@ type Controller struct {
 	httpClient         *http.Client
 	schedulerKind      string
 	Scheduler          scheduler.EngineScheduler
+	runChecks          *leaderElector
+	backgroundTasks    *leaderElector
+	metricsBus         metricsBus
 }
 
 func NewController() *Controller {
@@ -35,11 +37,13 @@ func NewController() *Controller {
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		ApiMetricStreamBus: make(chan *ApiMetricStreamEvent),
-		ApiClosingClients:  make(chan *ApiMetricStream),
-		ApiNewClients:      make(chan *ApiMetricStream),
-		ApiStreamClients:   make(map[string]map[string]chan *ApiMetricStreamEvent),
-		readingEngines:     make(chan shibuyaEngine),
+		ApiClosingClients: make(chan *ApiMetricStream),
+		ApiNewClients:     make(chan *ApiMetricStream),
+		ApiStreamClients:  make(map[string]map[string]chan *ApiMetricStreamEvent),
+		readingEngines:    make(chan shibuyaEngine),
+		runChecks:         newLeaderElector(runChecksLease),
+		backgroundTasks:   newLeaderElector(backgroundTasksLease),
+		metricsBus:        newMetricsBus(config.SC.MetricsBus),
 	}
 	c.schedulerKind = config.SC.ExecutorConfig.Cluster.Kind
 	c.Scheduler = scheduler.NewEngineScheduler(config.SC.ExecutorConfig.Cluster)
@@ -61,7 +65,12 @@ type ApiMetricStreamEvent struct {
 func (c *Controller) StartRunning() {
 	// First we do is to resume the running plans
 	// This method should not be moved as later goroutines rely on it.
-	c.resumeRunningPlans()
+	// With a shared metrics bus, the leader reads the engines and the metrics reach the clients of all the replicas.
+	if !c.metricsBus.shared() {
+		c.resumeRunningPlans()
+	}
+	go c.keepReadingRunningPlans()
+	c.ApiMetricStreamBus = c.metricsBus.subscribe()
 	go c.streamToApi()
 	go c.readConnectedEngines()
 	go c.fetchEngineMetrics()
@@ -69,7 +78,9 @@ func (c *Controller) StartRunning() {
 	// We can only move this func to an isolated controller process later
 	// because when we are terminating, we also need to close the opening connections
 	// Otherwise we might face connection leaks
+	go c.runChecks.run()
 	go c.CheckRunningThenTerminate()
+	go c.checkPendingPlans()
 	if !config.SC.DistributedMode {
 		log.Info("Controller is running in non-distributed mode!")
 		go c.IsolateBackgroundTasks()
@@ -78,8 +89,14 @@ func (c *Controller) StartRunning() {
 
 // In distributed mode, the func will be running as a standalone process
 // In non-distributed mode, the func will be run as a goroutine.
+// Only the leader among the replicas runs the tasks.
 func (c *Controller) IsolateBackgroundTasks() {
+	go c.backgroundTasks.run()
 	go c.AutoPurgeDeployments()
+	go c.AutoReplaceFailedEngines()
+	go c.AutoLaunchQueuedCollections()
+	go c.AutoRecordNodesCount()
+	go c.AutoExportMonthlyUsageReport()
 	c.AutoPurgeProjectIngressController()
 }
 
@@ -145,11 +162,84 @@ func (c *Controller) resumeRunningPlans() {
 		if err != nil {
 			continue
 		}
+		if c.isPlanConnected(collection.ID, ep) {
+			continue
+		}
 		pc := NewPlanController(ep, collection, c.Scheduler)
 		pc.subscribe(&c.connectedEngines, c.readingEngines)
 	}
 }
 
+func (c *Controller) isPlanConnected(collectionID int64, ep *model.ExecutionPlan) bool {
+	for i := 0; i < ep.Engines; i++ {
+		if _, ok := c.connectedEngines.Load(makePlanEngineKey(collectionID, ep.PlanID, i)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// readsEngines tells whether the replica should read the engines it triggers. With a shared metrics bus,
+// only the leader of the run checks reads the engines so every engine is read once.
+func (c *Controller) readsEngines() bool {
+	return !c.metricsBus.shared() || c.runChecks.isLeader()
+}
+
+// keepReadingRunningPlans closes the streams of the finished runs. Only the leader of the run checks
+// terminates the plans so the other replicas would leak the streams of the runs they triggered otherwise.
+// With a shared metrics bus, the leader also reads the engines of the running plans, including the plans
+// triggered by the other replicas, and the engines are no longer read once the leadership is lost.
+func (c *Controller) keepReadingRunningPlans() {
+	log.Printf("Reading the engines of the running plans for %s", config.SC.Context)
+	for {
+		switch {
+		case !c.metricsBus.shared():
+			c.closeFinishedRuns()
+		case c.runChecks.isLeader():
+			c.closeFinishedRuns()
+			c.resumeRunningPlans()
+		default:
+			c.closeConnectedEngines(func(shibuyaEngine) bool { return true })
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// closeFinishedRuns closes the streams of the engines whose run was stopped, e.g. by another replica
+func (c *Controller) closeFinishedRuns() {
+	currentRuns := make(map[int64]int64)
+	c.closeConnectedEngines(func(engine shibuyaEngine) bool {
+		collectionID, runID := engine.subscribedRun()
+		currRunID, ok := currentRuns[collectionID]
+		if !ok {
+			collection, err := model.GetCollection(collectionID)
+			if err != nil {
+				return false
+			}
+			if currRunID, err = collection.GetCurrentRun(); err != nil {
+				return false
+			}
+			currentRuns[collectionID] = currRunID
+		}
+		return currRunID != runID
+	})
+}
+
+func (c *Controller) closeConnectedEngines(shouldClose func(shibuyaEngine) bool) {
+	c.connectedEngines.Range(func(key, item interface{}) bool {
+		engine := item.(shibuyaEngine)
+		if !shouldClose(engine) {
+			return true
+		}
+		// The engine can be terminated at the same time
+		if _, loaded := c.connectedEngines.LoadAndDelete(key); loaded {
+			engine.closeStream()
+			log.Printf("Stream of engine %s is closed", key)
+		}
+		return true
+	})
+}
+
 func (c *Controller) readConnectedEngines() {
 	for engine := range c.readingEngines {
 		go func(engine shibuyaEngine) {
@@ -163,11 +253,11 @@ func (c *Controller) readConnectedEngines() {
 				status := metric.status
 				latency := metric.latency
 				threads := metric.threads
-				c.ApiMetricStreamBus <- &ApiMetricStreamEvent{
+				c.metricsBus.publish(&ApiMetricStreamEvent{
 					CollectionID: metric.collectionID,
 					PlanID:       metric.planID,
 					Raw:          metric.raw,
-				}
+				})
 				config.StatusCounter.WithLabelValues(metric.collectionID, metric.planID, runID, engineID, label, status).Inc()
 				config.CollectionLatencySummary.WithLabelValues(collectionID, runID).Observe(latency)
 				config.PlanLatencySummary.WithLabelValues(collectionID, planID, runID).Observe(latency)
@@ -181,61 +271,33 @@ func (c *Controller) readConnectedEngines() {
 	}
 }
 
-func (c *Controller) DeployCollection(collection *model.Collection) error {
+func (c *Controller) CollectionStatus(collection *model.Collection) (*smodel.CollectionStatus, error) {
 	eps, err := collection.GetExecutionPlans()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	nodesCount := int64(0)
-	enginesCount := 0
-	vu := 0
-	for _, e := range eps {
-		enginesCount += e.Engines
-		vu += e.Engines * e.Concurrency
+	cs, err := c.Scheduler.CollectionStatus(collection.ProjectID, collection.ID, eps)
+	if err != nil {
+		return nil, err
 	}
-	sid := ""
-	if project, err := model.GetProject(collection.ProjectID); err == nil {
-		sid = project.SID
+	ql, err := model.GetQueuedLaunch(collection.ID, config.SC.Context)
+	if err != nil {
+		return nil, err
 	}
-	if err := collection.NewLaunchEntry(sid, config.SC.Context, int64(enginesCount), nodesCount, int64(vu)); err != nil {
-		return err
+	if ql != nil {
+		cs.QueuePosition = ql.Position
 	}
-	err = utils.Retry(func() error {
-		return c.Scheduler.ExposeProject(collection.ProjectID)
-	}, nil)
-	if err != nil {
-		return err
-	}
-	// we will assume collection deployment will always be successful
-	// For some large deployments, it might take more than 1 min to finish, which could result 504 at gateway side
-	// So we do not wait for the deployment to be finished.
-	go func() {
-		var wg sync.WaitGroup
-		now_ := time.Now()
-		for _, e := range eps {
-			wg.Add(1)
-			go func(ep *model.ExecutionPlan) {
-				defer wg.Done()
-				pc := NewPlanController(ep, collection, c.Scheduler)
-				utils.Retry(func() error {
-					return pc.deploy()
-				}, nil)
-			}(e)
-		}
-		wg.Wait()
-		duration := time.Now().Sub(now_)
-		log.Infof("All engines deployment are finished for collection %d, total duration: %.2f seconds",
-			collection.ID, duration.Seconds())
-	}()
-	return nil
-}
-
-func (c *Controller) CollectionStatus(collection *model.Collection) (*smodel.CollectionStatus, error) {
-	eps, err := collection.GetExecutionPlans()
+	runID, err := collection.GetCurrentRun()
 	if err != nil {
 		return nil, err
 	}
-	cs, err := c.Scheduler.CollectionStatus(collection.ProjectID, collection.ID, eps)
+	if runID > 0 {
+		cs.Paused, err = model.IsRunPaused(runID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cs.PendingPlans, err = model.GetPendingPlansByCollection(collection.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	localMetricsBusProvider = "local"
+	redisMetricsBusProvider = "redis"
+)
+
+var allMetricsBusProviders = []string{localMetricsBusProvider, redisMetricsBusProvider}
+
+// metricsBus carries the metrics read from the engines to the replicas serving the metric streams
+type metricsBus interface {
+	publish(event *ApiMetricStreamEvent)
+	// subscribe returns the events published by all the replicas sharing the bus, including this one
+	subscribe() <-chan *ApiMetricStreamEvent
+	// shared tells whether the events reach the other replicas. Only one replica needs to read the engines then.
+	shared() bool
+}
+
+func newMetricsBus(cfg *config.MetricsBus) metricsBus {
+	switch cfg.Provider {
+	case "", localMetricsBusProvider:
+		return newLocalMetricsBus()
+	case redisMetricsBusProvider:
+		return newRedisMetricsBus(cfg)
+	}
+	log.Fatalf("Unknown metrics bus %s, valid providers are %v", cfg.Provider, allMetricsBusProviders)
+	return nil
+}
+
+// localMetricsBus only works within the process. The metrics can only be streamed by the replica reading the engines.
+type localMetricsBus struct {
+	events chan *ApiMetricStreamEvent
+}
+
+func newLocalMetricsBus() *localMetricsBus {
+	return &localMetricsBus{
+		events: make(chan *ApiMetricStreamEvent),
+	}
+}
+
+func (lb *localMetricsBus) publish(event *ApiMetricStreamEvent) {
+	lb.events <- event
+}
+
+func (lb *localMetricsBus) subscribe() <-chan *ApiMetricStreamEvent {
+	return lb.events
+}
+
+func (lb *localMetricsBus) shared() bool {
+	return false
+}
+
+const (
+	// Events waiting to be published or streamed. Events are dropped when the broker or the streams cannot keep up
+	redisPublishBuffer   = 10000
+	redisSubscribeBuffer = 10000
+	// Events are published in batches as engines can send thousands of metrics per second
+	redisPublishBatch = 500
+	redisTimeout      = 5 * time.Second
+)
+
+// redisMetricsBus shares the events through a Redis pub/sub channel of the context.
+// The client reconnects by itself, and so does the subscription.
+type redisMetricsBus struct {
+	client   *redis.Client
+	channel  string
+	outgoing chan *ApiMetricStreamEvent
+	incoming chan *ApiMetricStreamEvent
+	// events dropped before being published and before being streamed
+	dropped         atomic.Int64
+	droppedIncoming atomic.Int64
+}
+
+func newRedisMetricsBus(cfg *config.MetricsBus) *redisMetricsBus {
+	rb := &redisMetricsBus{
+		client: redis.NewClient(&redis.Options{
+			Addr:         cfg.Url,
+			Password:     cfg.Password,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}),
+		channel:  fmt.Sprintf("shibuya-metrics-%s", config.SC.Context),
+		outgoing: make(chan *ApiMetricStreamEvent, redisPublishBuffer),
+		incoming: make(chan *ApiMetricStreamEvent, redisSubscribeBuffer),
+	}
+	go rb.keepPublishing()
+	return rb
+}
+
+func (rb *redisMetricsBus) publish(event *ApiMetricStreamEvent) {
+	select {
+	case rb.outgoing <- event:
+	default:
+		rb.dropped.Add(1)
+	}
+}
+
+func (rb *redisMetricsBus) subscribe() <-chan *ApiMetricStreamEvent {
+	go rb.readMessages()
+	return rb.incoming
+}
+
+func (rb *redisMetricsBus) shared() bool {
+	return true
+}
+
+func (rb *redisMetricsBus) keepPublishing() {
+	for event := range rb.outgoing {
+		batch := []*ApiMetricStreamEvent{event}
+	drain:
+		for len(batch) < redisPublishBatch {
+			select {
+			case event := <-rb.outgoing:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		if err := rb.client.Publish(ctx, rb.channel, payload).Err(); err != nil {
+			log.Errorf("Cannot publish to the metrics bus, %d metrics are dropped: %v", len(batch), err)
+		}
+		cancel()
+		if dropped := rb.dropped.Swap(0); dropped > 0 {
+			log.Warnf("The metrics bus is not keeping up, %d metrics are dropped", dropped)
+		}
+	}
+}
+
+// readMessages passes the events to the metric streams. A slow stream must not hold the subscription,
+// otherwise the broker would disconnect it, so events are dropped when the streams cannot keep up.
+func (rb *redisMetricsBus) readMessages() {
+	pubsub := rb.client.Subscribe(context.Background(), rb.channel)
+	defer pubsub.Close()
+	log.Printf("Subscribed to metrics bus channel %s", rb.channel)
+	for msg := range pubsub.Channel() {
+		batch := []*ApiMetricStreamEvent{}
+		if err := json.Unmarshal([]byte(msg.Payload), &batch); err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, event := range batch {
+			select {
+			case rb.incoming <- event:
+			default:
+				rb.droppedIncoming.Add(1)
+			}
+		}
+		if dropped := rb.droppedIncoming.Swap(0); dropped > 0 {
+			log.Warnf("The metric streams are not keeping up, %d metrics are dropped", dropped)
+		}
+	}
+}
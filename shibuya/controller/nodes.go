@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/rakutentech/shibuya/shibuya/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+// AutoRecordNodesCount records how many nodes every launched collection is running on into the usage history.
+// Engines are scheduled after the launch so we keep checking until the collection is purged.
+func (c *Controller) AutoRecordNodesCount() {
+	log.Info("Start the loop for recording nodes count")
+	for {
+		time.Sleep(60 * time.Second)
+		c.backgroundTasks.waitForLeadership()
+		nodesInfo, err := c.Scheduler.GetNodesInfo()
+		if errors.Is(err, scheduler.FeatureUnavailable) {
+			log.Info("Scheduler does not support reporting nodes")
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		nodesCount := make(map[int64]int64)
+		for _, ni := range nodesInfo {
+			for _, node := range ni.Nodes {
+				for _, collectionID := range node.Collections {
+					nodesCount[collectionID] += 1
+				}
+			}
+		}
+		launchingCollections, err := model.GetLaunchingCollectionByContext(config.SC.Context)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, collectionID := range launchingCollections {
+			count, ok := nodesCount[collectionID]
+			if !ok {
+				continue
+			}
+			collection := &model.Collection{ID: collectionID}
+			if err := collection.UpdateNodesCount(count); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/rakutentech/shibuya/shibuya/config"
 	enginesModel "github.com/rakutentech/shibuya/shibuya/engines/model"
@@ -28,10 +29,27 @@ func NewPlanController(ep *model.ExecutionPlan, collection *model.Collection, sc
 	}
 }
 
+// engineConfig applies the resource overrides of the plan on top of the default engine config
+func (pc *PlanController) engineConfig() *config.ExecutorContainer {
+	ec := *findEngineConfig(JmeterEngineType)
+	if pc.ep.CPU != "" {
+		ec.CPU = pc.ep.CPU
+	}
+	if pc.ep.Mem != "" {
+		ec.Mem = pc.ep.Mem
+	}
+	if pc.ep.Heap != "" {
+		ec.Heap = pc.ep.Heap
+	}
+	if pc.ep.Image != "" {
+		ec.Image = config.SC.ExecutorConfig.JmeterContainer.ResolveImage(pc.ep.Image)
+	}
+	return &ec
+}
+
 func (pc *PlanController) deploy() error {
-	engineConfig := findEngineConfig(JmeterEngineType)
 	if err := pc.scheduler.DeployPlan(pc.collection.ProjectID, pc.collection.ID, pc.ep.PlanID,
-		pc.ep.Engines, engineConfig); err != nil {
+		pc.ep.Engines, pc.engineConfig()); err != nil {
 		return err
 	}
 	return nil
@@ -41,11 +59,15 @@ func (pc *PlanController) prepare(plan *model.Plan, edc *enginesModel.EngineData
 	edc.Duration = strconv.Itoa(pc.ep.Duration)
 	edc.Concurrency = strconv.Itoa(pc.ep.Concurrency)
 	edc.Rampup = strconv.Itoa(pc.ep.Rampup)
+	// The target throughput is for the whole plan so every engine takes an equal share of it
+	if pc.ep.RPS > 0 {
+		edc.RPS = strconv.FormatFloat(float64(pc.ep.RPS)/float64(pc.ep.Engines), 'f', -1, 64)
+	}
 	engineDataConfigs := edc.DeepCopies(pc.ep.Engines)
 	for i := 0; i < pc.ep.Engines; i++ {
 		// we split the data inherited from collection if the plan specifies split too
-		if pc.ep.CSVSplit {
-			for _, ed := range engineDataConfigs[i].EngineData {
+		for _, ed := range engineDataConfigs[i].EngineData {
+			if ed.ShouldSplit(pc.ep.CSVSplit) {
 				ed.TotalSplits *= pc.ep.Engines
 				ed.CurrentSplit = (ed.CurrentSplit * pc.ep.Engines) + i
 			}
@@ -54,6 +76,7 @@ func (pc *PlanController) prepare(plan *model.Plan, edc *enginesModel.EngineData
 		engineDataConfigs[i].EngineData[plan.TestFile.Filename] = plan.TestFile
 		engineDataConfigs[i].RunID = runID
 		engineDataConfigs[i].EngineID = i
+		pc.addProperties(engineDataConfigs[i].Properties, runID, i)
 		// add all data uploaded in plans. This will override common data if same filename already exists
 		for _, d := range plan.Data {
 			sf := model.ShibuyaFile{
@@ -61,8 +84,12 @@ func (pc *PlanController) prepare(plan *model.Plan, edc *enginesModel.EngineData
 				Filepath:     d.Filepath,
 				TotalSplits:  1,
 				CurrentSplit: 0,
+				Version:      d.Version,
+				Checksum:     d.Checksum,
+				Rows:         d.Rows,
+				CSVSettings:  d.CSVSettings,
 			}
-			if pc.ep.CSVSplit {
+			if d.ShouldSplit(pc.ep.CSVSplit) {
 				sf.TotalSplits = pc.ep.Engines
 				sf.CurrentSplit = i
 			}
@@ -72,27 +99,43 @@ func (pc *PlanController) prepare(plan *model.Plan, edc *enginesModel.EngineData
 	return engineDataConfigs
 }
 
-func (pc *PlanController) trigger(engineDataConfig *enginesModel.EngineDataConfig, runID int64) error {
+// addProperties adds the properties of the plan on top of the ones of the collection, and the built-in
+// properties so the scripts can tell which engine they are running in, e.g. to partition the data
+func (pc *PlanController) addProperties(props map[string]string, runID int64, engineID int) {
+	for k, v := range pc.ep.Properties {
+		props[k] = v
+	}
+	builtins := map[string]string{
+		"engine_index":  strconv.Itoa(engineID),
+		"engine_count":  strconv.Itoa(pc.ep.Engines),
+		"run_id":        strconv.FormatInt(runID, 10),
+		"plan_id":       strconv.FormatInt(pc.ep.PlanID, 10),
+		"collection_id": strconv.FormatInt(pc.collection.ID, 10),
+	}
+	for k, v := range builtins {
+		props[model.BuiltinPropertyPrefix+k] = v
+	}
+}
+
+// prepareEngines makes all the engines of the plan ready to start the run. The engines are returned
+// so they can be committed together with the engines of the other plans.
+func (pc *PlanController) prepareEngines(engineDataConfig *enginesModel.EngineDataConfig, runID int64) ([]shibuyaEngine, error) {
 	plan, err := model.GetPlan(pc.ep.PlanID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	engineDataConfigs := pc.prepare(plan, engineDataConfig, runID)
 	engines, err := generateEnginesWithUrl(pc.ep.Engines, pc.ep.PlanID, pc.collection.ID, pc.collection.ProjectID,
 		JmeterEngineType, pc.scheduler)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	errs := make(chan error, len(engines))
 	defer close(errs)
 	planErrors := []error{}
 	for i, engine := range engines {
 		go func(engine shibuyaEngine, i int) {
-			if err := engine.trigger(engineDataConfigs[i]); err != nil {
-				errs <- err
-				return
-			}
-			errs <- nil
+			errs <- engine.prepare(engineDataConfigs[i])
 		}(engine, i)
 	}
 	for i := 0; i < len(engines); i++ {
@@ -100,10 +143,87 @@ func (pc *PlanController) trigger(engineDataConfig *enginesModel.EngineDataConfi
 			planErrors = append(planErrors, err)
 		}
 	}
+	if len(planErrors) > 0 {
+		return nil, fmt.Errorf("Trigger plan errors:%v", planErrors)
+	}
+	log.Printf("Engines of plan %d are prepared", pc.ep.PlanID)
+	return engines, nil
+}
+
+// commit starts the prepared engines at startAt and reports how late each of them started in the start skew
+// gauge. The skew is by the clock of the controller so the engines can be compared with each other.
+func (pc *PlanController) commit(engines []shibuyaEngine, runID int64, startAt time.Time) error {
+	type commitResult struct {
+		engineID int
+		result   *enginesModel.StartResult
+		err      error
+	}
+	results := make(chan commitResult, len(engines))
+	defer close(results)
+	for _, engine := range engines {
+		go func(engine shibuyaEngine) {
+			r, err := engine.commit(startAt)
+			results <- commitResult{engine.EngineID(), r, err}
+		}(engine)
+	}
+	planErrors := []error{}
+	collectionID := strconv.FormatInt(pc.collection.ID, 10)
+	planID := strconv.FormatInt(pc.ep.PlanID, 10)
+	var maxSkew time.Duration
+	for i := 0; i < len(engines); i++ {
+		r := <-results
+		if r.err != nil {
+			planErrors = append(planErrors, r.err)
+			continue
+		}
+		if r.result == nil {
+			continue
+		}
+		skew := r.result.StartedTime.Add(-r.result.ClockOffset).Sub(startAt)
+		log.Printf("Engine %d of plan %d started with %dms skew, its clock is %dms off", r.engineID, pc.ep.PlanID,
+			skew.Milliseconds(), r.result.ClockOffset.Milliseconds())
+		config.StartSkewGauge.WithLabelValues(collectionID, planID, strconv.FormatInt(runID, 10),
+			strconv.Itoa(r.engineID)).Set(skew.Seconds())
+		if skew > maxSkew {
+			maxSkew = skew
+		}
+	}
 	if len(planErrors) > 0 {
 		return fmt.Errorf("Trigger plan errors:%v", planErrors)
 	}
-	log.Printf("Triggering for plan %d is finished", pc.ep.PlanID)
+	log.Printf("Triggering for plan %d is finished. Max start skew is %dms", pc.ep.PlanID, maxSkew.Milliseconds())
+	return nil
+}
+
+// changeSampling pauses or resumes the sampling of all the engines in the plan.
+// The engines keep their threads so the test can be continued from where it was paused.
+func (pc *PlanController) changeSampling(pause bool) error {
+	engines, err := generateEnginesWithUrl(pc.ep.Engines, pc.ep.PlanID, pc.collection.ID, pc.collection.ProjectID,
+		JmeterEngineType, pc.scheduler)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(engines))
+	defer close(errs)
+	planErrors := []error{}
+	for _, engine := range engines {
+		go func(engine shibuyaEngine) {
+			if pause {
+				errs <- engine.pause()
+				return
+			}
+			errs <- engine.resume()
+		}(engine)
+	}
+	for i := 0; i < len(engines); i++ {
+		if err := <-errs; err != nil {
+			planErrors = append(planErrors, err)
+		}
+	}
+	if len(planErrors) > 0 {
+		return fmt.Errorf("Changing sampling of plan errors:%v", planErrors)
+	}
+	log.Printf("Sampling of plan %d is changed, paused: %t", pc.ep.PlanID, pause)
 	return nil
 }
 
@@ -125,12 +245,22 @@ func (pc *PlanController) subscribe(connectedEngines *sync.Map, readingEngines c
 	}
 	for _, engine := range engines {
 		go func(engine shibuyaEngine, runID int64) {
+			key := makePlanEngineKey(collection.ID, ep.PlanID, engine.EngineID())
+			if item, ok := connectedEngines.Load(key); ok {
+				connected := item.(shibuyaEngine)
+				if _, connectedRunID := connected.subscribedRun(); connectedRunID == runID {
+					return
+				}
+				// The stream of the previous run is not closed yet. The metrics would be labeled with the old run
+				if connectedEngines.CompareAndDelete(key, item) {
+					connected.closeStream()
+				}
+			}
 			//After this step, the engine instance has states including stream client
 			err := engine.subscribe(runID)
 			if err != nil {
 				return
 			}
-			key := makePlanEngineKey(collection.ID, ep.PlanID, engine.EngineID())
 			if _, loaded := connectedEngines.LoadOrStore(key, engine); !loaded {
 				readingEngines <- engine
 				log.Printf("Engine %s is subscribed", key)
@@ -166,20 +296,51 @@ func (pc *PlanController) progress() bool {
 	return !r
 }
 
-func (pc *PlanController) term(force bool, connectedEngines *sync.Map) error {
+func (pc *PlanController) term(force bool, runID int64, connectedEngines *sync.Map) error {
 	var wg sync.WaitGroup
 	ep := pc.ep
-	for i := 0; i < ep.Engines; i++ {
+	engines := make([]shibuyaEngine, ep.Engines)
+	missing := false
+	for i := range engines {
+		if item, ok := connectedEngines.Load(makePlanEngineKey(pc.collection.ID, ep.PlanID, i)); ok {
+			engines[i] = item.(shibuyaEngine)
+		} else {
+			missing = true
+		}
+	}
+	// The engines can be read by another replica, e.g. the leader when the metrics bus is shared,
+	// but they still need to be stopped.
+	if missing && !force {
+		generated, err := generateEnginesWithUrl(ep.Engines, ep.PlanID, pc.collection.ID, pc.collection.ProjectID,
+			JmeterEngineType, pc.scheduler)
+		if err != nil {
+			log.Error(err)
+		}
+		for _, engine := range generated {
+			if engines[engine.EngineID()] == nil {
+				engines[engine.EngineID()] = engine
+			}
+		}
+	}
+	for i, engine := range engines {
 		key := makePlanEngineKey(pc.collection.ID, ep.PlanID, i)
-		item, ok := connectedEngines.Load(key)
-		if ok {
+		if engine != nil {
 			wg.Add(1)
-			engine := item.(shibuyaEngine)
 			go func(engine shibuyaEngine) {
 				defer wg.Done()
-				engine.terminate(force)
+				result, err := engine.terminate(force)
+				if err != nil {
+					log.Error(err)
+				}
 				connectedEngines.Delete(key)
 				log.Printf("Engine %s is terminated", key)
+				if result == nil || !result.Forced() {
+					return
+				}
+				log.Warnf("Engine %s did not stop gracefully and was stopped by %s", key, result.StoppedBy)
+				if err := model.AddForcedStop(runID, ep.PlanID, engine.EngineID(), result.StoppedBy); err != nil {
+					log.Error(err)
+				}
 			}(engine)
 		}
 	}
@@ -66,6 +66,12 @@ func (c *Controller) deleteMetrics(runID string, collectionID string, planID str
 			"run_id":        runID,
 			"engine_no":     engineID,
 		})
+		config.StartSkewGauge.Delete(prometheus.Labels{
+			"collection_id": collectionID,
+			"plan_id":       planID,
+			"run_id":        runID,
+			"engine_no":     engineID,
+		})
 	}
 	config.PlanLatencySummary.Delete(prometheus.Labels{
 		"collection_id": collectionID,
@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/rakutentech/shibuya/shibuya/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkQuotas makes sure the launch stays within the quotas of both the project and its owner group
+func checkQuotas(project *model.Project, estimate *model.UsageEstimate) error {
+	scopes := [][]string{
+		{model.ProjectQuotaScope, strconv.FormatInt(project.ID, 10)},
+		{model.OwnerQuotaScope, project.Owner},
+	}
+	for _, s := range scopes {
+		quota, err := model.GetQuota(s[0], s[1])
+		if err != nil {
+			return err
+		}
+		if quota == nil {
+			continue
+		}
+		usage, err := model.GetQuotaUsage(s[0], s[1])
+		if err != nil {
+			return err
+		}
+		if err := quota.Check(usage, estimate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// launchWait is the reason a launch has to wait for other launches to finish. Only the waits for the cluster
+// capacity hold the launches queued behind. A quota only holds the launches of its project or owner group.
+type launchWait struct {
+	reason  string
+	cluster bool
+}
+
+// admit checks whether the collection can be launched now. If the collection needs to wait for other launches
+// to finish, the wait is returned. Errors mean the collection cannot be launched even after waiting.
+func (c *Controller) admit(collection *model.Collection) (*launchWait, error) {
+	eps, err := collection.GetExecutionPlans()
+	if err != nil {
+		return nil, err
+	}
+	estimate := model.EstimateUsage(eps, config.SC.Context)
+	if maxEngines := config.SC.ExecutorConfig.MaxEnginesInCluster; maxEngines > 0 {
+		launching, err := model.GetLaunchingEnginesCount(config.SC.Context)
+		if err != nil {
+			return nil, err
+		}
+		if launching+estimate.Engines > int64(maxEngines) {
+			return &launchWait{
+				reason: fmt.Sprintf("The cluster is full. Engines in use: %d, requesting: %d, capacity: %d",
+					launching, estimate.Engines, maxEngines),
+				cluster: true,
+			}, nil
+		}
+	}
+	project, err := model.GetProject(collection.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQuotas(project, estimate); err != nil {
+		var qe *model.QuotaExceededError
+		if errors.As(err, &qe) && qe.Retryable {
+			return &launchWait{reason: qe.Message}, nil
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// errDeployFailed is returned when the launch is recorded but its engines cannot be deployed
+var errDeployFailed = errors.New("Failed to deploy the engines")
+
+// launchIfAdmitted launches the collection unless it has to wait. The admission is checked under the launch lock
+// so concurrent launches cannot exceed the capacity or the quotas together.
+func (c *Controller) launchIfAdmitted(collection *model.Collection) (*launchWait, error) {
+	var wait *launchWait
+	err := model.WithLaunchLock(config.SC.Context, func() error {
+		var err error
+		if wait, err = c.admit(collection); err != nil || wait != nil {
+			return err
+		}
+		return c.recordLaunch(collection)
+	})
+	if err != nil || wait != nil {
+		return wait, err
+	}
+	if err := c.deployEngines(collection); err != nil {
+		return nil, fmt.Errorf("%w: %v", errDeployFailed, err)
+	}
+	return nil, nil
+}
+
+// isPermanentLaunchError tells whether the queued launch can never succeed, so it should leave the queue.
+// Other errors, e.g. the database being unavailable, are retried in the next round.
+func isPermanentLaunchError(err error) bool {
+	var qe *model.QuotaExceededError
+	if errors.As(err, &qe) {
+		return !qe.Retryable
+	}
+	// e.g. the project is deleted while the launch is queued
+	return errors.Is(err, errDeployFailed) || isNotFound(err)
+}
+
+// isNotFound tells whether the error is about a row which does not exist anymore
+func isNotFound(err error) bool {
+	var de *model.DBError
+	return errors.As(err, &de) && errors.Is(de.Err, sql.ErrNoRows)
+}
+
+// isQueueHeld tells whether a new launch has to queue behind the launches already in the queue. Launches waiting
+// for their quotas are not in the way, but the others would take the capacity first.
+func (c *Controller) isQueueHeld(queue []*model.QueuedLaunch) (bool, error) {
+	for _, ql := range queue {
+		collection, err := model.GetCollection(ql.CollectionID)
+		if err != nil {
+			continue
+		}
+		wait, err := c.admit(collection)
+		if err != nil {
+			continue
+		}
+		if wait == nil || wait.cluster {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeployCollection launches the engines of the collection. If the launch has to wait for the cluster capacity
+// or the quotas, the collection is queued and the queued launch is returned instead.
+// Launches are admitted in order so a new launch also waits when the launches queued ahead are not waiting
+// for their quotas.
+func (c *Controller) DeployCollection(collection *model.Collection, requester string) (*model.QueuedLaunch, error) {
+	queue, err := model.GetLaunchQueue(config.SC.Context)
+	if err != nil {
+		return nil, err
+	}
+	for _, ql := range queue {
+		if ql.CollectionID == collection.ID {
+			return ql, nil
+		}
+	}
+	// Let the launch fail as usual instead of queueing it again
+	launched, err := collection.IsLaunched()
+	if err != nil {
+		return nil, err
+	}
+	if launched {
+		return nil, c.launchCollection(collection)
+	}
+	held, err := c.isQueueHeld(queue)
+	if err != nil {
+		return nil, err
+	}
+	wait := &launchWait{reason: "Waiting for the launches queued ahead", cluster: true}
+	if !held {
+		if wait, err = c.launchIfAdmitted(collection); err != nil || wait == nil {
+			return nil, err
+		}
+	}
+	if err := model.EnqueueLaunch(collection.ID, config.SC.Context, requester, wait.reason); err != nil {
+		return nil, err
+	}
+	log.Infof("Launch of collection %d is queued: %s", collection.ID, wait.reason)
+	return model.GetQueuedLaunch(collection.ID, config.SC.Context)
+}
+
+func (c *Controller) launchCollection(collection *model.Collection) error {
+	if err := c.recordLaunch(collection); err != nil {
+		return err
+	}
+	return c.deployEngines(collection)
+}
+
+func (c *Controller) recordLaunch(collection *model.Collection) error {
+	eps, err := collection.GetExecutionPlans()
+	if err != nil {
+		return err
+	}
+	// The engines are not scheduled yet. Nodes count is recorded later by AutoRecordNodesCount
+	nodesCount := int64(0)
+	estimate := model.EstimateUsage(eps, config.SC.Context)
+	// The launch entry is counted in the quotas of the project, so it cannot be recorded without the project
+	project, err := model.GetProject(collection.ProjectID)
+	if err != nil {
+		return err
+	}
+	return collection.NewLaunchEntry(project.SID, config.SC.Context, estimate.Engines, nodesCount, estimate.VU)
+}
+
+func (c *Controller) deployEngines(collection *model.Collection) error {
+	eps, err := collection.GetExecutionPlans()
+	if err != nil {
+		return err
+	}
+	err = utils.Retry(func() error {
+		return c.Scheduler.ExposeProject(collection.ProjectID)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	// we will assume collection deployment will always be successful
+	// For some large deployments, it might take more than 1 min to finish, which could result 504 at gateway side
+	// So we do not wait for the deployment to be finished.
+	go func() {
+		var wg sync.WaitGroup
+		now_ := time.Now()
+		for _, e := range eps {
+			wg.Add(1)
+			go func(ep *model.ExecutionPlan) {
+				defer wg.Done()
+				pc := NewPlanController(ep, collection, c.Scheduler)
+				utils.Retry(func() error {
+					return pc.deploy()
+				}, nil)
+			}(e)
+		}
+		wg.Wait()
+		duration := time.Now().Sub(now_)
+		log.Infof("All engines deployment are finished for collection %d, total duration: %.2f seconds",
+			collection.ID, duration.Seconds())
+	}()
+	return nil
+}
+
+type launchNotification struct {
+	Requester    string `json:"requester"`
+	CollectionID int64  `json:"collection_id"`
+	Message      string `json:"message"`
+}
+
+// notifyRequester posts the message to the configured webhook. Requesters can also see the queue
+// position in the collection status.
+func notifyRequester(ql *model.QueuedLaunch, message string) {
+	log.Infof("Notifying %s of collection %d: %s", ql.Requester, ql.CollectionID, message)
+	nc := config.SC.Notification
+	if nc == nil || nc.WebhookUrl == "" {
+		return
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(&launchNotification{
+		Requester:    ql.Requester,
+		CollectionID: ql.CollectionID,
+		Message:      message,
+	})
+	resp, err := config.SC.HTTPClient.Post(nc.WebhookUrl, "application/json", body)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// AutoLaunchQueuedCollections launches the queued collections when the capacity frees up.
+// The queue is processed in order and stops at the first launch that still has to wait for the cluster capacity.
+// Launches waiting for their quotas are skipped so they do not hold the launches of the other teams.
+func (c *Controller) AutoLaunchQueuedCollections() {
+	log.Info("Start the loop for launching queued collections")
+	for {
+		time.Sleep(10 * time.Second)
+		c.backgroundTasks.waitForLeadership()
+		queue, err := model.GetLaunchQueue(config.SC.Context)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, ql := range queue {
+			collection, err := model.GetCollection(ql.CollectionID)
+			if isNotFound(err) {
+				if err := model.DequeueLaunch(ql.CollectionID); err != nil {
+					log.Error(err)
+				}
+				continue
+			}
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			wait, err := c.launchIfAdmitted(collection)
+			if errors.Is(err, model.ErrLaunchLockTimeout) {
+				break
+			}
+			if err == nil && wait != nil {
+				if wait.cluster {
+					break
+				}
+				continue
+			}
+			if err != nil && !isPermanentLaunchError(err) {
+				log.Errorf("Queued launch of collection %d is kept in the queue: %v", collection.ID, err)
+				continue
+			}
+			if err := model.DequeueLaunch(ql.CollectionID); err != nil {
+				log.Error(err)
+			}
+			if err != nil {
+				notifyRequester(ql, fmt.Sprintf("The queued launch of collection %d failed: %v", collection.ID, err))
+				continue
+			}
+			notifyRequester(ql, fmt.Sprintf("Collection %d is being launched", collection.ID))
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkPendingPlans starts the plans of the running collections once their start delay is over and their
+// dependency is met. Plans wait while the run is paused.
+func (c *Controller) checkPendingPlans() {
+	log.Printf("Checking the pending plans for %s", config.SC.Context)
+	for {
+		time.Sleep(2 * time.Second)
+		c.runChecks.waitForLeadership()
+		pendingPlans, err := model.GetPendingPlans()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		pending := make(map[int64]map[int64]bool)
+		for _, pp := range pendingPlans {
+			if _, ok := pending[pp.CollectionID]; !ok {
+				pending[pp.CollectionID] = make(map[int64]bool)
+			}
+			pending[pp.CollectionID][pp.PlanID] = true
+		}
+		for _, pp := range pendingPlans {
+			if pp.Starting {
+				continue
+			}
+			if pp.StartTime == nil {
+				if err := c.checkDependency(pp, pending[pp.CollectionID]); err != nil {
+					log.Error(err)
+				}
+				continue
+			}
+			if time.Now().Before(*pp.StartTime) {
+				continue
+			}
+			// The start time is shifted by the paused time once the run is resumed
+			paused, err := model.IsRunPaused(pp.RunID)
+			if err != nil || paused {
+				continue
+			}
+			if err := model.ClaimPendingPlan(pp.CollectionID, pp.PlanID); err != nil {
+				continue
+			}
+			go c.startPendingPlan(pp)
+		}
+	}
+}
+
+// checkDependency sets the start time of the plan once the plan it depends on reaches the state
+func (c *Controller) checkDependency(pp *model.PendingPlan, pending map[int64]bool) error {
+	dependency := pp.DependsOn
+	if pending[dependency.PlanID] {
+		return nil
+	}
+	rp, err := model.GetRunningPlan(pp.CollectionID, dependency.PlanID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	running := err == nil
+	switch dependency.State {
+	case model.PlanStarted:
+	case model.PlanRampedUp:
+		if running {
+			dep, err := model.GetExecutionPlan(pp.CollectionID, dependency.PlanID)
+			if err != nil {
+				return err
+			}
+			if time.Since(rp.StartedTime) < time.Duration(dep.Rampup)*time.Second {
+				return nil
+			}
+		}
+	default:
+		if running {
+			return nil
+		}
+	}
+	ep, err := model.GetExecutionPlan(pp.CollectionID, pp.PlanID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Plan %d of collection %d will start in %ds as plan %d is %s", pp.PlanID, pp.CollectionID,
+		ep.StartDelay, dependency.PlanID, dependency.State)
+	return model.SetPendingPlanStartTime(pp.CollectionID, pp.PlanID, time.Now().Add(time.Duration(ep.StartDelay)*time.Second))
+}
+
+// cancelDependentPlans removes the pending plans waiting for the plan, directly or through other plans, when
+// the plan fails to start. It has to be called while the plan is still pending, otherwise checkPendingPlans
+// could take the plan as finished and start its dependents.
+func (c *Controller) cancelDependentPlans(collectionID, planID int64) {
+	pendingPlans, err := model.GetPendingPlansByCollection(collectionID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	failed := map[int64]bool{planID: true}
+	for found := true; found; {
+		found = false
+		for _, pp := range pendingPlans {
+			if pp.Starting || pp.DependsOn == nil || failed[pp.PlanID] || !failed[pp.DependsOn.PlanID] {
+				continue
+			}
+			failed[pp.PlanID] = true
+			found = true
+			log.Printf("Plan %d of collection %d is cancelled as plan %d failed to start", pp.PlanID, collectionID, planID)
+			if err := model.DeletePendingPlan(collectionID, pp.PlanID); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (c *Controller) startPendingPlan(pp *model.PendingPlan) {
+	collection, err := model.GetCollection(pp.CollectionID)
+	if err != nil {
+		log.Error(err)
+		model.DeletePendingPlan(pp.CollectionID, pp.PlanID)
+		return
+	}
+	// The run is stopped while the plan was waiting
+	if runID, err := collection.GetCurrentRun(); err != nil || runID != pp.RunID {
+		model.DeletePendingPlan(pp.CollectionID, pp.PlanID)
+		return
+	}
+	collection.ExecutionPlans, err = collection.GetExecutionPlans()
+	if err != nil {
+		log.Error(err)
+		model.DeletePendingPlan(pp.CollectionID, pp.PlanID)
+		return
+	}
+	engineDataConfigs := prepareCollection(collection)
+	for i, ep := range collection.ExecutionPlans {
+		if ep.PlanID != pp.PlanID {
+			continue
+		}
+		log.Printf("Starting pending plan %d of collection %d", pp.PlanID, pp.CollectionID)
+		if errs := c.startPlans(collection, []int{i}, engineDataConfigs, pp.RunID); len(errs) > 0 {
+			log.Errorf("Pending plan %d of collection %d failed to start: %v", pp.PlanID, pp.CollectionID, errs)
+			c.finishIdleRun(collection, pp.RunID)
+		}
+		return
+	}
+	// The plan is removed from the collection
+	model.DeletePendingPlan(pp.CollectionID, pp.PlanID)
+	c.finishIdleRun(collection, pp.RunID)
+}
+
+// finishIdleRun finishes the run when none of its plans is running or waiting to start
+func (c *Controller) finishIdleRun(collection *model.Collection, runID int64) {
+	if t, err := collection.HasRunningPlan(); t || err != nil {
+		return
+	}
+	if t, err := collection.HasPendingPlan(); t || err != nil {
+		return
+	}
+	collection.StopRun()
+	collection.RunFinish(runID)
+}
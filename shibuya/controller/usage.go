@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/model"
+	"github.com/rakutentech/shibuya/shibuya/object_storage"
+	log "github.com/sirupsen/logrus"
+)
+
+func makeMonthlyUsageReportName(month time.Time) string {
+	return fmt.Sprintf("usage_reports/%s.csv", month.Format("2006-01"))
+}
+
+// exportMonthlyUsageReport writes the usage of the month before now to the object storage
+// unless it has been exported already, for example by the controller of another context.
+func exportMonthlyUsageReport(now time.Time) error {
+	end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	start := end.AddDate(0, -1, 0)
+	filename := makeMonthlyUsageReportName(start)
+	if _, err := object_storage.Client.Storage.Size(filename); err == nil {
+		return nil
+	}
+	report, err := model.GetUsageReport(start.Format(model.MySQLFormat), end.Format(model.MySQLFormat), model.GroupByMonth)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := model.WriteUsageReportCSV(&b, report); err != nil {
+		return err
+	}
+	if err := object_storage.Client.Storage.Upload(filename, io.NopCloser(&b)); err != nil {
+		return err
+	}
+	log.Infof("Usage report %s is exported", filename)
+	return nil
+}
+
+// AutoExportMonthlyUsageReport exports the report of the previous month once the month is over.
+func (c *Controller) AutoExportMonthlyUsageReport() {
+	if !config.SC.MonthlyUsageReport {
+		return
+	}
+	log.Info("Start the loop for exporting monthly usage reports")
+	exported := ""
+	for {
+		c.backgroundTasks.waitForLeadership()
+		now := time.Now()
+		if month := now.Format("2006-01"); month != exported {
+			if err := exportMonthlyUsageReport(now); err != nil {
+				log.Error(err)
+			} else {
+				exported = month
+			}
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
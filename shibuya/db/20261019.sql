@@ -0,0 +1,141 @@
+use shibuya;
+
+ALTER TABLE collection_plan ADD COLUMN rps INT UNSIGNED DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS collection_run_pause (
+    run_id INT UNSIGNED NOT NULL,
+    paused_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resumed_time TIMESTAMP NULL DEFAULT NULL,
+    key (run_id, resumed_time)
+)CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS collection_run_forced_stop (
+    run_id INT UNSIGNED NOT NULL,
+    plan_id INT UNSIGNED NOT NULL,
+    engine_id INT UNSIGNED NOT NULL,
+    stopped_by VARCHAR(20) NOT NULL,
+    stopped_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    key (run_id)
+)CHARSET=utf8mb4;
+
+ALTER TABLE collection_plan ADD COLUMN cpu VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE collection_plan ADD COLUMN mem VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE collection_plan ADD COLUMN heap VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE collection_plan ADD COLUMN image VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS project_resource_policy (
+    project_id INT UNSIGNED NOT NULL,
+    min_cpu VARCHAR(20) NOT NULL DEFAULT '',
+    max_cpu VARCHAR(20) NOT NULL DEFAULT '',
+    min_mem VARCHAR(20) NOT NULL DEFAULT '',
+    max_mem VARCHAR(20) NOT NULL DEFAULT '',
+    images TEXT,
+    PRIMARY KEY (project_id)
+)CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS quota (
+    scope VARCHAR(20) NOT NULL,
+    scope_id VARCHAR(50) NOT NULL,
+    max_engines INT UNSIGNED NOT NULL DEFAULT 0,
+    max_vu INT UNSIGNED NOT NULL DEFAULT 0,
+    max_monthly_vuh INT UNSIGNED NOT NULL DEFAULT 0,
+    PRIMARY KEY (scope, scope_id)
+)CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS collection_launch_queue (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    collection_id INT UNSIGNED NOT NULL,
+    context VARCHAR(20) NOT NULL,
+    requester VARCHAR(100) NOT NULL,
+    reason TEXT,
+    queued_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE KEY (collection_id),
+    key (context)
+)CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS file_version (
+    kind VARCHAR(20) NOT NULL,
+    owner_id INT UNSIGNED NOT NULL,
+    filename VARCHAR(191) NOT NULL,
+    version INT UNSIGNED NOT NULL,
+    size BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    checksum VARCHAR(64) NOT NULL DEFAULT '',
+    uploader VARCHAR(191) NOT NULL DEFAULT '',
+    -- Versions are reserved before their content is uploaded so concurrent uploads get different versions.
+    -- Reserved versions are hidden until the upload is finished.
+    uploading TINYINT(1) NOT NULL DEFAULT 0,
+    created_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (kind, owner_id, filename, version)
+)CHARSET=utf8mb4;
+
+ALTER TABLE plan_data ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE plan_test_file ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE collection_data ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 0;
+
+-- Files uploaded before versioning become version 0. They are stored without the version in the path
+INSERT IGNORE INTO file_version (kind, owner_id, filename, version) SELECT 'plan', plan_id, filename, 0 FROM plan_data;
+INSERT IGNORE INTO file_version (kind, owner_id, filename, version) SELECT 'plan', plan_id, filename, 0 FROM plan_test_file;
+INSERT IGNORE INTO file_version (kind, owner_id, filename, version) SELECT 'collection', collection_id, filename, 0 FROM collection_data;
+
+CREATE TABLE IF NOT EXISTS collection_run_file (
+    run_id INT UNSIGNED NOT NULL,
+    plan_id INT UNSIGNED NOT NULL,
+    filename VARCHAR(191) NOT NULL,
+    version INT UNSIGNED NOT NULL,
+    checksum VARCHAR(64) NOT NULL DEFAULT '',
+    key (run_id)
+)CHARSET=utf8mb4;
+
+-- Rows of the CSV files. Null for the other files and the files uploaded before it was counted
+ALTER TABLE file_version ADD COLUMN row_count INT UNSIGNED;
+
+-- How the CSV files are distributed to the engines. Empty split follows the csv_split of the collection or the plan
+ALTER TABLE plan_data ADD COLUMN split VARCHAR(10) NOT NULL DEFAULT '',
+    ADD COLUMN split_mode VARCHAR(20) NOT NULL DEFAULT '',
+    ADD COLUMN keep_header TINYINT(1) NOT NULL DEFAULT 0;
+ALTER TABLE collection_data ADD COLUMN split VARCHAR(10) NOT NULL DEFAULT '',
+    ADD COLUMN split_mode VARCHAR(20) NOT NULL DEFAULT '',
+    ADD COLUMN keep_header TINYINT(1) NOT NULL DEFAULT 0;
+
+-- JMeter properties set from the collection config, stored as JSON objects
+ALTER TABLE collection ADD COLUMN properties TEXT;
+ALTER TABLE collection_plan ADD COLUMN properties TEXT;
+
+-- Jars admins allowed to be uploaded to the plans and collections of a project, by sha256
+CREATE TABLE IF NOT EXISTS project_jar_allowlist (
+    project_id INT UNSIGNED NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    name VARCHAR(191) NOT NULL DEFAULT '',
+    added_by VARCHAR(191) NOT NULL DEFAULT '',
+    created_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, checksum)
+)CHARSET=utf8mb4;
+
+-- Seconds a plan waits before it starts, counted from its dependency being met or from the trigger
+ALTER TABLE collection_plan ADD COLUMN start_delay INT UNSIGNED NOT NULL DEFAULT 0,
+ADD COLUMN depends_on_plan_id INT UNSIGNED NULL,
+ADD COLUMN depends_on_state VARCHAR(20) NOT NULL DEFAULT '';
+
+-- Plans of a run which have not started yet. start_time is null while the plan waits for its dependency.
+-- starting is set by the controller starting the plan and the row is deleted once the plan is running.
+CREATE TABLE IF NOT EXISTS pending_plan (
+    collection_id INT UNSIGNED NOT NULL,
+    plan_id INT UNSIGNED NOT NULL,
+    run_id INT UNSIGNED NOT NULL,
+    context varchar(20) NOT NULL,
+    start_time TIMESTAMP NULL,
+    starting TINYINT NOT NULL DEFAULT 0,
+    created_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (collection_id, plan_id),
+    INDEX (context)
+) CHARSET=utf8mb4;
+
+-- Background tasks run by only one controller replica, the holder of the lease. The holder renews the lease
+-- and other replicas take it over once it's expired.
+CREATE TABLE IF NOT EXISTS leader_lease (
+    name varchar(100) NOT NULL,
+    holder varchar(255) NOT NULL,
+    renewed_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (name)
+) CHARSET=utf8mb4;
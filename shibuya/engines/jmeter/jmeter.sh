@@ -30,8 +30,9 @@ MINIMAL_VERSION=1.8.0
 # Check if Java is present and the minimal version requirement
 _java=`type java | awk '{ print $ NF }'`
 CURRENT_VERSION=`"$_java" -version 2>&1 | awk -F'"' '/version/ {print $2}'`
-minimal_version=`echo $MINIMAL_VERSION | awk -F'.' '{ print $2 }'`
-current_version=`echo $CURRENT_VERSION | awk -F'.' '{ print $2 }'`
+# Java 9 and later are versioned as 11.0.2 instead of 1.8.0
+minimal_version=`echo $MINIMAL_VERSION | awk -F'.' '{ if ($1 == 1) print $2; else print $1 }'`
+current_version=`echo $CURRENT_VERSION | awk -F'.' '{ if ($1 == 1) print $2; else print $1 }'`
 if [ $current_version ]; then
         if [ $current_version -lt $minimal_version ]; then
                  echo "Error: Java version is too low to run JMeter. Needs at least Java >= ${MINIMAL_VERSION}."
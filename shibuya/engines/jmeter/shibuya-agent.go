@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,9 +15,12 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	etree "github.com/beevik/etree"
@@ -26,6 +31,7 @@ import (
 	sos "github.com/rakutentech/shibuya/shibuya/object_storage"
 
 	"github.com/rakutentech/shibuya/shibuya/engines/containerstats"
+	"github.com/rakutentech/shibuya/shibuya/engines/jmx"
 	enginesModel "github.com/rakutentech/shibuya/shibuya/engines/model"
 	"github.com/rakutentech/shibuya/shibuya/model"
 	"github.com/rakutentech/shibuya/shibuya/utils"
@@ -37,18 +43,92 @@ const (
 	RESULT_ROOT      = "/test-result"
 	TEST_DATA_FOLDER = "/test-data"
 	PROPERTY_FILE    = "/test-conf/shibuya.properties"
-	JMETER_BIN_FOLER = "/apache-jmeter-3.3/bin"
-	JMETER_BIN       = "jmeter"
-	STDERR           = "/dev/stderr"
-	JMX_FILENAME     = "modified.jmx"
+	// Used when the image does not set JMETER_HOME and no JMeter is found in the root
+	DEFAULT_JMETER_HOME = "/apache-jmeter-3.3"
+	JMETER_HOME_PREFIX  = "/apache-jmeter-"
+	JMETER_BIN          = "jmeter"
+	STDERR              = "/dev/stderr"
+	JMX_FILENAME        = "modified.jmx"
+	// Constant Throughput Timer calculates the delay based on all the active threads in the engine.
+	// So with the same timer added to every thread group, the engine as a whole stays at the target.
+	THROUGHPUT_TIMER_CALC_MODE = "1"
+	PAUSE_FILENAME             = "shibuya.pause"
+	// Jmeter is started when the run is prepared and holds the test while the gate file exists
+	GATE_FILENAME = "shibuya.gate"
+	// How long a prepared engine waits for the commit before giving up the test
+	GATE_TIMEOUT = 30 * time.Minute
+	// Logged by the start gate so the agent knows where Jmeter is
+	GATE_WAITING_LINE = "shibuya: waiting at the start gate"
+	GATE_OPENED_LINE  = "shibuya: start gate is opened"
+	// Only the last lines of the output are kept so long tests do not run the engine out of memory
+	LOG_BUFFER_LINES = 10000
+	// The thread groups run this much longer than the plan so the paused time does not count against the
+	// duration. The agent ends the test once Jmeter has been sampling for the duration of the plan.
+	MAX_PAUSED_TIME = 6 * time.Hour
 )
 
 var (
-	JMETER_EXECUTABLE = path.Join(JMETER_BIN_FOLER, JMETER_BIN)
-	JMETER_SHUTDOWN   = path.Join(JMETER_BIN_FOLER, "stoptest.sh")
+	JMETER_BIN_FOLDER = path.Join(findJmeterHome(), "bin")
+	JMETER_EXECUTABLE = path.Join(JMETER_BIN_FOLDER, JMETER_BIN)
+	JMETER_STOPTEST   = path.Join(JMETER_BIN_FOLDER, "stoptest.sh")
+	JMETER_SHUTDOWN   = path.Join(JMETER_BIN_FOLDER, "shutdown.sh")
 	JMX_FILEPATH      = path.Join(TEST_DATA_FOLDER, JMX_FILENAME)
+	// Uploaded jars are put in their own folder which is in the classpath and the plugin search paths
+	JAR_FOLDER = path.Join(TEST_DATA_FOLDER, "lib")
+	// The pause file lives in the test data folder so it will be cleaned when a new test is started
+	PAUSE_FILEPATH = path.Join(TEST_DATA_FOLDER, PAUSE_FILENAME)
+	GATE_FILEPATH  = path.Join(TEST_DATA_FOLDER, GATE_FILENAME)
+	// Every sampler is blocked by this script while the pause file exists. The script runs before every
+	// sample, so the file is only checked once a second and the result is shared through the properties.
+	PAUSE_SCRIPT = fmt.Sprintf(`def now = System.currentTimeMillis()
+if (now - (props.get("shibuya.pause.checked") ?: 0L) >= 1000L) {
+    props.put("shibuya.pause.checked", now)
+    props.put("shibuya.paused", new File("%[1]s").exists())
+}
+while (props.get("shibuya.paused")) {
+    Thread.sleep(1000)
+    props.put("shibuya.paused", new File("%[1]s").exists())
+}
+// setUp thread groups of the test run alongside the start gate so they are held here
+while (props.get("shibuya.started") == null) {
+    Thread.sleep(10)
+}
+return 0`, PAUSE_FILEPATH)
+	// Run by the start gate, a setUp thread group. The other thread groups, and their ramp up, only start
+	// after the setUp thread groups are finished.
+	GATE_SCRIPT = fmt.Sprintf(`def gate = new File("%s")
+if (gate.exists()) {
+    log.info("%s")
+    while (gate.exists()) {
+        Thread.sleep(10)
+    }
+}
+log.info("%s")
+props.put("shibuya.started", true)
+return 0`, GATE_FILEPATH, GATE_WAITING_LINE, GATE_OPENED_LINE)
 )
 
+// findJmeterHome lets the engine images ship any JMeter version. Images set JMETER_HOME or JMETER_VERSION,
+// otherwise the JMeter installed in the root is used, e.g. /apache-jmeter-5.6.3
+func findJmeterHome() string {
+	if home := os.Getenv("JMETER_HOME"); home != "" {
+		return home
+	}
+	if version := os.Getenv("JMETER_VERSION"); version != "" {
+		return JMETER_HOME_PREFIX + version
+	}
+	matches, err := filepath.Glob(JMETER_HOME_PREFIX + "*")
+	if err != nil || len(matches) == 0 {
+		return DEFAULT_JMETER_HOME
+	}
+	// The newest version is picked, e.g. 5.10 over 5.6
+	sort.Slice(matches, func(i, j int) bool {
+		return utils.CompareVersions(strings.TrimPrefix(matches[i], JMETER_HOME_PREFIX),
+			strings.TrimPrefix(matches[j], JMETER_HOME_PREFIX)) < 0
+	})
+	return matches[len(matches)-1]
+}
+
 type ShibuyaWrapper struct {
 	newClients     chan chan string
 	closingClients chan chan string
@@ -65,11 +145,21 @@ type ShibuyaWrapper struct {
 	//stderr         io.ReadCloser
 	reader       io.ReadCloser
 	writer       io.Writer
-	buffer       []byte
+	logs         *utils.LineBuffer
 	runID        int
 	collectionID string
 	planID       string
 	engineID     int
+	// number of samples read from the JTL file. It is used for calculating the achieved rps
+	samplesCount int64
+	// rows of the split csv files received in the current run
+	csvRows map[string]int64
+	// JMeter properties of the current run
+	properties map[string]string
+	// Jmeter is started and holding the test at the start gate until the commit
+	gated atomic.Bool
+	// How long Jmeter samples in the current run, excluding the paused time
+	duration time.Duration
 }
 
 func findCollectionIDPlanID() (string, string) {
@@ -87,6 +177,7 @@ func NewServer() (sw *ShibuyaWrapper) {
 		Bus:            make(chan string),
 		httpClient:     &http.Client{},
 		storageClient:  sos.Client.Storage,
+		logs:           utils.NewLineBuffer(LOG_BUFFER_LINES),
 	}
 	sw.collectionID, sw.planID = findCollectionIDPlanID()
 	reader, writer, _ := os.Pipe()
@@ -107,8 +198,7 @@ func (sw *ShibuyaWrapper) readOutput() {
 		if err != nil {
 			continue
 		}
-		line = append(line, '\n')
-		sw.buffer = append(sw.buffer, line...)
+		sw.logs.Add(string(line))
 	}
 }
 
@@ -146,6 +236,7 @@ func (sw *ShibuyaWrapper) makePromMetrics(line string) {
 	if err != nil {
 		return
 	}
+	atomic.AddInt64(&sw.samplesCount, 1)
 	collectionID := sw.collectionID
 	planID := sw.planID
 	engineID := fmt.Sprintf("%d", sw.engineID)
@@ -252,6 +343,54 @@ func (sw *ShibuyaWrapper) streamHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// waitForExit returns true if the Jmeter process exits within the timeout
+func (sw *ShibuyaWrapper) waitForExit(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if sw.getPid() == 0 {
+			return true
+		}
+		time.Sleep(time.Second * 2)
+	}
+	return sw.getPid() == 0
+}
+
+func findStopTimeout(r *http.Request) time.Duration {
+	timeout, err := strconv.Atoi(r.FormValue("timeout"))
+	if err != nil || timeout <= 0 {
+		return enginesModel.DefaultGracefulStopTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// stopJmeter escalates from stoptest.sh to shutdown.sh and finally SIGKILL so a hung Jmeter cannot
+// block the stop request forever. It returns the way the process was ended.
+func (sw *ShibuyaWrapper) stopJmeter(timeout time.Duration) string {
+	pid := sw.getPid()
+	exec.Command(JMETER_STOPTEST).Run()
+	if sw.waitForExit(timeout) {
+		return enginesModel.StoppedByStopTest
+	}
+	log.Printf("shibuya-agent: Jmeter process %d is not stopped after %v, shutting it down", pid, timeout)
+	exec.Command(JMETER_SHUTDOWN).Run()
+	if sw.waitForExit(enginesModel.ShutdownWindow) {
+		return enginesModel.StoppedByShutdown
+	}
+	log.Printf("shibuya-agent: Jmeter process %d is not shut down after %v, killing it", pid, enginesModel.ShutdownWindow)
+	sw.killJmeter(pid)
+	return enginesModel.StoppedByKill
+}
+
+func (sw *ShibuyaWrapper) killJmeter(pid int) {
+	// bin/jmeter is a shell wrapper so the whole process group is killed, including the java process
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+		log.Println(err)
+	}
+	if !sw.waitForExit(enginesModel.ShutdownWindow) {
+		log.Printf("shibuya-agent: Jmeter process %d is still not reaped after being killed", pid)
+	}
+}
+
 func (sw *ShibuyaWrapper) stopHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		return
@@ -265,16 +404,73 @@ func (sw *ShibuyaWrapper) stopHandler(w http.ResponseWriter, r *http.Request) {
 	if pid == 0 {
 		return
 	}
+	// Nothing is sampled before the gate is opened so the process is just killed
+	if sw.gated.Swap(false) {
+		sw.abortGatedRun(pid)
+		return
+	}
 	log.Printf("shibuya-agent: Shutting down Jmeter process %d", sw.getPid())
-	cmd := exec.Command(JMETER_SHUTDOWN)
-	cmd.Run()
-	for {
-		if sw.getPid() == 0 {
-			break
-		}
-		time.Sleep(time.Second * 2)
+	// Paused samplers should not hold the shutdown
+	if err := resumeSampling(); err != nil {
+		log.Println(err)
 	}
+	result := enginesModel.StopResult{
+		StoppedBy: sw.stopJmeter(findStopTimeout(r)),
+	}
+	log.Printf("shibuya-agent: Jmeter process %d is stopped by %s", pid, result.StoppedBy)
 	sw.closeSignal <- 1
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
+
+func pauseSampling() error {
+	return ioutil.WriteFile(PAUSE_FILEPATH, []byte{}, 0777)
+}
+
+func isSamplingPaused() bool {
+	_, err := os.Stat(PAUSE_FILEPATH)
+	return err == nil
+}
+
+func resumeSampling() error {
+	if err := os.Remove(PAUSE_FILEPATH); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (sw *ShibuyaWrapper) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if sw.getPid() == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := pauseSampling(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("shibuya-agent: Sampling of Jmeter process %d is paused", sw.getPid())
+}
+
+func (sw *ShibuyaWrapper) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if sw.getPid() == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := resumeSampling(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("shibuya-agent: Sampling of Jmeter process %d is resumed", sw.getPid())
 }
 
 func (sw *ShibuyaWrapper) setPid(pid int) {
@@ -291,12 +487,32 @@ func (sw *ShibuyaWrapper) getPid() int {
 	return sw.currentPid
 }
 
+// makePropertyArgs sorts the properties so the command is the same for the same properties
+func makePropertyArgs(props map[string]string) []string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []string{}
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("-J%s=%s", name, props[name]))
+	}
+	return args
+}
+
 func (sw *ShibuyaWrapper) runCommand() int {
 	log.Printf("shibuya-agent: Start to run plan")
 	logFile := sw.makeLogFile()
-	cmd := exec.Command(JMETER_EXECUTABLE, "-n", "-t", JMX_FILEPATH, "-l", logFile,
-		"-q", PROPERTY_FILE, "-G", PROPERTY_FILE, "-j", STDERR)
+	args := []string{"-n", "-t", JMX_FILEPATH, "-l", logFile,
+		"-q", PROPERTY_FILE, "-G", PROPERTY_FILE, "-j", STDERR}
+	args = append(args, makePropertyArgs(sw.properties)...)
+	cmd := exec.Command(JMETER_EXECUTABLE, args...)
 	cmd.Stderr = sw.writer
+	// Jmeter gets its own process group so it can be killed together with its children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Children left behind could keep the stderr pipe open and block Wait forever
+	cmd.WaitDelay = enginesModel.ShutdownWindow
 	err := cmd.Start()
 	if err != nil {
 		log.Println(err)
@@ -331,35 +547,113 @@ func saveToDisk(filename string, file []byte) error {
 	return nil
 }
 
-func GetThreadGroups(planDoc *etree.Document) ([]*etree.Element, error) {
-	jtp := planDoc.SelectElement("jmeterTestPlan")
-	if jtp == nil {
-		return nil, errors.New("Missing Jmeter Test plan in jmx")
+func createOnDisk(filename string) (*os.File, error) {
+	filePath := filepath.Join(TEST_DATA_FOLDER, filepath.Base(filename))
+	log.Println(filePath)
+	return os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+}
+
+func makeThroughputTimer(rps float64) *etree.Element {
+	timer := etree.NewElement("ConstantThroughputTimer")
+	timer.CreateAttr("guiclass", "TestBeanGUI")
+	timer.CreateAttr("testclass", "ConstantThroughputTimer")
+	timer.CreateAttr("testname", "Shibuya Constant Throughput Timer")
+	timer.CreateAttr("enabled", "true")
+	calcMode := timer.CreateElement("intProp")
+	calcMode.CreateAttr("name", "calcMode")
+	calcMode.SetText(THROUGHPUT_TIMER_CALC_MODE)
+	throughput := timer.CreateElement("doubleProp")
+	throughput.CreateElement("name").SetText("throughput")
+	// The timer is using samples per minute
+	throughput.CreateElement("value").SetText(strconv.FormatFloat(rps*60, 'f', -1, 64))
+	throughput.CreateElement("savedValue").SetText("0.0")
+	return timer
+}
+
+func makeScriptTimer(name, script string) *etree.Element {
+	timer := etree.NewElement("JSR223Timer")
+	timer.CreateAttr("guiclass", "TestBeanGUI")
+	timer.CreateAttr("testclass", "JSR223Timer")
+	timer.CreateAttr("testname", name)
+	timer.CreateAttr("enabled", "true")
+	props := [][]string{
+		{"scriptLanguage", "groovy"},
+		{"parameters", ""},
+		{"filename", ""},
+		{"cacheKey", "true"},
+		{"script", script},
 	}
-	ht := jtp.SelectElement("hashTree")
-	if ht == nil {
-		return nil, errors.New("Missing hash tree inside Jmeter test plan in jmx")
+	for _, p := range props {
+		prop := timer.CreateElement("stringProp")
+		prop.CreateAttr("name", p[0])
+		prop.SetText(p[1])
 	}
-	ht = ht.SelectElement("hashTree")
-	if ht == nil {
-		return nil, errors.New("Missing hash tree inside hash tree in jmx")
+	return timer
+}
+
+func makePauseTimer() *etree.Element {
+	return makeScriptTimer("Shibuya Pause Timer", PAUSE_SCRIPT)
+}
+
+func addProp(e *etree.Element, tag, name, value string) {
+	prop := e.CreateElement(tag)
+	prop.CreateAttr("name", name)
+	prop.SetText(value)
+}
+
+// addStartGate adds a setUp thread group running the gate script once. The flow control action only carries
+// the timer and does not record a sample.
+func addStartGate(planDoc *etree.Document) error {
+	ht, err := jmx.FindTestPlanHashTree(planDoc)
+	if err != nil {
+		return err
 	}
-	tgs := ht.SelectElements("ThreadGroup")
-	stgs := ht.SelectElements("SetupThreadGroup")
-	tgs = append(tgs, stgs...)
-	return tgs, nil
+	tg := ht.CreateElement("SetupThreadGroup")
+	tg.CreateAttr("guiclass", "SetupThreadGroupGui")
+	tg.CreateAttr("testclass", "SetupThreadGroup")
+	tg.CreateAttr("testname", "Shibuya Start Gate")
+	tg.CreateAttr("enabled", "true")
+	loop := tg.CreateElement("elementProp")
+	loop.CreateAttr("name", "ThreadGroup.main_controller")
+	loop.CreateAttr("elementType", "LoopController")
+	loop.CreateAttr("guiclass", "LoopControlPanel")
+	loop.CreateAttr("testclass", "LoopController")
+	addProp(loop, "boolProp", "LoopController.continue_forever", "false")
+	addProp(loop, "stringProp", "LoopController.loops", "1")
+	addProp(tg, "stringProp", "ThreadGroup.on_sample_error", "continue")
+	addProp(tg, "stringProp", "ThreadGroup.num_threads", "1")
+	addProp(tg, "stringProp", "ThreadGroup.ramp_time", "0")
+	addProp(tg, "boolProp", "ThreadGroup.scheduler", "false")
+	tgHashTree := ht.CreateElement("hashTree")
+
+	action := tgHashTree.CreateElement("TestAction")
+	action.CreateAttr("guiclass", "TestActionGui")
+	action.CreateAttr("testclass", "TestAction")
+	action.CreateAttr("testname", "Shibuya Start Gate")
+	action.CreateAttr("enabled", "true")
+	// Pausing the current thread for 0ms
+	addProp(action, "intProp", "ActionProcessor.action", "1")
+	addProp(action, "intProp", "ActionProcessor.target", "0")
+	addProp(action, "stringProp", "ActionProcessor.duration", "0")
+	actionHashTree := tgHashTree.CreateElement("hashTree")
+	actionHashTree.AddChild(makeScriptTimer("Shibuya Start Gate Timer", GATE_SCRIPT))
+	actionHashTree.AddChild(etree.NewElement("hashTree"))
+	return nil
 }
 
-func parseTestPlan(file []byte) (*etree.Document, error) {
-	doc := etree.NewDocument()
-	if err := doc.ReadFromBytes(file); err != nil {
-		return nil, err
+// Timers are applied to all the samplers within the scope. So we add them into the thread group directly
+func addTimer(tg *etree.Element, timer *etree.Element) error {
+	ht := jmx.FindThreadGroupHashTree(tg)
+	if ht == nil {
+		return fmt.Errorf("Missing hash tree of thread group %s in jmx", tg.SelectAttrValue("testname", ""))
 	}
-	return doc, nil
+	ht.AddChild(timer)
+	ht.AddChild(etree.NewElement("hashTree"))
+	return nil
 }
 
-func modifyJMX(file []byte, threads, duration, rampTime string) ([]byte, error) {
-	planDoc, err := parseTestPlan(file)
+func modifyJMX(file []byte, threads, duration, rampTime, rps string) ([]byte, error) {
+	planDoc, err := jmx.ParseTestPlan(file)
 	if err != nil {
 		return nil, err
 	}
@@ -367,61 +661,159 @@ func modifyJMX(file []byte, threads, duration, rampTime string) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	// it includes threadgroups and setupthreadgroups
-	threadGroups, err := GetThreadGroups(planDoc)
+	rpsFloat := float64(0)
+	if rps != "" {
+		if rpsFloat, err = strconv.ParseFloat(rps, 64); err != nil {
+			return nil, err
+		}
+	}
+	rampTimeInt, err := strconv.Atoi(rampTime)
+	if err != nil {
+		return nil, err
+	}
+	// it includes the thread groups of the plugins and the ones in test fragments
+	threadGroups, err := jmx.GetThreadGroups(planDoc)
 	if err != nil {
 		return nil, err
 	}
 	for _, tg := range threadGroups {
-		children := tg.ChildElements()
-		for _, child := range children {
-			attrName := child.SelectAttrValue("name", "")
-			switch attrName {
-			case "ThreadGroup.duration":
-				child.SetText(strconv.Itoa(durationInt * 60))
-			case "ThreadGroup.scheduler":
-				child.SetText("true")
-			case "ThreadGroup.num_threads":
-				child.SetText(threads)
-			case "ThreadGroup.ramp_time":
-				child.SetText(rampTime)
+		jmx.RewriteThreadGroup(tg, threads, durationInt*60+int(MAX_PAUSED_TIME.Seconds()), rampTimeInt)
+		if err := addTimer(tg, makePauseTimer()); err != nil {
+			return nil, err
+		}
+		if rpsFloat > 0 {
+			if err := addTimer(tg, makeThroughputTimer(rpsFloat)); err != nil {
+				return nil, err
 			}
 		}
 	}
+	// Added after the thread groups are rewritten as the gate only runs once
+	if err := addStartGate(planDoc); err != nil {
+		return nil, err
+	}
 	return planDoc.WriteToBytes()
 }
 
-func (sw *ShibuyaWrapper) prepareJMX(sf *model.ShibuyaFile, threads, duration, rampTime string) error {
-	file, err := sw.storageClient.Download(sf.Filepath)
+func (sw *ShibuyaWrapper) prepareJMX(sf *model.ShibuyaFile, threads, duration, rampTime, rps string) error {
+	file, err := sos.Download(sw.storageClient, sf.Filepath)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	modified, err := modifyJMX(file, threads, duration, rampTime)
+	modified, err := modifyJMX(file, threads, duration, rampTime, rps)
 	if err != nil {
 		return err
 	}
 	return saveToDisk(JMX_FILENAME, modified)
 }
 
-func (sw *ShibuyaWrapper) prepareCSV(sf *model.ShibuyaFile) error {
-	file, err := sw.storageClient.Download(sf.Filepath)
+// prepareCSV only writes the part of the file of the engine to the disk as data files can be larger than the
+// memory. Contiguous splits stop reading the file after their rows. It returns the number of rows the engine
+// got, -1 when the file is not split.
+func (sw *ShibuyaWrapper) prepareCSV(sf *model.ShibuyaFile) (int64, error) {
+	if sf.TotalSplits <= 1 {
+		return -1, sw.downloadAndSaveFile(sf)
+	}
+	var header []byte
+	if sf.KeepHeader {
+		rc, err := sw.storageClient.Open(sf.Filepath)
+		if err != nil {
+			return 0, err
+		}
+		header, err = utils.ReadCSVHeader(rc)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	f, err := createOnDisk(sf.Filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if sf.SplitMode == model.RoundRobinSplitMode {
+		rc, err := sw.storageClient.Open(sf.Filepath)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return utils.SplitCSVRoundRobin(rc, f, sf.TotalSplits, sf.CurrentSplit, header)
+	}
+	rows := sf.Rows
+	if rows == 0 {
+		// Files uploaded before the rows were counted
+		if rows, err = sw.countCSVRows(sf); err != nil {
+			return 0, err
+		}
+	}
+	if len(header) > 0 {
+		rows -= 1
+	}
+	start, end, err := utils.CalCSVRange(rows, sf.TotalSplits, sf.CurrentSplit)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := sw.storageClient.Open(sf.Filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return utils.SplitCSV(rc, f, start, end, header)
+}
+
+func (sw *ShibuyaWrapper) countCSVRows(sf *model.ShibuyaFile) (int64, error) {
+	rc, err := sw.storageClient.Open(sf.Filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return utils.CountCSVRows(rc)
+}
+
+func (sw *ShibuyaWrapper) downloadAndSaveFile(sf *model.ShibuyaFile) error {
+	rc, err := sw.storageClient.Open(sf.Filepath)
 	if err != nil {
 		return err
 	}
-	splittedCSV, err := utils.SplitCSV(file, sf.TotalSplits, sf.CurrentSplit)
+	defer rc.Close()
+	f, err := createOnDisk(sf.Filename)
 	if err != nil {
 		return err
 	}
-	return saveToDisk(sf.Filename, splittedCSV)
+	defer f.Close()
+	_, err = io.Copy(f, rc)
+	return err
 }
 
-func (sw *ShibuyaWrapper) downloadAndSaveFile(sf *model.ShibuyaFile) error {
-	file, err := sw.storageClient.Download(sf.Filepath)
+// prepareJar downloads the jar into the jar folder. The checksum is verified so the engines only load the
+// version allowed for the project.
+func (sw *ShibuyaWrapper) prepareJar(sf *model.ShibuyaFile) error {
+	if err := os.MkdirAll(JAR_FOLDER, os.ModePerm); err != nil {
+		return err
+	}
+	rc, err := sw.storageClient.Open(sf.Filepath)
 	if err != nil {
 		return err
 	}
-	return saveToDisk(sf.Filename, file)
+	defer rc.Close()
+	filePath := filepath.Join(JAR_FOLDER, filepath.Base(sf.Filename))
+	log.Println(filePath)
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), rc); err != nil {
+		return err
+	}
+	if sf.Checksum == "" {
+		return nil
+	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != sf.Checksum {
+		return fmt.Errorf("Checksum of %s does not match. Expected %s, got %s", sf.Filename, sf.Checksum, checksum)
+	}
+	return nil
 }
 
 func (sw *ShibuyaWrapper) prepareTestData(edc enginesModel.EngineDataConfig) error {
@@ -429,11 +821,19 @@ func (sw *ShibuyaWrapper) prepareTestData(edc enginesModel.EngineDataConfig) err
 		fileType := filepath.Ext(sf.Filename)
 		switch fileType {
 		case ".jmx":
-			if err := sw.prepareJMX(sf, edc.Concurrency, edc.Duration, edc.Rampup); err != nil {
+			if err := sw.prepareJMX(sf, edc.Concurrency, edc.Duration, edc.Rampup, edc.RPS); err != nil {
 				return err
 			}
 		case ".csv":
-			if err := sw.prepareCSV(sf); err != nil {
+			rows, err := sw.prepareCSV(sf)
+			if err != nil {
+				return err
+			}
+			if rows >= 0 {
+				sw.csvRows[sf.Filename] = rows
+			}
+		case ".jar":
+			if err := sw.prepareJar(sf); err != nil {
 				return err
 			}
 		default:
@@ -445,53 +845,269 @@ func (sw *ShibuyaWrapper) prepareTestData(edc enginesModel.EngineDataConfig) err
 	return nil
 }
 
-func (sw *ShibuyaWrapper) startHandler(w http.ResponseWriter, r *http.Request) {
-	sw.handlerLock.Lock()
-	defer sw.handlerLock.Unlock()
-
-	if r.Method == "POST" {
-		if sw.getPid() != 0 {
-			w.WriteHeader(http.StatusConflict)
-			return
+// prepareRun downloads and prepares the test data of the run in the request. It writes the error
+// response and returns false when the engine cannot run the test.
+func (sw *ShibuyaWrapper) prepareRun(w http.ResponseWriter, r *http.Request) bool {
+	file, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	defer r.Body.Close()
+	var edc enginesModel.EngineDataConfig
+	if err := json.Unmarshal(file, &edc); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	if err := cleanTestData(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	sw.csvRows = make(map[string]int64)
+	if err := sw.prepareTestData(edc); err != nil {
+		if errors.Is(err, sos.FileNotFoundError()) {
+			w.WriteHeader(http.StatusNotFound)
+			return false
 		}
-		file, err := ioutil.ReadAll(r.Body)
-		if err != nil {
+		if errors.Is(err, jmx.ErrUncontrolledThreadGroup) {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	sw.runID = int(edc.RunID)
+	sw.engineID = edc.EngineID
+	sw.properties = edc.Properties
+	minutes, _ := strconv.Atoi(edc.Duration)
+	sw.duration = time.Duration(minutes) * time.Minute
+	sw.setTargetRPS(edc.RPS)
+	sw.reportCSVRows()
+	return true
+}
+
+// startRun starts the test right away. Without the gate file, the start gate is opened as soon as Jmeter
+// reaches it.
+func (sw *ShibuyaWrapper) startRun() int {
+	// Subscribing before Jmeter is launched so the opening of the gate cannot be missed
+	_, lines := sw.logs.Subscribe()
+	pid := sw.runCommand()
+	go sw.tailJemeter()
+	go sw.keepTestDuration(pid, sw.duration, lines, enginesModel.TestStartTimeout)
+	log.Printf("shibuya-agent: Start running Jmeter process with pid: %d", pid)
+	return pid
+}
+
+// keepTestDuration ends the test once Jmeter has been sampling for the duration, counted from the opening of
+// the start gate. The time the sampling is paused is not counted, so the thread groups are given MAX_PAUSED_TIME
+// on top of the duration and would only end the test by themselves after a longer pause.
+func (sw *ShibuyaWrapper) keepTestDuration(pid int, duration time.Duration, lines chan string, gateTimeout time.Duration) {
+	sw.waitForLine(lines, GATE_OPENED_LINE, gateTimeout)
+	sw.logs.Unsubscribe(lines)
+	if pid == 0 || duration <= 0 {
+		return
+	}
+	var sampled time.Duration
+	last := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if sw.getPid() != pid {
 			return
 		}
-		defer r.Body.Close()
-		var edc enginesModel.EngineDataConfig
-		if err := json.Unmarshal(file, &edc); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
+		now := time.Now()
+		if !isSamplingPaused() {
+			sampled += now.Sub(last)
+		}
+		last = now
+		if sampled >= duration {
+			log.Printf("shibuya-agent: Jmeter process %d has sampled for %v, shutting it down", pid, duration)
+			exec.Command(JMETER_SHUTDOWN).Run()
 			return
 		}
-		if err := cleanTestData(); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// startHandler prepares the test data and starts the test right away
+func (sw *ShibuyaWrapper) startHandler(w http.ResponseWriter, r *http.Request) {
+	sw.handlerLock.Lock()
+	defer sw.handlerLock.Unlock()
+
+	if r.Method == "POST" {
+		if sw.getPid() != 0 {
+			w.WriteHeader(http.StatusConflict)
 			return
 		}
-		if err := sw.prepareTestData(edc); err != nil {
-			if errors.Is(err, sos.FileNotFoundError()) {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if !sw.prepareRun(w, r) {
 			return
 		}
-		sw.runID = int(edc.RunID)
-		sw.engineID = edc.EngineID
-		pid := sw.runCommand()
-		go sw.tailJemeter()
-		log.Printf("shibuya-agent: Start running Jmeter process with pid: %d", pid)
+		pid := sw.startRun()
 		w.Write([]byte(strconv.Itoa(pid)))
 		return
 	}
 	w.Write([]byte("hmm"))
 }
 
+// prepareHandler is the first phase of a synchronized start. The engine gets ready to run the test and starts
+// Jmeter, which holds the test at the start gate until the commit. So the start of the JVM and the loading of
+// the test plan do not delay the test.
+func (sw *ShibuyaWrapper) prepareHandler(w http.ResponseWriter, r *http.Request) {
+	sw.handlerLock.Lock()
+	defer sw.handlerLock.Unlock()
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if sw.getPid() != 0 {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if !sw.prepareRun(w, r) {
+		return
+	}
+	if err := closeGate(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Subscribing before Jmeter is launched so it cannot reach the gate unnoticed
+	_, lines := sw.logs.Subscribe()
+	pid := sw.runCommand()
+	if pid == 0 {
+		sw.logs.Unsubscribe(lines)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := sw.waitForLine(lines, GATE_WAITING_LINE, enginesModel.TestStartTimeout); !ok {
+		sw.logs.Unsubscribe(lines)
+		log.Printf("shibuya-agent: Jmeter process %d did not reach the start gate", pid)
+		sw.killJmeter(pid)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sw.gated.Store(true)
+	go sw.tailJemeter()
+	go sw.keepTestDuration(pid, sw.duration, lines, GATE_TIMEOUT)
+	go sw.expireGate(pid)
+	log.Printf("shibuya-agent: Run %d is prepared, Jmeter process %d is waiting at the start gate", sw.runID, pid)
+}
+
+// commitHandler opens the start gate at start_at, in unix milliseconds, so all the engines of the run
+// start together. It replies once the gate is opened.
+func (sw *ShibuyaWrapper) commitHandler(w http.ResponseWriter, r *http.Request) {
+	sw.handlerLock.Lock()
+	defer sw.handlerLock.Unlock()
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !sw.gated.Load() {
+		sw.rejectCommit(w)
+		return
+	}
+	receivedTime := time.Now()
+	startAtMs, err := strconv.ParseInt(r.FormValue("start_at"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("start_at should be in unix milliseconds"))
+		return
+	}
+	startAt := time.Unix(0, startAtMs*int64(time.Millisecond))
+	time.Sleep(time.Until(startAt))
+	_, lines := sw.logs.Subscribe()
+	defer sw.logs.Unsubscribe(lines)
+	// The test could be stopped while waiting for start_at
+	if !sw.gated.Swap(false) {
+		sw.rejectCommit(w)
+		return
+	}
+	if err := openGate(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	startedTime, ok := sw.waitForLine(lines, GATE_OPENED_LINE, enginesModel.TestStartTimeout)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("shibuya-agent: Start gate of run %d is opened", sw.runID)
+	json.NewEncoder(w).Encode(&enginesModel.StartResult{
+		StartedTime:  startedTime,
+		ReceivedTime: receivedTime,
+	})
+}
+
+// rejectCommit replies to a commit when Jmeter is not waiting at the start gate
+func (sw *ShibuyaWrapper) rejectCommit(w http.ResponseWriter) {
+	if sw.getPid() != 0 {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte("The engine is not prepared for the test"))
+}
+
+func closeGate() error {
+	return ioutil.WriteFile(GATE_FILEPATH, []byte{}, 0777)
+}
+
+func openGate() error {
+	if err := os.Remove(GATE_FILEPATH); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// expireGate gives up the test when the commit does not come in time, so a lost commit does not keep
+// the engine busy
+func (sw *ShibuyaWrapper) expireGate(pid int) {
+	time.Sleep(GATE_TIMEOUT)
+	if sw.getPid() != pid || !sw.gated.Swap(false) {
+		return
+	}
+	log.Printf("shibuya-agent: Run %d is not committed in %v, killing Jmeter process %d", sw.runID, GATE_TIMEOUT, pid)
+	sw.abortGatedRun(pid)
+}
+
+// abortGatedRun kills Jmeter while it is still waiting at the start gate
+func (sw *ShibuyaWrapper) abortGatedRun(pid int) {
+	log.Printf("shibuya-agent: Killing Jmeter process %d waiting at the start gate", pid)
+	sw.killJmeter(pid)
+	sw.closeSignal <- 1
+}
+
+// waitForLine returns when Jmeter logs the line. It gives up when Jmeter exits or does not log the line in time.
+func (sw *ShibuyaWrapper) waitForLine(lines chan string, expected string, timeout time.Duration) (time.Time, bool) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, expected) {
+				return time.Now(), true
+			}
+		case <-ticker.C:
+			if sw.getPid() == 0 {
+				log.Printf("shibuya-agent: Jmeter exited before logging %q", expected)
+				return time.Now(), false
+			}
+		case <-deadline:
+			log.Printf("shibuya-agent: Jmeter did not log %q in %v", expected, timeout)
+			return time.Now(), false
+		}
+	}
+}
+
 func (sw *ShibuyaWrapper) progressHandler(w http.ResponseWriter, r *http.Request) {
 	pid := sw.getPid()
 	if pid == 0 {
@@ -501,8 +1117,33 @@ func (sw *ShibuyaWrapper) progressHandler(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
 }
 
+// stdoutHandler returns the buffered output of the engine. With follow=true, the new lines are streamed
+// until the client goes away.
 func (sw *ShibuyaWrapper) stdoutHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write(sw.buffer)
+	follow := r.URL.Query().Get("follow") == "true"
+	flusher, ok := w.(http.Flusher)
+	if !follow || !ok {
+		for _, line := range sw.logs.Lines() {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+	lines, c := sw.logs.Subscribe()
+	defer sw.logs.Unsubscribe(c)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case line := <-c:
+			fmt.Fprintln(w, line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
 // This func reports the cpu/memory usage of the engine
@@ -533,8 +1174,46 @@ func (sw *ShibuyaWrapper) reportOwnMetrics(interval time.Duration) error {
 	}
 }
 
+func (sw *ShibuyaWrapper) makeRunLabels() []string {
+	return []string{sw.collectionID, sw.planID, strconv.Itoa(sw.runID), strconv.Itoa(sw.engineID)}
+}
+
+func (sw *ShibuyaWrapper) setTargetRPS(rps string) {
+	if rps == "" {
+		return
+	}
+	target, err := strconv.ParseFloat(rps, 64)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	config.TargetRPSGauge.WithLabelValues(sw.makeRunLabels()...).Set(target)
+}
+
+func (sw *ShibuyaWrapper) reportCSVRows() {
+	for filename, rows := range sw.csvRows {
+		log.Printf("shibuya-agent: engine %d got %d rows of %s", sw.engineID, rows, filename)
+		labels := append(sw.makeRunLabels(), filename)
+		config.CSVRowsGauge.WithLabelValues(labels...).Set(float64(rows))
+	}
+}
+
+// This func reports the rps achieved by the engine so it can be compared with the target rps
+func (sw *ShibuyaWrapper) reportThroughput(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		samples := atomic.SwapInt64(&sw.samplesCount, 0)
+		if sw.getPid() == 0 && samples == 0 {
+			continue
+		}
+		config.AchievedRPSGauge.WithLabelValues(sw.makeRunLabels()...).Set(float64(samples) / interval.Seconds())
+	}
+}
+
 func main() {
+	log.Printf("shibuya-agent: Using JMeter in %s", JMETER_BIN_FOLDER)
 	sw := NewServer()
+	go sw.reportThroughput(5 * time.Second)
 	go func() {
 		if err := sw.reportOwnMetrics(5 * time.Second); err != nil {
 			// if the engine is having issues with reading stats from cgroup
@@ -544,7 +1223,11 @@ func main() {
 		}
 	}()
 	http.HandleFunc("/start", sw.startHandler)
+	http.HandleFunc("/prepare", sw.prepareHandler)
+	http.HandleFunc("/commit", sw.commitHandler)
 	http.HandleFunc("/stop", sw.stopHandler)
+	http.HandleFunc("/pause", sw.pauseHandler)
+	http.HandleFunc("/resume", sw.resumeHandler)
 	http.HandleFunc("/stream", sw.streamHandler)
 	http.HandleFunc("/progress", sw.progressHandler)
 	http.HandleFunc("/output", sw.stdoutHandler)
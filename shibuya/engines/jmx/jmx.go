@@ -0,0 +1,70 @@
+package jmx
+
+import (
+	"errors"
+
+	etree "github.com/beevik/etree"
+)
+
+func ParseTestPlan(file []byte) (*etree.Document, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(file); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// FindTestPlanHashTree returns the hash tree holding the children of the test plan, where the thread groups are
+func FindTestPlanHashTree(planDoc *etree.Document) (*etree.Element, error) {
+	jtp := planDoc.SelectElement("jmeterTestPlan")
+	if jtp == nil {
+		return nil, errors.New("Missing Jmeter Test plan in jmx")
+	}
+	ht := jtp.SelectElement("hashTree")
+	if ht == nil {
+		return nil, errors.New("Missing hash tree inside Jmeter test plan in jmx")
+	}
+	ht = ht.SelectElement("hashTree")
+	if ht == nil {
+		return nil, errors.New("Missing hash tree inside hash tree in jmx")
+	}
+	return ht, nil
+}
+
+func FindThreadGroupHashTree(tg *etree.Element) *etree.Element {
+	// In jmx, the children of an element are put into the hash tree right after the element
+	parent := tg.Parent()
+	if parent == nil {
+		return nil
+	}
+	children := parent.ChildElements()
+	for i, child := range children {
+		if child != tg {
+			continue
+		}
+		if i+1 < len(children) && children[i+1].Tag == "hashTree" {
+			return children[i+1]
+		}
+		return nil
+	}
+	return nil
+}
+
+func isDisabled(e *etree.Element) bool {
+	return e.SelectAttrValue("enabled", "true") == "false"
+}
+
+// walkTestElements calls fn for every test element under the hash tree. Children of an element are in the
+// hash tree following it.
+func walkTestElements(ht *etree.Element, disabled bool, fn func(e *etree.Element, parentDisabled bool)) {
+	children := ht.ChildElements()
+	for i, child := range children {
+		if child.Tag == "hashTree" {
+			continue
+		}
+		fn(child, disabled)
+		if i+1 < len(children) && children[i+1].Tag == "hashTree" {
+			walkTestElements(children[i+1], disabled || isDisabled(child), fn)
+		}
+	}
+}
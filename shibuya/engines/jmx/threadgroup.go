@@ -0,0 +1,159 @@
+package jmx
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	etree "github.com/beevik/etree"
+)
+
+// Thread groups shibuya rewrites with the threads, duration and ramp up of the plan. Plugin thread groups
+// are saved with their full class names so they are matched by the last part of the name.
+var SupportedThreadGroups = []string{"ThreadGroup", "SetupThreadGroup", "ConcurrencyThreadGroup",
+	"ArrivalsThreadGroup", "UltimateThreadGroup"}
+
+// Thread groups left as they are on purpose. tearDown thread groups usually run once after the test.
+var keptThreadGroups = []string{"PostThreadGroup"}
+
+var ErrUncontrolledThreadGroup = errors.New("Thread groups cannot be controlled by shibuya")
+
+// threadGroupKind returns the class name without the package, e.g. UltimateThreadGroup
+func threadGroupKind(e *etree.Element) string {
+	kind := e.Tag
+	if i := strings.LastIndex(kind, "."); i >= 0 {
+		kind = kind[i+1:]
+	}
+	return kind
+}
+
+func contains(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// findThreadGroups returns the enabled thread groups shibuya can rewrite and the enabled ones it cannot. Thread
+// groups can be anywhere in the tree, e.g. in test fragments. Disabled thread groups are not run so they are left
+// as they are.
+func findThreadGroups(planDoc *etree.Document) ([]*etree.Element, []*etree.Element, error) {
+	if _, err := FindTestPlanHashTree(planDoc); err != nil {
+		return nil, nil, err
+	}
+	root := planDoc.SelectElement("jmeterTestPlan").SelectElement("hashTree")
+	controlled := []*etree.Element{}
+	uncontrolled := []*etree.Element{}
+	walkTestElements(root, false, func(e *etree.Element, parentDisabled bool) {
+		kind := threadGroupKind(e)
+		if !strings.HasSuffix(kind, "ThreadGroup") || contains(keptThreadGroups, kind) {
+			return
+		}
+		if parentDisabled || isDisabled(e) {
+			return
+		}
+		if contains(SupportedThreadGroups, kind) {
+			controlled = append(controlled, e)
+			return
+		}
+		uncontrolled = append(uncontrolled, e)
+	})
+	return controlled, uncontrolled, nil
+}
+
+// GetThreadGroups returns the thread groups to be rewritten. It fails when some of the thread groups
+// cannot be controlled as the test would not follow the plan.
+func GetThreadGroups(planDoc *etree.Document) ([]*etree.Element, error) {
+	controlled, uncontrolled, err := findThreadGroups(planDoc)
+	if err != nil {
+		return nil, err
+	}
+	if len(uncontrolled) > 0 {
+		names := []string{}
+		for _, tg := range uncontrolled {
+			names = append(names, fmt.Sprintf("%s (%s)", tg.SelectAttrValue("testname", ""), threadGroupKind(tg)))
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUncontrolledThreadGroup, strings.Join(names, ", "))
+	}
+	return controlled, nil
+}
+
+// setProp sets the text of the property with the name. The property is created when it's missing.
+func setProp(e *etree.Element, tag, name, value string) {
+	for _, child := range e.SelectElements(tag) {
+		if child.SelectAttrValue("name", "") == name {
+			child.SetText(value)
+			return
+		}
+	}
+	prop := e.CreateElement(tag)
+	prop.CreateAttr("name", name)
+	prop.SetText(value)
+}
+
+// RewriteThreadGroup makes the thread group run the threads for the duration, ramping up in rampTime.
+// Both of the times are in seconds and the duration includes the ramp up.
+func RewriteThreadGroup(tg *etree.Element, threads string, duration, rampTime int) {
+	hold := duration - rampTime
+	if hold < 0 {
+		hold = 0
+	}
+	switch threadGroupKind(tg) {
+	case "ConcurrencyThreadGroup":
+		setProp(tg, "stringProp", "TargetLevel", threads)
+		setProp(tg, "stringProp", "RampUp", strconv.Itoa(rampTime))
+		setProp(tg, "stringProp", "Hold", strconv.Itoa(hold))
+		setProp(tg, "stringProp", "Unit", "S")
+	case "ArrivalsThreadGroup":
+		// The target level is the arrival rate so the threads limit the concurrency
+		setProp(tg, "stringProp", "ConcurrencyLimit", threads)
+		setProp(tg, "stringProp", "RampUp", strconv.Itoa(rampTime))
+		setProp(tg, "stringProp", "Hold", strconv.Itoa(hold))
+		setProp(tg, "stringProp", "Unit", "S")
+	case "UltimateThreadGroup":
+		rewriteUltimateThreadGroup(tg, threads, hold, rampTime)
+	default:
+		for _, child := range tg.ChildElements() {
+			attrName := child.SelectAttrValue("name", "")
+			switch attrName {
+			case "ThreadGroup.duration":
+				child.SetText(strconv.Itoa(duration))
+			case "ThreadGroup.scheduler":
+				child.SetText("true")
+			case "ThreadGroup.num_threads":
+				child.SetText(threads)
+			case "ThreadGroup.ramp_time":
+				child.SetText(strconv.Itoa(rampTime))
+			}
+		}
+	}
+}
+
+// The schedule of the ultimate thread group is replaced by a single row of
+// threads, initial delay, startup time, hold time and shutdown time
+func rewriteUltimateThreadGroup(tg *etree.Element, threads string, hold, rampTime int) {
+	var data *etree.Element
+	for _, cp := range tg.SelectElements("collectionProp") {
+		if cp.SelectAttrValue("name", "") == "ultimatethreadgroupdata" {
+			data = cp
+			break
+		}
+	}
+	if data == nil {
+		data = tg.CreateElement("collectionProp")
+		data.CreateAttr("name", "ultimatethreadgroupdata")
+	}
+	for _, row := range data.ChildElements() {
+		data.RemoveChild(row)
+	}
+	row := data.CreateElement("collectionProp")
+	row.CreateAttr("name", "shibuya")
+	for _, v := range []string{threads, "0", strconv.Itoa(rampTime), strconv.Itoa(hold), "0"} {
+		prop := row.CreateElement("stringProp")
+		prop.CreateAttr("name", v)
+		prop.SetText(v)
+	}
+}
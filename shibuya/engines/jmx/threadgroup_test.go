@@ -0,0 +1,169 @@
+package jmx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func makeTestPlan(threadGroups string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<jmeterTestPlan version="1.2">
+  <hashTree>
+    <TestPlan testname="Test Plan" enabled="true"/>
+    <hashTree>` + threadGroups + `</hashTree>
+  </hashTree>
+</jmeterTestPlan>`)
+}
+
+const (
+	threadGroup = `
+      <ThreadGroup testname="tg" enabled="true">
+        <stringProp name="ThreadGroup.num_threads">1</stringProp>
+        <stringProp name="ThreadGroup.ramp_time">1</stringProp>
+        <boolProp name="ThreadGroup.scheduler">false</boolProp>
+        <stringProp name="ThreadGroup.duration"></stringProp>
+      </ThreadGroup>
+      <hashTree/>`
+	concurrencyThreadGroup = `
+      <com.blazemeter.jmeter.threads.concurrency.ConcurrencyThreadGroup testname="concurrency" enabled="true">
+        <stringProp name="TargetLevel">5</stringProp>
+        <stringProp name="RampUp">1</stringProp>
+        <stringProp name="Hold">2</stringProp>
+        <stringProp name="Unit">M</stringProp>
+      </com.blazemeter.jmeter.threads.concurrency.ConcurrencyThreadGroup>
+      <hashTree/>`
+	ultimateThreadGroup = `
+      <kg.apc.jmeter.threads.UltimateThreadGroup testname="ultimate" enabled="true">
+        <collectionProp name="ultimatethreadgroupdata">
+          <collectionProp name="1">
+            <stringProp name="1">5</stringProp>
+            <stringProp name="2">0</stringProp>
+            <stringProp name="3">10</stringProp>
+            <stringProp name="4">60</stringProp>
+            <stringProp name="5">10</stringProp>
+          </collectionProp>
+          <collectionProp name="2">
+            <stringProp name="1">5</stringProp>
+            <stringProp name="2">30</stringProp>
+            <stringProp name="3">10</stringProp>
+            <stringProp name="4">60</stringProp>
+            <stringProp name="5">10</stringProp>
+          </collectionProp>
+        </collectionProp>
+      </kg.apc.jmeter.threads.UltimateThreadGroup>
+      <hashTree/>`
+	fragment = `
+      <TestFragmentController testname="fragment" enabled="true"/>
+      <hashTree>` + threadGroup + `
+      </hashTree>`
+)
+
+func findProp(t *testing.T, file []byte, path string) string {
+	doc, err := ParseTestPlan(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := doc.FindElement(path)
+	if e == nil {
+		t.Fatalf("%s not found", path)
+	}
+	return e.Text()
+}
+
+func rewrite(t *testing.T, file []byte) []byte {
+	doc, err := ParseTestPlan(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgs, err := GetThreadGroups(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tg := range tgs {
+		RewriteThreadGroup(tg, "10", 600, 60)
+	}
+	out, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRewriteThreadGroup(t *testing.T) {
+	out := rewrite(t, makeTestPlan(threadGroup))
+	expected := map[string]string{
+		"ThreadGroup.num_threads": "10",
+		"ThreadGroup.ramp_time":   "60",
+		"ThreadGroup.scheduler":   "true",
+		"ThreadGroup.duration":    "600",
+	}
+	for name, value := range expected {
+		if v := findProp(t, out, "//ThreadGroup/*[@name='"+name+"']"); v != value {
+			t.Errorf("%s: expected %s, got %s", name, value, v)
+		}
+	}
+}
+
+func TestRewriteConcurrencyThreadGroup(t *testing.T) {
+	out := rewrite(t, makeTestPlan(concurrencyThreadGroup))
+	expected := map[string]string{
+		"TargetLevel": "10",
+		"RampUp":      "60",
+		"Hold":        "540",
+		"Unit":        "S",
+	}
+	for name, value := range expected {
+		if v := findProp(t, out, "//com.blazemeter.jmeter.threads.concurrency.ConcurrencyThreadGroup/stringProp[@name='"+name+"']"); v != value {
+			t.Errorf("%s: expected %s, got %s", name, value, v)
+		}
+	}
+}
+
+func TestRewriteUltimateThreadGroup(t *testing.T) {
+	out := rewrite(t, makeTestPlan(ultimateThreadGroup))
+	doc, err := ParseTestPlan(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := doc.FindElements("//collectionProp[@name='ultimatethreadgroupdata']/collectionProp")
+	if len(rows) != 1 {
+		t.Fatalf("expected a single row, got %d", len(rows))
+	}
+	values := []string{}
+	for _, p := range rows[0].SelectElements("stringProp") {
+		values = append(values, p.Text())
+	}
+	if strings.Join(values, ",") != "10,0,60,540,0" {
+		t.Errorf("unexpected schedule %v", values)
+	}
+}
+
+func TestThreadGroupsInTestFragments(t *testing.T) {
+	out := rewrite(t, makeTestPlan(fragment))
+	if v := findProp(t, out, "//ThreadGroup/*[@name='ThreadGroup.num_threads']"); v != "10" {
+		t.Errorf("thread group in the fragment should be rewritten, got %s threads", v)
+	}
+}
+
+func TestUncontrolledThreadGroup(t *testing.T) {
+	unknown := `
+      <com.example.CustomThreadGroup testname="custom" enabled="true"/>
+      <hashTree/>`
+	doc, err := ParseTestPlan(makeTestPlan(threadGroup + unknown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetThreadGroups(doc); !errors.Is(err, ErrUncontrolledThreadGroup) {
+		t.Errorf("expected uncontrolled thread group error, got %v", err)
+	}
+	// Disabled thread groups are not run so they are fine
+	disabled := strings.Replace(unknown, `enabled="true"`, `enabled="false"`, 1)
+	doc, err = ParseTestPlan(makeTestPlan(threadGroup + disabled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetThreadGroups(doc); err != nil {
+		t.Errorf("disabled thread groups should be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package jmx
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	etree "github.com/beevik/etree"
+)
+
+const (
+	ErrorLevel   = "error"
+	WarningLevel = "warning"
+)
+
+var ErrInvalidTestPlan = errors.New("Invalid test plan")
+
+// Core JMeter classes are either saved with their short names or under this package
+const coreClassPrefix = "org.apache.jmeter."
+
+// DefaultImage is the key of the plugins of the default engine image
+const DefaultImage = ""
+
+// Issue is a problem found in the test plan that will make the test behave differently than expected.
+// Test plans with errors cannot be run by shibuya.
+type Issue struct {
+	Level   string `json:"level"`
+	Element string `json:"element"` // testname of the element
+	Message string `json:"message"`
+}
+
+type validator struct {
+	dataFiles map[string]bool
+	// plugins installed in each of the engine images, by the image name
+	plugins map[string][]string
+	issues  []*Issue
+	// plugin classes already reported
+	classes map[string]bool
+}
+
+func (v *validator) add(level string, e *etree.Element, format string, args ...interface{}) {
+	v.issues = append(v.issues, &Issue{
+		Level:   level,
+		Element: e.SelectAttrValue("testname", e.Tag),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) checkThreadGroups(planDoc *etree.Document) error {
+	controlled, uncontrolled, err := findThreadGroups(planDoc)
+	if err != nil {
+		return err
+	}
+	for _, tg := range uncontrolled {
+		v.add(ErrorLevel, tg, "%s cannot be controlled by shibuya so it ignores the threads and duration of the plan", threadGroupKind(tg))
+	}
+	if len(controlled) == 0 {
+		v.issues = append(v.issues, &Issue{
+			Level:   ErrorLevel,
+			Message: fmt.Sprintf("No enabled thread group shibuya can run. Supported thread groups are %s", strings.Join(SupportedThreadGroups, ", ")),
+		})
+	}
+	return nil
+}
+
+func (v *validator) checkCSVDataSet(e *etree.Element) {
+	for _, prop := range e.SelectElements("stringProp") {
+		if prop.SelectAttrValue("name", "") != "filename" {
+			continue
+		}
+		filename := strings.TrimSpace(prop.Text())
+		// Files set by variables can only be known at runtime
+		if filename == "" || strings.Contains(filename, "${") {
+			return
+		}
+		// Engines put all the data files into the same folder. The file can still be uploaded after the test plan
+		if !v.dataFiles[filepath.Base(filename)] {
+			v.add(WarningLevel, e, "%s is not uploaded to the plan or the collections using the plan yet", filepath.Base(filename))
+		}
+	}
+}
+
+func isInstalled(class string, plugins []string) bool {
+	if !strings.Contains(class, ".") || strings.HasPrefix(class, coreClassPrefix) {
+		return true
+	}
+	for _, p := range plugins {
+		if strings.HasPrefix(class, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingImages returns the engine images the class is not installed in
+func (v *validator) missingImages(class string) []string {
+	images := []string{}
+	for image, plugins := range v.plugins {
+		if isInstalled(class, plugins) {
+			continue
+		}
+		if image == DefaultImage {
+			image = "default"
+		}
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+func (v *validator) checkPlugins(e *etree.Element) {
+	classes := []string{e.Tag, e.SelectAttrValue("testclass", "")}
+	for _, ep := range e.FindElements(".//elementProp") {
+		classes = append(classes, ep.SelectAttrValue("elementType", ""))
+	}
+	for _, class := range classes {
+		if class == "" || v.classes[class] {
+			continue
+		}
+		images := v.missingImages(class)
+		if len(images) == 0 {
+			continue
+		}
+		v.classes[class] = true
+		v.add(ErrorLevel, e, "plugin class %s is not installed in the engine image %s", class, strings.Join(images, ", "))
+	}
+}
+
+// HasErrors tells whether any of the issues is an error
+func HasErrors(issues []*Issue) bool {
+	for _, issue := range issues {
+		if issue.Level == ErrorLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate finds the problems of the test plan before it's run. dataFiles are the names of the files the
+// engines will receive and plugins are the class name prefixes of the plugins installed in each of the engine
+// images the test plan runs on. It only returns an error when the file is not a valid test plan.
+func Validate(file []byte, dataFiles []string, plugins map[string][]string) ([]*Issue, error) {
+	planDoc, err := ParseTestPlan(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTestPlan, err)
+	}
+	v := &validator{
+		dataFiles: make(map[string]bool),
+		plugins:   plugins,
+		issues:    []*Issue{},
+		classes:   make(map[string]bool),
+	}
+	for _, f := range dataFiles {
+		v.dataFiles[f] = true
+	}
+	if err := v.checkThreadGroups(planDoc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTestPlan, err)
+	}
+	root := planDoc.SelectElement("jmeterTestPlan").SelectElement("hashTree")
+	walkTestElements(root, false, func(e *etree.Element, parentDisabled bool) {
+		// JMeter loads the classes of the disabled elements too
+		v.checkPlugins(e)
+		if parentDisabled {
+			return
+		}
+		if isDisabled(e) {
+			v.add(WarningLevel, e, "%s is disabled", e.Tag)
+			return
+		}
+		if e.Tag == "CSVDataSet" {
+			v.checkCSVDataSet(e)
+		}
+	})
+	return v.issues, nil
+}
@@ -0,0 +1,79 @@
+package jmx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMissingCSVIsWarning(t *testing.T) {
+	csvThreadGroup := `
+      <ThreadGroup testname="tg" enabled="true">
+        <stringProp name="ThreadGroup.num_threads">1</stringProp>
+      </ThreadGroup>
+      <hashTree>
+        <CSVDataSet testname="users" enabled="true">
+          <stringProp name="filename">users.csv</stringProp>
+        </CSVDataSet>
+        <hashTree/>
+      </hashTree>`
+	issues, err := Validate(makeTestPlan(csvThreadGroup), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Level != WarningLevel {
+		t.Fatalf("expected a warning for the missing file, got %v", issues)
+	}
+	if HasErrors(issues) {
+		t.Error("the test plan should be runnable once the file is uploaded")
+	}
+}
+
+func TestValidatePluginsPerImage(t *testing.T) {
+	plugins := map[string][]string{
+		DefaultImage: {"kg.apc.jmeter."},
+		"jmeter-5":   {"com.blazemeter."},
+	}
+	issues, err := Validate(makeTestPlan(ultimateThreadGroup), nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || !strings.HasSuffix(issues[0].Message, "engine image jmeter-5") {
+		t.Fatalf("expected the class to be missing in jmeter-5 only, got %v", issues)
+	}
+	issues, err = Validate(makeTestPlan(ultimateThreadGroup+concurrencyThreadGroup), nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 2 || !strings.HasSuffix(issues[1].Message, "engine image default") {
+		t.Fatalf("expected each class to be missing in one image, got %v", issues)
+	}
+	delete(plugins, "jmeter-5")
+	issues, err = Validate(makeTestPlan(ultimateThreadGroup), nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HasErrors(issues) {
+		t.Errorf("the class is installed in every image, got %v", issues)
+	}
+}
+
+func TestValidateDisabledThreadGroups(t *testing.T) {
+	disabled := strings.Replace(threadGroup, `enabled="true"`, `enabled="false"`, 1)
+	disabledFragment := strings.Replace(fragment, `enabled="true"`, `enabled="false"`, 1)
+	for _, tgs := range []string{disabled, disabledFragment} {
+		issues, err := Validate(makeTestPlan(tgs), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !HasErrors(issues) {
+			t.Errorf("test plans without an enabled thread group should be errors, got %v", issues)
+		}
+	}
+	issues, err := Validate(makeTestPlan(disabled+threadGroup), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HasErrors(issues) {
+		t.Errorf("one enabled thread group is enough, got %v", issues)
+	}
+}
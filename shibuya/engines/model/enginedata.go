@@ -7,6 +7,9 @@ type EngineDataConfig struct {
 	Duration    string                        `json:"duration"`
 	Concurrency string                        `json:"concurrency"`
 	Rampup      string                        `json:"rampup"`
+	RPS         string                        `json:"rps"`
 	RunID       int64                         `json:"run_id"`
 	EngineID    int                           `json:"engine_id"`
+	// JMeter properties passed with -J, including the ones set by shibuya
+	Properties map[string]string `json:"properties"`
 }
@@ -20,6 +20,11 @@ func (edc *EngineDataConfig) deepCopy() *EngineDataConfig {
 		Duration:    edc.Duration,
 		Concurrency: edc.Concurrency,
 		Rampup:      edc.Rampup,
+		RPS:         edc.RPS,
+		Properties:  map[string]string{},
+	}
+	for k, v := range edc.Properties {
+		edcCopy.Properties[k] = v
 	}
 	for filename, ed := range edc.EngineData {
 		sf := model.ShibuyaFile{
@@ -28,6 +33,10 @@ func (edc *EngineDataConfig) deepCopy() *EngineDataConfig {
 			Filelink:     ed.Filelink,
 			TotalSplits:  ed.TotalSplits,
 			CurrentSplit: ed.CurrentSplit,
+			Version:      ed.Version,
+			Checksum:     ed.Checksum,
+			Rows:         ed.Rows,
+			CSVSettings:  ed.CSVSettings,
 		}
 		edcCopy.EngineData[filename] = &sf
 	}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// TestStartTimeout is how long the engine waits for Jmeter to reach the start gate after launching it.
+// Jmeter needs a few seconds to start the JVM and load the test plan.
+const TestStartTimeout = time.Minute
+
+// StartResult is replied by the engine when the test is started at the time requested by the controller
+type StartResult struct {
+	// When the start gate was opened, by the clock of the engine
+	StartedTime time.Time `json:"started_time"`
+	// When the start request reached the engine, by the clock of the engine. The controller compares it with
+	// the time it sent the request to find out how much the clock of the engine is off
+	ReceivedTime time.Time `json:"received_time"`
+	// Set by the controller. The clock of the engine minus the clock of the controller, including the
+	// network latency of the request
+	ClockOffset time.Duration `json:"-"`
+}
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// These are the ways a test can be ended by the engine when it receives a stop request.
+// The agent escalates from one to the next when the previous one does not finish the test in time.
+const (
+	StoppedByStopTest = "stoptest"
+	StoppedByShutdown = "shutdown"
+	StoppedByKill     = "kill"
+)
+
+const (
+	// Used when the controller does not specify the graceful timeout
+	DefaultGracefulStopTimeout = 60 * time.Second
+	// How long the engine waits for the shutdown script before killing the process
+	ShutdownWindow = 10 * time.Second
+)
+
+type StopResult struct {
+	StoppedBy string `json:"stopped_by"`
+}
+
+// Forced means the test did not finish within the graceful timeout
+func (sr *StopResult) Forced() bool {
+	return sr.StoppedBy == StoppedByShutdown || sr.StoppedBy == StoppedByKill
+}
@@ -3,7 +3,6 @@ package model
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -12,7 +11,6 @@ import (
 	"github.com/rakutentech/shibuya/shibuya/object_storage"
 
 	mysql "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 type ShibuyaFile struct {
@@ -21,17 +19,22 @@ type ShibuyaFile struct {
 	Filelink     string `json:"filelink"` // Full url for users to download the file - storage.com/shibuya/plan/22/a.txt
 	TotalSplits  int    `json:"total_splits"`
 	CurrentSplit int    `json:"current_split"`
+	Version      int    `json:"version"`  // Version of the file in use
+	Checksum     string `json:"checksum"` // sha256 of the version. Empty for the files uploaded before versioning
+	Rows         int64  `json:"rows"`     // Rows of the CSV files. 0 when they are not counted
+	CSVSettings
 }
 
 type Collection struct {
-	ID             int64            `json:"id"`
-	Name           string           `json:"name"`
-	ProjectID      int64            `json:"project_id"`
-	ExecutionPlans []*ExecutionPlan `json:"execution_plans"`
-	RunHistories   []*RunHistory    `json:"run_history"`
-	CreatedTime    time.Time        `json:"created_time"`
-	Data           []*ShibuyaFile   `json:"data"`
-	CSVSplit       bool             `json:"csv_split"`
+	ID             int64             `json:"id"`
+	Name           string            `json:"name"`
+	ProjectID      int64             `json:"project_id"`
+	ExecutionPlans []*ExecutionPlan  `json:"execution_plans"`
+	RunHistories   []*RunHistory     `json:"run_history"`
+	CreatedTime    time.Time         `json:"created_time"`
+	Data           []*ShibuyaFile    `json:"data"`
+	CSVSplit       bool              `json:"csv_split"`
+	Properties     map[string]string `json:"properties"`
 }
 
 type CollectionLaunchHistory struct {
@@ -63,18 +66,20 @@ func CreateCollection(name string, projectID int64) (int64, error) {
 func GetCollection(ID int64) (*Collection, error) {
 	DBC := config.SC.DBC
 
-	q, err := DBC.Prepare("select id, name, project_id, created_time, csv_split from collection where id=?")
+	q, err := DBC.Prepare("select id, name, project_id, created_time, csv_split, properties from collection where id=?")
 	if err != nil {
 		return nil, err
 	}
 	defer q.Close()
 
 	collection := new(Collection)
+	var properties sql.NullString
 	err = q.QueryRow(ID).Scan(&collection.ID, &collection.Name, &collection.ProjectID,
-		&collection.CreatedTime, &collection.CSVSplit)
+		&collection.CreatedTime, &collection.CSVSplit, &properties)
 	if err != nil {
 		return nil, &DBError{Err: err, Message: "collection not found"}
 	}
+	collection.Properties = unmarshalProperties(properties)
 	if collection.Data, err = collection.getCollectionFiles(); err != nil {
 		return collection, err
 	}
@@ -110,15 +115,27 @@ func (c *Collection) AddExecutionPlan(ep *ExecutionPlan) error {
 	if ep.CSVSplit {
 		CSVSplitDB = 1
 	}
+	properties, err := marshalProperties(ep.Properties)
+	if err != nil {
+		return err
+	}
+	var dependsOnPlanID sql.NullInt64
+	var dependsOnState string
+	if ep.DependsOn != nil {
+		dependsOnPlanID = sql.NullInt64{Int64: ep.DependsOn.PlanID, Valid: true}
+		dependsOnState = ep.DependsOn.state()
+	}
 	db := config.SC.DBC
 	q, err := db.Prepare(
-		"insert into collection_plan (plan_id, collection_id, rampup, concurrency, duration, engines, csv_split) values (?,?,?,?,?,?,?) on duplicate key update rampup=?, concurrency=?, duration=?, engines=?, csv_split=?")
+		"insert into collection_plan (plan_id, collection_id, rampup, concurrency, duration, engines, csv_split, rps, cpu, mem, heap, image, properties, start_delay, depends_on_plan_id, depends_on_state) values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) on duplicate key update rampup=?, concurrency=?, duration=?, engines=?, csv_split=?, rps=?, cpu=?, mem=?, heap=?, image=?, properties=?, start_delay=?, depends_on_plan_id=?, depends_on_state=?")
 	if err != nil {
 		return err
 	}
 	defer q.Close()
-	_, err = q.Exec(ep.PlanID, c.ID, ep.Rampup, ep.Concurrency, ep.Duration, ep.Engines, CSVSplitDB, ep.Rampup, ep.Concurrency,
-		ep.Duration, ep.Engines, CSVSplitDB)
+	_, err = q.Exec(ep.PlanID, c.ID, ep.Rampup, ep.Concurrency, ep.Duration, ep.Engines, CSVSplitDB, ep.RPS,
+		ep.CPU, ep.Mem, ep.Heap, ep.Image, properties, ep.StartDelay, dependsOnPlanID, dependsOnState,
+		ep.Rampup, ep.Concurrency, ep.Duration, ep.Engines, CSVSplitDB, ep.RPS,
+		ep.CPU, ep.Mem, ep.Heap, ep.Image, properties, ep.StartDelay, dependsOnPlanID, dependsOnState)
 	if err != nil {
 		return err
 	}
@@ -127,7 +144,7 @@ func (c *Collection) AddExecutionPlan(ep *ExecutionPlan) error {
 
 func (c *Collection) GetExecutionPlans() ([]*ExecutionPlan, error) {
 	db := config.SC.DBC
-	q, err := db.Prepare("select plan_id, rampup, concurrency, duration, engines, csv_split from collection_plan where collection_id=?")
+	q, err := db.Prepare("select plan_id, rampup, concurrency, duration, engines, csv_split, rps, cpu, mem, heap, image, properties, start_delay, depends_on_plan_id, depends_on_state from collection_plan where collection_id=?")
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +158,14 @@ func (c *Collection) GetExecutionPlans() ([]*ExecutionPlan, error) {
 	for rows.Next() {
 		ep := new(ExecutionPlan)
 		var CSVSplitDB int8
-		rows.Scan(&ep.PlanID, &ep.Rampup, &ep.Concurrency, &ep.Duration, &ep.Engines, &CSVSplitDB)
+		var properties sql.NullString
+		var dependsOnPlanID sql.NullInt64
+		var dependsOnState string
+		rows.Scan(&ep.PlanID, &ep.Rampup, &ep.Concurrency, &ep.Duration, &ep.Engines, &CSVSplitDB, &ep.RPS,
+			&ep.CPU, &ep.Mem, &ep.Heap, &ep.Image, &properties, &ep.StartDelay, &dependsOnPlanID, &dependsOnState)
 		ep.CSVSplit = CSVSplitDB == 1
+		ep.Properties = unmarshalProperties(properties)
+		ep.setDependency(dependsOnPlanID, dependsOnState)
 		r = append(r, ep)
 	}
 	err = rows.Err()
@@ -154,7 +177,7 @@ func (c *Collection) GetExecutionPlans() ([]*ExecutionPlan, error) {
 
 func GetExecutionPlan(collectionID, planID int64) (*ExecutionPlan, error) {
 	db := config.SC.DBC
-	q, err := db.Prepare("select plan_id, rampup, concurrency, duration, engines, csv_split from collection_plan where collection_id=? and plan_id=?")
+	q, err := db.Prepare("select plan_id, rampup, concurrency, duration, engines, csv_split, rps, cpu, mem, heap, image, properties, start_delay, depends_on_plan_id, depends_on_state from collection_plan where collection_id=? and plan_id=?")
 	if err != nil {
 		return nil, err
 	}
@@ -162,11 +185,17 @@ func GetExecutionPlan(collectionID, planID int64) (*ExecutionPlan, error) {
 
 	ep := new(ExecutionPlan)
 	var CSVSplitDB int8
-	err = q.QueryRow(collectionID, planID).Scan(&ep.PlanID, &ep.Rampup, &ep.Concurrency, &ep.Duration, &ep.Engines, &CSVSplitDB)
+	var properties sql.NullString
+	var dependsOnPlanID sql.NullInt64
+	var dependsOnState string
+	err = q.QueryRow(collectionID, planID).Scan(&ep.PlanID, &ep.Rampup, &ep.Concurrency, &ep.Duration, &ep.Engines, &CSVSplitDB, &ep.RPS,
+		&ep.CPU, &ep.Mem, &ep.Heap, &ep.Image, &properties, &ep.StartDelay, &dependsOnPlanID, &dependsOnState)
 	if err != nil {
 		return nil, err
 	}
 	ep.CSVSplit = CSVSplitDB == 1
+	ep.Properties = unmarshalProperties(properties)
+	ep.setDependency(dependsOnPlanID, dependsOnState)
 	return ep, nil
 }
 
@@ -202,6 +231,16 @@ func (c *Collection) DeleteExecutionPlans() error {
 
 func (c *Collection) DeleteRunHistory() error {
 	db := config.SC.DBC
+	for _, table := range []string{"collection_run_pause", "collection_run_forced_stop", "collection_run_file"} {
+		dq, err := db.Prepare(fmt.Sprintf("delete d from %s d join collection_run_history h on d.run_id = h.run_id where h.collection_id=?", table))
+		if err != nil {
+			return err
+		}
+		defer dq.Close()
+		if _, err = dq.Exec(c.ID); err != nil {
+			return err
+		}
+	}
 	q, err := db.Prepare("delete from collection_run_history where collection_id=?")
 	if err != nil {
 		return err
@@ -215,15 +254,19 @@ func (c *Collection) DeleteRunHistory() error {
 	return nil
 }
 
-func (c *Collection) updateCollectionCSVSplit(split bool) error {
+func (c *Collection) updateCollectionConfig(split bool, props map[string]string) error {
+	properties, err := marshalProperties(props)
+	if err != nil {
+		return err
+	}
 	db := config.SC.DBC
-	q, err := db.Prepare("update collection set csv_split=? where id=?")
+	q, err := db.Prepare("update collection set csv_split=?, properties=? where id=?")
 	if err != nil {
 		return err
 	}
 	defer q.Close()
 
-	_, err = q.Exec(split, c.ID)
+	_, err = q.Exec(split, properties, c.ID)
 	if err != nil {
 		return err
 	}
@@ -259,33 +302,60 @@ outer:
 			return err
 		}
 	}
-	err = c.updateCollectionCSVSplit(ec.CSVSplit)
+	err = c.updateCollectionConfig(ec.CSVSplit, ec.Properties)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Collection) MakeFileName(filename string) string {
-	return fmt.Sprintf("collection/%d/%s", c.ID, filename)
+func (c *Collection) MakeFileName(filename string, version int) string {
+	return makeVersionedFileName(CollectionFileKind, c.ID, filename, version)
+}
+
+// StoreFile uploads the file as a new version and makes the collection use it
+func (c *Collection) StoreFile(content io.ReadCloser, filename, uploader string) error {
+	fv, err := storeFileVersion(CollectionFileKind, c.ID, content, filename, uploader)
+	if err != nil {
+		return err
+	}
+	if IsJarFile(filename) {
+		if err := checkUploadedJar(CollectionFileKind, c.ID, c.ProjectID, fv); err != nil {
+			return err
+		}
+	}
+	return c.useFileVersion(filename, fv.Version)
 }
 
-func (c *Collection) StoreFile(content io.ReadCloser, filename string) error {
-	filenameForStorage := c.MakeFileName(filename)
+func (c *Collection) useFileVersion(filename string, version int) error {
 	db := config.SC.DBC
-	q, err := db.Prepare("insert into collection_data (collection_id, filename) values (?, ?)")
+	q, err := db.Prepare("insert into collection_data (collection_id, filename, version) values (?, ?, ?) on duplicate key update version=?")
 	if err != nil {
 		return err
 	}
 	defer q.Close()
-	_, err = q.Query(c.ID, filename)
-	if driverErr, ok := err.(*mysql.MySQLError); ok {
-		if driverErr.Number == 1062 {
-			return errors.New("File already exists. If you wish to update it then delete existing one and upload again.")
-		}
+	_, err = q.Exec(c.ID, filename, version, version)
+	return err
+}
+
+// RollbackFile makes the collection use an older version of the file
+func (c *Collection) RollbackFile(filename string, version int) error {
+	exists, err := fileVersionExists(CollectionFileKind, c.ID, filename, version)
+	if err != nil {
 		return err
 	}
-	return object_storage.Client.Storage.Upload(filenameForStorage, content)
+	if !exists {
+		return &DBError{Err: sql.ErrNoRows, Message: "file version not found"}
+	}
+	return c.useFileVersion(filename, version)
+}
+
+func (c *Collection) GetFileVersions(filename string) ([]*FileVersion, error) {
+	return getFileVersions(CollectionFileKind, c.ID, filename)
+}
+
+func (c *Collection) GetFilesInfo() ([]*FileInfo, error) {
+	return getFilesInfo(CollectionFileKind, c.ID, "collection_data", "collection_id", DataFileType)
 }
 
 func (c *Collection) DeleteFile(filename string) error {
@@ -296,15 +366,11 @@ func (c *Collection) DeleteFile(filename string) error {
 	}
 	defer q.Close()
 
-	_, err = q.Query(filename, c.ID)
+	_, err = q.Exec(filename, c.ID)
 	if err != nil {
 		return err
 	}
-	err = object_storage.Client.Storage.Delete(c.MakeFileName(filename))
-	if err != nil {
-		return err
-	}
-	return nil
+	return deleteFileVersions(CollectionFileKind, c.ID, filename)
 }
 
 func (c *Collection) DeleteAllFiles() error {
@@ -320,23 +386,17 @@ func (c *Collection) DeleteAllFiles() error {
 		return err
 	}
 
-	for _, f := range c.Data {
-		err = c.DeleteFile(f.Filename)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	return nil
+	return deleteAllFileVersions(CollectionFileKind, c.ID)
 }
 
 func (c *Collection) getCollectionFiles() ([]*ShibuyaFile, error) {
 	db := config.SC.DBC
-	q, err := db.Prepare("select filename from collection_data where collection_id=?")
+	q, err := db.Prepare("select d.filename, d.version, coalesce(v.checksum, ''), coalesce(v.row_count, 0), d.split, d.split_mode, d.keep_header from collection_data d left join file_version v on v.kind=? and v.owner_id=d.collection_id and v.filename=d.filename and v.version=d.version where d.collection_id=?")
 	if err != nil {
 		return nil, err
 	}
 	defer q.Close()
-	rows, err := q.Query(c.ID)
+	rows, err := q.Query(CollectionFileKind, c.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -344,8 +404,10 @@ func (c *Collection) getCollectionFiles() ([]*ShibuyaFile, error) {
 	r := []*ShibuyaFile{}
 	for rows.Next() {
 		f := new(ShibuyaFile)
-		rows.Scan(&f.Filename)
-		f.Filepath = c.MakeFileName(f.Filename)
+		var keepHeader int8
+		rows.Scan(&f.Filename, &f.Version, &f.Checksum, &f.Rows, &f.Split, &f.SplitMode, &keepHeader)
+		f.KeepHeader = keepHeader == 1
+		f.Filepath = c.MakeFileName(f.Filename, f.Version)
 		f.Filelink = object_storage.Client.Storage.GetUrl(f.Filepath)
 		r = append(r, f)
 	}
@@ -383,14 +445,30 @@ func (c *Collection) RunFinish(runID int64) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return closeRunPauses(runID)
 }
 
 type RunHistory struct {
-	ID           int64     `json:"id"`
-	CollectionID int64     `json:"collection_id"`
-	StartedTime  time.Time `json:"started_time"`
-	EndTime      time.Time `json:"end_time"`
+	ID             int64       `json:"id"`
+	CollectionID   int64       `json:"collection_id"`
+	StartedTime    time.Time   `json:"started_time"`
+	EndTime        time.Time   `json:"end_time"`
+	Pauses         []*RunPause `json:"pauses"`
+	PausedDuration float64     `json:"paused_duration"` // in seconds
+	// Engines which needed to be forced to stop the test
+	ForcedStops []*ForcedStop `json:"forced_stops"`
+	// Versions of the files the engines received
+	Files []*RunFile `json:"files"`
+}
+
+func (rh *RunHistory) loadDetails() error {
+	if err := rh.loadPauses(); err != nil {
+		return err
+	}
+	if err := rh.loadForcedStops(); err != nil {
+		return err
+	}
+	return rh.loadFiles()
 }
 
 func GetRun(runID int64) (*RunHistory, error) {
@@ -410,6 +488,9 @@ func GetRun(runID int64) (*RunHistory, error) {
 	if endTime.Valid {
 		r.EndTime = endTime.Time
 	}
+	if err := r.loadDetails(); err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
@@ -432,9 +513,40 @@ func (c *Collection) GetRuns() ([]*RunHistory, error) {
 		rs.Scan(&run.ID, &run.CollectionID, &run.StartedTime, &run.EndTime)
 		r = append(r, run)
 	}
+	if err := c.loadRunDetails(r); err != nil {
+		return r, err
+	}
 	return r, nil
 }
 
+// loadRunDetails loads the details of all the runs of the collection at once instead of querying per run
+func (c *Collection) loadRunDetails(runs []*RunHistory) error {
+	pauses, err := getCollectionRunPauses(c.ID)
+	if err != nil {
+		return err
+	}
+	forcedStops, err := getCollectionForcedStops(c.ID)
+	if err != nil {
+		return err
+	}
+	files, err := getCollectionRunFiles(c.ID)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		run.setPauses(pauses[run.ID])
+		run.ForcedStops = forcedStops[run.ID]
+		if run.ForcedStops == nil {
+			run.ForcedStops = []*ForcedStop{}
+		}
+		run.Files = files[run.ID]
+		if run.Files == nil {
+			run.Files = []*RunFile{}
+		}
+	}
+	return nil
+}
+
 func (c *Collection) StartRun() (int64, error) {
 	db := config.SC.DBC
 	q, err := db.Prepare("insert into collection_run (collection_id) values(?)")
@@ -529,6 +641,20 @@ func (c *Collection) HasRunningPlan() (bool, error) {
 	return false, nil
 }
 
+func (c *Collection) IsLaunched() (bool, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select count(1) from collection_launch where collection_id=?")
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	var count int
+	if err := q.QueryRow(c.ID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (c *Collection) NewLaunchEntry(owner, cxt string, enginesCount, machinesCount, vu int64) error {
 	db := config.SC.DBC
 	ct := context.TODO()
@@ -590,6 +716,19 @@ func (c *Collection) MarkUsageFinished(cxt string, vu int64) error {
 	return tx.Commit()
 }
 
+// UpdateNodesCount records the most nodes the launch has been running on. The nodes are only known
+// after the engines are scheduled so it cannot be set when the launch entry is created.
+func (c *Collection) UpdateNodesCount(nodesCount int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("update collection_launch_history2 set nodes_count=greatest(coalesce(nodes_count, 0), ?) where collection_id=? and end_time is null")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(nodesCount, c.ID)
+	return err
+}
+
 // Get the current launching collection by context. The context is different per controller
 func GetLaunchingCollectionByContext(cxt string) ([]int64, error) {
 	db := config.SC.DBC
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+const (
+	CSVSplitInherit = ""
+	CSVSplitAlways  = "always"
+	CSVSplitNever   = "never"
+
+	ContiguousSplitMode = "contiguous"
+	RoundRobinSplitMode = "round_robin"
+)
+
+// CSVSettings controls how a CSV file is distributed to the engines
+type CSVSettings struct {
+	Split      string `json:"split"`       // Overrides the csv_split of the collection or the plan. Empty to follow it
+	SplitMode  string `json:"split_mode"`  // contiguous when empty
+	KeepHeader bool   `json:"keep_header"` // The first row is a header and every split gets a copy of it
+}
+
+// ShouldSplit tells whether the file is split when the collection or the plan has csvSplit.
+// The override applies to both levels so a file with never is always sent whole.
+func (cs CSVSettings) ShouldSplit(csvSplit bool) bool {
+	switch cs.Split {
+	case CSVSplitAlways:
+		return true
+	case CSVSplitNever:
+		return false
+	}
+	return csvSplit
+}
+
+func (cs CSVSettings) Validate() error {
+	switch cs.Split {
+	case CSVSplitInherit, CSVSplitAlways, CSVSplitNever:
+	default:
+		return fmt.Errorf("split should be one of empty, %s and %s", CSVSplitAlways, CSVSplitNever)
+	}
+	switch cs.SplitMode {
+	case "", ContiguousSplitMode, RoundRobinSplitMode:
+	default:
+		return fmt.Errorf("split_mode should be one of %s and %s", ContiguousSplitMode, RoundRobinSplitMode)
+	}
+	return nil
+}
+
+func updateCSVSettings(table, idColumn string, id int64, filename string, cs CSVSettings) error {
+	if err := cs.Validate(); err != nil {
+		return err
+	}
+	var keepHeader int8
+	if cs.KeepHeader {
+		keepHeader = 1
+	}
+	db := config.SC.DBC
+	q, err := db.Prepare(fmt.Sprintf("update %s set split=?, split_mode=?, keep_header=? where %s=? and filename=?",
+		table, idColumn))
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	r, err := q.Exec(cs.Split, cs.SplitMode, keepHeader, id, filename)
+	if err != nil {
+		return err
+	}
+	// Affected rows are 0 when nothing changes so we need to check the file separately
+	if n, _ := r.RowsAffected(); n > 0 {
+		return nil
+	}
+	q2, err := db.Prepare(fmt.Sprintf("select 1 from %s where %s=? and filename=?", table, idColumn))
+	if err != nil {
+		return err
+	}
+	defer q2.Close()
+	var found int
+	err = q2.QueryRow(id, filename).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &DBError{Err: err, Message: "file not found"}
+	}
+	return err
+}
+
+func (p *Plan) UpdateFileCSVSettings(filename string, cs CSVSettings) error {
+	return updateCSVSettings("plan_data", "plan_id", p.ID, filename, cs)
+}
+
+func (c *Collection) UpdateFileCSVSettings(filename string, cs CSVSettings) error {
+	return updateCSVSettings("collection_data", "collection_id", c.ID, filename, cs)
+}
@@ -8,3 +8,14 @@ type DBError struct {
 func (e *DBError) Error() string {
 	return e.Message
 }
+
+// QuotaExceededError is returned when a launch would exceed the quota of the project or the owner group
+type QuotaExceededError struct {
+	Message string
+	// The quota can be available again when other launches finish
+	Retryable bool
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Message
+}
@@ -8,6 +8,19 @@ type ExecutionPlan struct {
 	Engines     int    `yaml:"engines" json:"engines"`
 	Duration    int    `yaml:"duration" json:"duration"`
 	CSVSplit    bool   `yaml:"csv_split" json:"csv_split"` // go-sql-driver does not support tinyint mapped to bool directly: https://github.com/go-sql-driver/mysql/issues/440
+	// Target requests per second of the whole plan. 0 means the plan is driven by concurrency only.
+	RPS int `yaml:"rps,omitempty" json:"rps"`
+	// Engine resources of the plan. Empty values fall back to the default engine config.
+	CPU   string `yaml:"cpu,omitempty" json:"cpu"`
+	Mem   string `yaml:"mem,omitempty" json:"mem"`
+	Heap  string `yaml:"heap,omitempty" json:"heap"`   // JVM heap size, e.g. 512m or 2g
+	Image string `yaml:"image,omitempty" json:"image"` // an image or the name of an engine image curated by the admins
+	// JMeter properties of the plan. They override the ones of the collection.
+	Properties map[string]string `yaml:"properties,omitempty" json:"properties"`
+	// Seconds the plan waits before it starts, counted from its dependency being met or from the trigger
+	StartDelay int `yaml:"start_delay,omitempty" json:"start_delay"`
+	// Another plan of the collection the plan waits for
+	DependsOn *PlanDependency `yaml:"depends_on,omitempty" json:"depends_on"`
 }
 
 type ExecutionCollection struct {
@@ -16,6 +29,8 @@ type ExecutionCollection struct {
 	CollectionID int64            `yaml:"collectionid"`
 	Tests        []*ExecutionPlan `yaml:"tests"`
 	CSVSplit     bool             `yaml:"csv_split"`
+	// JMeter properties shared by all the plans
+	Properties map[string]string `yaml:"properties,omitempty"`
 }
 
 type ExecutionWrapper struct {
@@ -0,0 +1,397 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/object_storage"
+	"github.com/rakutentech/shibuya/shibuya/utils"
+
+	mysql "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PlanFileKind       = "plan"
+	CollectionFileKind = "collection"
+)
+
+// FileVersion is one upload of a plan or collection file. Uploading a file with an existing name creates
+// a new version. The plan or collection uses the latest version unless it's rolled back to an older one.
+type FileVersion struct {
+	Filename    string    `json:"filename"`
+	Version     int       `json:"version"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"` // sha256 of the content
+	Uploader    string    `json:"uploader"`
+	CreatedTime time.Time `json:"created_time"`
+	Filelink    string    `json:"filelink"`
+	Rows        int64     `json:"rows"` // Rows of the CSV files. 0 for the other files
+}
+
+const (
+	TestFileType = "test"
+	DataFileType = "data"
+)
+
+// FileInfo is the version of a file the engines will receive
+type FileInfo struct {
+	*FileVersion
+	Type        string       `json:"type"`
+	CSVSettings *CSVSettings `json:"csv_settings,omitempty"` // Only for the data files
+}
+
+// makeVersionedFileName returns the path of the version in the object storage. Version 0 are the files
+// uploaded before versioning so they are kept in their original path.
+func makeVersionedFileName(kind string, id int64, filename string, version int) string {
+	if version == 0 {
+		return fmt.Sprintf("%s/%d/%s", kind, id, filename)
+	}
+	return fmt.Sprintf("%s/%d/v%d/%s", kind, id, version, filename)
+}
+
+type countingReader struct {
+	r    io.Reader
+	size int64
+	rows utils.CSVRowCounter
+	// The error of the content, e.g. the upload is too big, which the storage may not return as it is
+	err error
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.size += int64(n)
+	cr.rows.Write(p[:n])
+	if err != nil && err != io.EOF {
+		cr.err = err
+	}
+	return n, err
+}
+
+// reserveFileVersion adds the next version of the file before its content is uploaded. The versions of the file
+// are locked while the next one is picked so concurrent uploads of the same file get different versions.
+func reserveFileVersion(kind string, id int64, filename, uploader string) (int, error) {
+	db := config.SC.DBC
+	ct := context.TODO()
+	tx, err := db.BeginTx(ct, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var version int
+	err = tx.QueryRow("select coalesce(max(version), 0) + 1 from file_version where kind=? and owner_id=? and filename=? for update",
+		kind, id, filename).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("insert into file_version (kind, owner_id, filename, version, uploader, uploading) values (?, ?, ?, ?, ?, 1)",
+		kind, id, filename, version, uploader)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func cancelFileVersion(kind string, id int64, filename string, version int) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from file_version where kind=? and owner_id=? and filename=? and version=? and uploading=1")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(kind, id, filename, version)
+	return err
+}
+
+// storeFileVersion uploads the content as a new version of the file and returns the version.
+// Nothing is left in the object storage when the version cannot be reserved.
+func storeFileVersion(kind string, id int64, content io.ReadCloser, filename, uploader string) (*FileVersion, error) {
+	defer content.Close()
+	version, err := reserveFileVersion(kind, id, filename, uploader)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	cr := &countingReader{r: io.TeeReader(content, h)}
+	if err := object_storage.Client.Storage.Upload(makeVersionedFileName(kind, id, filename, version), io.NopCloser(cr)); err != nil {
+		// The version is free for the next upload, which overwrites what may have been uploaded
+		if cerr := cancelFileVersion(kind, id, filename, version); cerr != nil {
+			log.Error(cerr)
+		}
+		if cr.err != nil {
+			return nil, cr.err
+		}
+		return nil, err
+	}
+	fv := &FileVersion{
+		Filename: filename,
+		Version:  version,
+		Size:     cr.size,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+		Uploader: uploader,
+	}
+	var rows sql.NullInt64
+	if strings.HasSuffix(filename, ".csv") {
+		fv.Rows = cr.rows.Rows()
+		rows = sql.NullInt64{Int64: fv.Rows, Valid: true}
+	}
+	db := config.SC.DBC
+	q, err := db.Prepare("update file_version set size=?, checksum=?, row_count=?, uploading=0 where kind=? and owner_id=? and filename=? and version=?")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	if _, err := q.Exec(fv.Size, fv.Checksum, rows, kind, id, filename, version); err != nil {
+		return nil, err
+	}
+	return fv, nil
+}
+
+func getFileVersions(kind string, id int64, filename string) ([]*FileVersion, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select filename, version, size, checksum, uploader, created_time, coalesce(row_count, 0) from file_version where kind=? and owner_id=? and filename=? and uploading=0 order by version desc")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(kind, id, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*FileVersion{}
+	for rs.Next() {
+		fv := new(FileVersion)
+		rs.Scan(&fv.Filename, &fv.Version, &fv.Size, &fv.Checksum, &fv.Uploader, &fv.CreatedTime, &fv.Rows)
+		fv.Filelink = object_storage.Client.Storage.GetUrl(makeVersionedFileName(kind, id, fv.Filename, fv.Version))
+		r = append(r, fv)
+	}
+	return r, rs.Err()
+}
+
+// getFilesInfo returns the versions in use of the files in the table
+func getFilesInfo(kind string, id int64, table, idColumn, fileType string) ([]*FileInfo, error) {
+	db := config.SC.DBC
+	// Test files have no csv settings
+	settingsColumns := "'', '', 0"
+	if fileType == DataFileType {
+		settingsColumns = "d.split, d.split_mode, d.keep_header"
+	}
+	q, err := db.Prepare(fmt.Sprintf("select d.filename, d.version, coalesce(v.size, 0), coalesce(v.checksum, ''), coalesce(v.uploader, ''), v.created_time, coalesce(v.row_count, 0), %s from %s d left join file_version v on v.kind=? and v.owner_id=d.%s and v.filename=d.filename and v.version=d.version where d.%s=? order by d.filename",
+		settingsColumns, table, idColumn, idColumn))
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*FileInfo{}
+	for rs.Next() {
+		fv := new(FileVersion)
+		cs := new(CSVSettings)
+		var createdTime mysql.NullTime
+		var keepHeader int8
+		rs.Scan(&fv.Filename, &fv.Version, &fv.Size, &fv.Checksum, &fv.Uploader, &createdTime, &fv.Rows,
+			&cs.Split, &cs.SplitMode, &keepHeader)
+		cs.KeepHeader = keepHeader == 1
+		fv.CreatedTime = createdTime.Time
+		fv.Filelink = object_storage.Client.Storage.GetUrl(makeVersionedFileName(kind, id, fv.Filename, fv.Version))
+		fi := &FileInfo{FileVersion: fv, Type: fileType}
+		if fileType == DataFileType {
+			fi.CSVSettings = cs
+		}
+		r = append(r, fi)
+	}
+	return r, rs.Err()
+}
+
+func fileVersionExists(kind string, id int64, filename string, version int) (bool, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select 1 from file_version where kind=? and owner_id=? and filename=? and version=? and uploading=0")
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	var found int
+	err = q.QueryRow(kind, id, filename, version).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isFileVersionRecorded tells whether a run received the version. Those versions are kept so the runs can be
+// reproduced. Collection files are recorded with plan 0.
+func isFileVersionRecorded(kind string, id int64, filename string, version int) (bool, error) {
+	query := "select count(1) from collection_run_file where plan_id=? and filename=? and version=?"
+	args := []interface{}{id, filename, version}
+	if kind == CollectionFileKind {
+		query = `select count(1) from collection_run_file f join collection_run_history h on f.run_id=h.run_id
+where h.collection_id=? and f.plan_id=0 and f.filename=? and f.version=?`
+	}
+	db := config.SC.DBC
+	q, err := db.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	var count int
+	if err := q.QueryRow(args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// deleteFileVersions removes the versions of the file, except the ones recorded by the runs. Their rows are
+// kept too so a new upload of the file does not reuse their versions.
+func deleteFileVersions(kind string, id int64, filename string) error {
+	versions, err := getFileVersions(kind, id, filename)
+	if err != nil {
+		return err
+	}
+	for _, fv := range versions {
+		recorded, err := isFileVersionRecorded(kind, id, filename, fv.Version)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			continue
+		}
+		if err := discardFileVersion(kind, id, filename, fv.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardFileVersion removes a version which is not used by the plan or the collection
+func discardFileVersion(kind string, id int64, filename string, version int) error {
+	if err := object_storage.Client.Storage.Delete(makeVersionedFileName(kind, id, filename, version)); err != nil {
+		return err
+	}
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from file_version where kind=? and owner_id=? and filename=? and version=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(kind, id, filename, version)
+	return err
+}
+
+// deleteAllFileVersions removes the versions of all the files including the ones no longer in use
+func deleteAllFileVersions(kind string, id int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("select distinct filename from file_version where kind=? and owner_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	rs, err := q.Query(kind, id)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	filenames := []string{}
+	for rs.Next() {
+		var filename string
+		rs.Scan(&filename)
+		filenames = append(filenames, filename)
+	}
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if err := deleteFileVersions(kind, id, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunFile is a file the engines received in a run
+type RunFile struct {
+	PlanID   int64  `json:"plan_id"` // 0 for the collection files
+	Filename string `json:"filename"`
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+func AddRunFiles(runID, planID int64, files []*ShibuyaFile) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into collection_run_file (run_id, plan_id, filename, version, checksum) values (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	for _, f := range files {
+		if _, err := q.Exec(runID, planID, f.Filename, f.Version, f.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetRunFiles(runID int64) ([]*RunFile, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select plan_id, filename, version, checksum from collection_run_file where run_id=? order by plan_id, filename")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*RunFile{}
+	for rs.Next() {
+		rf := new(RunFile)
+		rs.Scan(&rf.PlanID, &rf.Filename, &rf.Version, &rf.Checksum)
+		r = append(r, rf)
+	}
+	return r, rs.Err()
+}
+
+// getCollectionRunFiles returns the files of all the runs of the collection by run
+func getCollectionRunFiles(collectionID int64) (map[int64][]*RunFile, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select f.run_id, f.plan_id, f.filename, f.version, f.checksum from collection_run_file f join collection_run_history h on h.run_id=f.run_id where h.collection_id=? order by f.plan_id, f.filename")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := make(map[int64][]*RunFile)
+	for rs.Next() {
+		var runID int64
+		rf := new(RunFile)
+		rs.Scan(&runID, &rf.PlanID, &rf.Filename, &rf.Version, &rf.Checksum)
+		r[runID] = append(r[runID], rf)
+	}
+	return r, rs.Err()
+}
+
+func (rh *RunHistory) loadFiles() error {
+	files, err := GetRunFiles(rh.ID)
+	if err != nil {
+		return err
+	}
+	rh.Files = files
+	return nil
+}
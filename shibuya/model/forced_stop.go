@@ -0,0 +1,79 @@
+package model
+
+import (
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+// ForcedStop is an engine which did not stop the test within the graceful timeout
+type ForcedStop struct {
+	PlanID      int64     `json:"plan_id"`
+	EngineID    int       `json:"engine_id"`
+	StoppedBy   string    `json:"stopped_by"`
+	StoppedTime time.Time `json:"stopped_time"`
+}
+
+func AddForcedStop(runID, planID int64, engineID int, stoppedBy string) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into collection_run_forced_stop (run_id, plan_id, engine_id, stopped_by) values (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(runID, planID, engineID, stoppedBy)
+	return err
+}
+
+func GetForcedStops(runID int64) ([]*ForcedStop, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select plan_id, engine_id, stopped_by, stopped_time from collection_run_forced_stop where run_id=? order by plan_id, engine_id")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*ForcedStop{}
+	for rs.Next() {
+		fs := new(ForcedStop)
+		rs.Scan(&fs.PlanID, &fs.EngineID, &fs.StoppedBy, &fs.StoppedTime)
+		r = append(r, fs)
+	}
+	return r, rs.Err()
+}
+
+// getCollectionForcedStops returns the forced stops of all the runs of the collection by run
+func getCollectionForcedStops(collectionID int64) (map[int64][]*ForcedStop, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select f.run_id, f.plan_id, f.engine_id, f.stopped_by, f.stopped_time from collection_run_forced_stop f join collection_run_history h on h.run_id=f.run_id where h.collection_id=? order by f.plan_id, f.engine_id")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := make(map[int64][]*ForcedStop)
+	for rs.Next() {
+		var runID int64
+		fs := new(ForcedStop)
+		rs.Scan(&runID, &fs.PlanID, &fs.EngineID, &fs.StoppedBy, &fs.StoppedTime)
+		r[runID] = append(r[runID], fs)
+	}
+	return r, rs.Err()
+}
+
+func (rh *RunHistory) loadForcedStops() error {
+	forcedStops, err := GetForcedStops(rh.ID)
+	if err != nil {
+		return err
+	}
+	rh.ForcedStops = forcedStops
+	return nil
+}
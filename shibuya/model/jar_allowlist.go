@@ -0,0 +1,125 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+// AllowedJar is a jar the admins allowed to be uploaded to the plans and collections of a project.
+// Jars are matched by their sha256 so a different build of the same library needs to be allowed again.
+type AllowedJar struct {
+	ProjectID   int64     `json:"project_id"`
+	Checksum    string    `json:"checksum"`
+	Name        string    `json:"name"`
+	AddedBy     string    `json:"added_by"`
+	CreatedTime time.Time `json:"created_time"`
+}
+
+type JarNotAllowedError struct {
+	Filename string
+	Checksum string
+}
+
+func (e *JarNotAllowedError) Error() string {
+	return fmt.Sprintf("%s (sha256 %s) is not allowed in this project. Please ask the admins to allow it", e.Filename, e.Checksum)
+}
+
+func IsJarFile(filename string) bool {
+	return strings.HasSuffix(filename, ".jar")
+}
+
+func GetAllowedJars(projectID int64) ([]*AllowedJar, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select project_id, checksum, name, added_by, created_time from project_jar_allowlist where project_id=? order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*AllowedJar{}
+	for rs.Next() {
+		aj := new(AllowedJar)
+		rs.Scan(&aj.ProjectID, &aj.Checksum, &aj.Name, &aj.AddedBy, &aj.CreatedTime)
+		r = append(r, aj)
+	}
+	return r, rs.Err()
+}
+
+func AllowJar(aj *AllowedJar) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into project_jar_allowlist (project_id, checksum, name, added_by) values (?, ?, ?, ?) on duplicate key update name=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(aj.ProjectID, aj.Checksum, aj.Name, aj.AddedBy, aj.Name)
+	return err
+}
+
+func DisallowJar(projectID int64, checksum string) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from project_jar_allowlist where project_id=? and checksum=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(projectID, checksum)
+	return err
+}
+
+func isJarAllowed(projectID int64, checksum string) (bool, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select 1 from project_jar_allowlist where project_id=? and checksum=?")
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	var found int
+	err = q.QueryRow(projectID, checksum).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkUploadedJar removes the version just uploaded when the jar is not allowed in the project
+func checkUploadedJar(kind string, id, projectID int64, fv *FileVersion) error {
+	allowed, err := isJarAllowed(projectID, fv.Checksum)
+	if err != nil {
+		return err
+	}
+	if allowed {
+		return nil
+	}
+	if err := discardFileVersion(kind, id, fv.Filename, fv.Version); err != nil {
+		return err
+	}
+	return &JarNotAllowedError{Filename: fv.Filename, Checksum: fv.Checksum}
+}
+
+// CheckJars makes sure the jars are still allowed when the test is started as the admins can
+// remove them from the allow-list after they are uploaded
+func CheckJars(projectID int64, files []*ShibuyaFile) error {
+	for _, f := range files {
+		if !IsJarFile(f.Filename) {
+			continue
+		}
+		allowed, err := isJarAllowed(projectID, f.Checksum)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &JarNotAllowedError{Filename: f.Filename, Checksum: f.Checksum}
+		}
+	}
+	return nil
+}
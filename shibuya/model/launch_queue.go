@@ -0,0 +1,126 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+// QueuedLaunch is a collection waiting for the cluster capacity or the quotas to be launched.
+// Position starts from 1 and launches are admitted in the order they are queued.
+type QueuedLaunch struct {
+	CollectionID int64     `json:"collection_id"`
+	Requester    string    `json:"requester"`
+	Reason       string    `json:"reason"`
+	Position     int       `json:"position"`
+	QueuedTime   time.Time `json:"queued_time"`
+}
+
+// EnqueueLaunch does nothing if the collection is already in the queue
+func EnqueueLaunch(collectionID int64, cxt, requester, reason string) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert ignore into collection_launch_queue (collection_id, context, requester, reason) values (?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(collectionID, cxt, requester, reason)
+	return err
+}
+
+func DequeueLaunch(collectionID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from collection_launch_queue where collection_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(collectionID)
+	return err
+}
+
+func GetLaunchQueue(cxt string) ([]*QueuedLaunch, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select collection_id, requester, reason, queued_time from collection_launch_queue where context=? order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(cxt)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*QueuedLaunch{}
+	for rs.Next() {
+		ql := new(QueuedLaunch)
+		if err := rs.Scan(&ql.CollectionID, &ql.Requester, &ql.Reason, &ql.QueuedTime); err != nil {
+			return nil, err
+		}
+		ql.Position = len(r) + 1
+		r = append(r, ql)
+	}
+	return r, rs.Err()
+}
+
+// GetQueuedLaunch returns nil if the collection is not in the queue
+func GetQueuedLaunch(collectionID int64, cxt string) (*QueuedLaunch, error) {
+	queue, err := GetLaunchQueue(cxt)
+	if err != nil {
+		return nil, err
+	}
+	for _, ql := range queue {
+		if ql.CollectionID == collectionID {
+			return ql, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetLaunchingEnginesCount returns the number of engines of all the collections being launched in the context
+func GetLaunchingEnginesCount(cxt string) (int64, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select coalesce(sum(engines_count), 0) from collection_launch_history2 where context=? and end_time is null")
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+	var count int64
+	if err := q.QueryRow(cxt).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+const launchLockTimeout = 30 // seconds
+
+var ErrLaunchLockTimeout = errors.New("Timed out waiting for the other launches, please try again")
+
+// WithLaunchLock runs f while holding the launch lock of the context, so checking whether a launch is admitted
+// and recording it cannot interleave with other launches, including the ones from the other replicas.
+func WithLaunchLock(cxt string, f func() error) error {
+	db := config.SC.DBC
+	ct := context.TODO()
+	conn, err := db.Conn(ct)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The lock belongs to the DB session so the same connection has to release it
+	name := "shibuya-launch-" + cxt
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ct, "select get_lock(?, ?)", name, launchLockTimeout).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return ErrLaunchLockTimeout
+	}
+	defer func() {
+		var released sql.NullInt64
+		conn.QueryRowContext(ct, "select release_lock(?)", name).Scan(&released)
+	}()
+	return f()
+}
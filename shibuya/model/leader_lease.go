@@ -0,0 +1,31 @@
+package model
+
+import (
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+// AcquireLease takes the lease for the holder when it's free or expired, and renews it when the holder
+// already has it. It returns whether the holder has the lease. The times are compared in the DB so the
+// clocks of the replicas do not matter.
+func AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	db := config.SC.DBC
+	// holder is assigned first so renewed_time is updated when the lease is taken over too
+	q, err := db.Prepare(`insert into leader_lease (name, holder, renewed_time) values (?, ?, current_timestamp)
+on duplicate key update
+holder = if(holder = values(holder) or renewed_time < current_timestamp - interval ? second, values(holder), holder),
+renewed_time = if(holder = values(holder), current_timestamp, renewed_time)`)
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	if _, err := q.Exec(name, holder, int(ttl.Seconds())); err != nil {
+		return false, err
+	}
+	var current string
+	if err := db.QueryRow("select holder from leader_lease where name=?", name).Scan(&current); err != nil {
+		return false, err
+	}
+	return current == holder, nil
+}
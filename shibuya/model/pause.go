@@ -0,0 +1,223 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+// RunPause is an interval of a run while the sampling of all the engines was suspended.
+// ResumedTime is zero when the run is still paused.
+type RunPause struct {
+	PausedTime  time.Time `json:"paused_time"`
+	ResumedTime time.Time `json:"resumed_time"`
+}
+
+func PauseRun(runID int64) error {
+	db := config.SC.DBC
+	ct := context.TODO()
+	tx, err := db.BeginTx(ct, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRow("select count(1) from collection_run_pause where run_id=? and resumed_time is null for update",
+		runID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return &DBError{Message: "The run is already paused"}
+	}
+	if _, err = tx.Exec("insert into collection_run_pause (run_id) values (?)", runID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// shiftPendingPlans moves the start time of the plans waiting for it by the seconds, so the start delays
+// of the plans do not elapse while the run is paused
+func shiftPendingPlans(tx *sql.Tx, runID int64, seconds int64) error {
+	_, err := tx.Exec("update pending_plan set start_time=date_add(start_time, interval ? second) where run_id=? and start_time is not null and starting=0",
+		seconds, runID)
+	return err
+}
+
+func ResumeRun(runID int64) error {
+	db := config.SC.DBC
+	ct := context.TODO()
+	tx, err := db.BeginTx(ct, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var pausedSeconds int64
+	err = tx.QueryRow("select timestampdiff(second, paused_time, NOW()) from collection_run_pause where run_id=? and resumed_time is null for update",
+		runID).Scan(&pausedSeconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &DBError{Message: "The run is not paused"}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("update collection_run_pause set resumed_time=NOW() where run_id=? and resumed_time is null", runID); err != nil {
+		return err
+	}
+	if err := shiftPendingPlans(tx, runID, pausedSeconds); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelRunPause removes the pause which has just been recorded when the engines could not be paused
+func CancelRunPause(runID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from collection_run_pause where run_id=? and resumed_time is null")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(runID)
+	return err
+}
+
+// CancelRunResume reopens the last pause when the engines could not be resumed. The pending plans are
+// shifted back as they are shifted again by the next resume.
+func CancelRunResume(runID int64) error {
+	db := config.SC.DBC
+	ct := context.TODO()
+	tx, err := db.BeginTx(ct, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var pausedSeconds int64
+	err = tx.QueryRow("select timestampdiff(second, paused_time, resumed_time) from collection_run_pause where run_id=? order by paused_time desc limit 1 for update",
+		runID).Scan(&pausedSeconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("update collection_run_pause set resumed_time=null where run_id=? order by paused_time desc limit 1", runID); err != nil {
+		return err
+	}
+	if err := shiftPendingPlans(tx, runID, -pausedSeconds); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func IsRunPaused(runID int64) (bool, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select count(1) from collection_run_pause where run_id=? and resumed_time is null")
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	var count int
+	if err := q.QueryRow(runID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// When a run finishes while being paused, the pause ends together with the run
+func closeRunPauses(runID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("update collection_run_pause set resumed_time=NOW() where run_id=? and resumed_time is null")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(runID)
+	return err
+}
+
+func GetRunPauses(runID int64) ([]*RunPause, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select paused_time, resumed_time from collection_run_pause where run_id=? order by paused_time")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*RunPause{}
+	for rs.Next() {
+		p := new(RunPause)
+		var resumedTime mysql.NullTime
+		rs.Scan(&p.PausedTime, &resumedTime)
+		if resumedTime.Valid {
+			p.ResumedTime = resumedTime.Time
+		}
+		r = append(r, p)
+	}
+	return r, rs.Err()
+}
+
+// getCollectionRunPauses returns the pauses of all the runs of the collection by run
+func getCollectionRunPauses(collectionID int64) (map[int64][]*RunPause, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select p.run_id, p.paused_time, p.resumed_time from collection_run_pause p join collection_run_history h on h.run_id=p.run_id where h.collection_id=? order by p.paused_time")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := make(map[int64][]*RunPause)
+	for rs.Next() {
+		var runID int64
+		p := new(RunPause)
+		var resumedTime mysql.NullTime
+		rs.Scan(&runID, &p.PausedTime, &resumedTime)
+		if resumedTime.Valid {
+			p.ResumedTime = resumedTime.Time
+		}
+		r[runID] = append(r[runID], p)
+	}
+	return r, rs.Err()
+}
+
+func (rh *RunHistory) loadPauses() error {
+	pauses, err := GetRunPauses(rh.ID)
+	if err != nil {
+		return err
+	}
+	rh.setPauses(pauses)
+	return nil
+}
+
+// Paused duration is excluded from the run so the duration and throughput of the run are
+// calculated only from the time the engines were sampling.
+func (rh *RunHistory) setPauses(pauses []*RunPause) {
+	if pauses == nil {
+		pauses = []*RunPause{}
+	}
+	rh.Pauses = pauses
+	rh.PausedDuration = 0
+	for _, p := range pauses {
+		end := p.ResumedTime
+		if end.IsZero() {
+			end = time.Now()
+			if !rh.EndTime.IsZero() {
+				end = rh.EndTime
+			}
+		}
+		rh.PausedDuration += end.Sub(p.PausedTime).Seconds()
+	}
+}
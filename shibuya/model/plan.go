@@ -1,16 +1,15 @@
 package model
 
 import (
-	"errors"
+	"database/sql"
 	"fmt"
 	"io"
 	"strings"
 	"time"
 
-	mysql "github.com/go-sql-driver/mysql"
 	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/rakutentech/shibuya/shibuya/engines/jmx"
 	"github.com/rakutentech/shibuya/shibuya/object_storage"
-	log "github.com/sirupsen/logrus"
 )
 
 type Plan struct {
@@ -59,12 +58,12 @@ func GetPlan(ID int64) (*Plan, error) {
 
 func (p *Plan) GetPlanFiles() (*ShibuyaFile, []*ShibuyaFile, error) {
 	db := config.SC.DBC
-	q, err := db.Prepare("select filename from plan_data where plan_id=?")
+	q, err := db.Prepare("select d.filename, d.version, coalesce(v.checksum, ''), coalesce(v.row_count, 0), d.split, d.split_mode, d.keep_header from plan_data d left join file_version v on v.kind=? and v.owner_id=d.plan_id and v.filename=d.filename and v.version=d.version where d.plan_id=?")
 	if err != nil {
 		return nil, nil, err
 	}
 	defer q.Close()
-	rows, err := q.Query(p.ID)
+	rows, err := q.Query(PlanFileKind, p.ID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -72,8 +71,10 @@ func (p *Plan) GetPlanFiles() (*ShibuyaFile, []*ShibuyaFile, error) {
 	r := []*ShibuyaFile{}
 	for rows.Next() {
 		f := new(ShibuyaFile)
-		rows.Scan(&f.Filename)
-		f.Filepath = p.MakeFileName(f.Filename)
+		var keepHeader int8
+		rows.Scan(&f.Filename, &f.Version, &f.Checksum, &f.Rows, &f.Split, &f.SplitMode, &keepHeader)
+		f.KeepHeader = keepHeader == 1
+		f.Filepath = p.MakeFileName(f.Filename, f.Version)
 		f.Filelink = object_storage.Client.Storage.GetUrl(f.Filepath)
 		r = append(r, f)
 	}
@@ -81,17 +82,17 @@ func (p *Plan) GetPlanFiles() (*ShibuyaFile, []*ShibuyaFile, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	q2, err := db.Prepare("select filename from plan_test_file where plan_id=?")
+	q2, err := db.Prepare("select t.filename, t.version, coalesce(v.checksum, '') from plan_test_file t left join file_version v on v.kind=? and v.owner_id=t.plan_id and v.filename=t.filename and v.version=t.version where t.plan_id=?")
 	if err != nil {
 		return nil, nil, err
 	}
 	defer q2.Close()
 	t := new(ShibuyaFile)
-	err = q2.QueryRow(p.ID).Scan(&t.Filename)
+	err = q2.QueryRow(PlanFileKind, p.ID).Scan(&t.Filename, &t.Version, &t.Checksum)
 	if err != nil {
 		return nil, r, err
 	}
-	t.Filepath = p.MakeFileName(t.Filename)
+	t.Filepath = p.MakeFileName(t.Filename, t.Version)
 	t.Filelink = object_storage.Client.Storage.GetUrl(t.Filepath)
 	return t, r, nil
 }
@@ -113,53 +114,148 @@ func (p *Plan) Delete() error {
 	return nil
 }
 
-func (p *Plan) MakeFileName(filename string) string {
-	return fmt.Sprintf("plan/%d/%s", p.ID, filename)
+func (p *Plan) MakeFileName(filename string, version int) string {
+	return makeVersionedFileName(PlanFileKind, p.ID, filename, version)
 }
 
-func (p *Plan) StoreFile(content io.ReadCloser, filename string) error {
-	filenameForStorage := p.MakeFileName(filename)
-	table := "plan_data"
+func planFileTable(filename string) string {
 	if strings.HasSuffix(filename, ".jmx") {
-		table = "plan_test_file"
+		return "plan_test_file"
 	}
+	return "plan_data"
+}
+
+// StoreFile uploads the file as a new version and makes the plan use it. A plan has only one test file
+// so uploading a test file with another name replaces the current one.
+func (p *Plan) StoreFile(content io.ReadCloser, filename, uploader string) error {
+	fv, err := storeFileVersion(PlanFileKind, p.ID, content, filename, uploader)
+	if err != nil {
+		return err
+	}
+	if IsJarFile(filename) {
+		if err := checkUploadedJar(PlanFileKind, p.ID, p.ProjectID, fv); err != nil {
+			return err
+		}
+	}
+	return p.useFileVersion(filename, fv.Version)
+}
+
+func (p *Plan) useFileVersion(filename string, version int) error {
 	db := config.SC.DBC
-	q, err := db.Prepare(fmt.Sprintf("insert into %s (plan_id, filename) values (?, ?)", table))
+	q, err := db.Prepare(fmt.Sprintf("insert into %s (plan_id, filename, version) values (?, ?, ?) on duplicate key update filename=?, version=?",
+		planFileTable(filename)))
 	if err != nil {
 		return err
 	}
 	defer q.Close()
-	_, err = q.Exec(p.ID, filename)
-	if driverErr, ok := err.(*mysql.MySQLError); ok {
-		if driverErr.Number == 1062 {
-			return errors.New("File already exists. If you wish to update it then delete existing one and upload again.")
-		}
+	_, err = q.Exec(p.ID, filename, version, filename, version)
+	return err
+}
+
+// RollbackFile makes the plan use an older version of the file
+func (p *Plan) RollbackFile(filename string, version int) error {
+	exists, err := fileVersionExists(PlanFileKind, p.ID, filename, version)
+	if err != nil {
 		return err
 	}
-	return object_storage.Client.Storage.Upload(filenameForStorage, content)
+	if !exists {
+		return &DBError{Err: sql.ErrNoRows, Message: "file version not found"}
+	}
+	return p.useFileVersion(filename, version)
 }
 
-func (p *Plan) DeleteFile(filename string) error {
-	table := "plan_data"
-	if strings.HasSuffix(filename, ".jmx") {
-		table = "plan_test_file"
+func (p *Plan) GetFileVersions(filename string) ([]*FileVersion, error) {
+	return getFileVersions(PlanFileKind, p.ID, filename)
+}
+
+// GetFilesInfo returns the test file followed by the data files of the plan
+func (p *Plan) GetFilesInfo() ([]*FileInfo, error) {
+	testFiles, err := getFilesInfo(PlanFileKind, p.ID, "plan_test_file", "plan_id", TestFileType)
+	if err != nil {
+		return nil, err
 	}
+	data, err := getFilesInfo(PlanFileKind, p.ID, "plan_data", "plan_id", DataFileType)
+	if err != nil {
+		return nil, err
+	}
+	return append(testFiles, data...), nil
+}
+
+// getDataFilenames returns the names of the data files uploaded to the plan and the collections using it
+func (p *Plan) getDataFilenames() ([]string, error) {
 	db := config.SC.DBC
-	q, err := db.Prepare(fmt.Sprintf("delete from %s where filename=? and plan_id=?", table))
+	q, err := db.Prepare("select filename from plan_data where plan_id=? union select d.filename from collection_data d join collection_plan cp on d.collection_id = cp.collection_id where cp.plan_id=?")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer q.Close()
+	rs, err := q.Query(p.ID, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []string{}
+	for rs.Next() {
+		var filename string
+		rs.Scan(&filename)
+		r = append(r, filename)
+	}
+	return r, rs.Err()
+}
 
-	_, err = q.Exec(filename, p.ID)
+// ValidateTestFile checks the test plan against the data files the engines will receive and the plugins
+// installed in each of the engine images it runs on
+func (p *Plan) ValidateTestFile(content []byte) ([]*jmx.Issue, error) {
+	dataFiles, err := p.getDataFilenames()
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := p.getPlugins()
+	if err != nil {
+		return nil, err
+	}
+	return jmx.Validate(content, dataFiles, plugins)
+}
+
+// getPlugins returns the plugins of the default engine image and the curated images picked by the collections
+// using the plan, by the image name. Plugins of the other images are not known so they are not checked.
+func (p *Plan) getPlugins() (map[string][]string, error) {
+	jc := config.SC.ExecutorConfig.JmeterContainer
+	plugins := map[string][]string{jmx.DefaultImage: jc.Plugins}
+	db := config.SC.DBC
+	q, err := db.Prepare("select distinct image from collection_plan where plan_id=? and image != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var image string
+		rs.Scan(&image)
+		if ei := jc.FindImage(image); ei != nil {
+			plugins[ei.Name] = ei.Plugins
+		}
+	}
+	return plugins, rs.Err()
+}
+
+func (p *Plan) DeleteFile(filename string) error {
+	db := config.SC.DBC
+	q, err := db.Prepare(fmt.Sprintf("delete from %s where filename=? and plan_id=?", planFileTable(filename)))
 	if err != nil {
 		return err
 	}
-	err = object_storage.Client.Storage.Delete(p.MakeFileName(filename))
+	defer q.Close()
+
+	_, err = q.Exec(filename, p.ID)
 	if err != nil {
 		return err
 	}
-	return nil
+	return deleteFileVersions(PlanFileKind, p.ID, filename)
 }
 
 func (p *Plan) DeleteAllFiles() error {
@@ -175,13 +271,7 @@ func (p *Plan) DeleteAllFiles() error {
 		return err
 	}
 
-	for _, f := range p.Data {
-		err = p.DeleteFile(f.Filename)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	return nil
+	return deleteAllFileVersions(PlanFileKind, p.ID)
 }
 
 func (p *Plan) IsBeingUsed() (bool, error) {
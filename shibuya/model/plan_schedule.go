@@ -0,0 +1,272 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+)
+
+// States of a plan another plan can wait for
+const (
+	PlanStarted  = "started"
+	PlanRampedUp = "ramped_up"
+	PlanFinished = "finished"
+)
+
+var planStates = []string{PlanStarted, PlanRampedUp, PlanFinished}
+
+// PlanDependency makes a plan wait for another plan of the collection to reach the state, e.g. a warm up
+// plan to be finished. The state is finished when it's empty.
+type PlanDependency struct {
+	PlanID int64  `yaml:"testid" json:"plan_id"`
+	State  string `yaml:"state,omitempty" json:"state"`
+}
+
+func (pd *PlanDependency) state() string {
+	if pd.State == "" {
+		return PlanFinished
+	}
+	return pd.State
+}
+
+func (ep *ExecutionPlan) setDependency(planID sql.NullInt64, state string) {
+	if planID.Valid {
+		ep.DependsOn = &PlanDependency{PlanID: planID.Int64, State: state}
+	}
+}
+
+// IsDeferred tells whether the plan does not start together with the collection
+func (ep *ExecutionPlan) IsDeferred() bool {
+	return ep.StartDelay > 0 || ep.DependsOn != nil
+}
+
+// ValidatePlanSchedule checks the plans only depend on the plans of the same collection, and without a cycle,
+// as they would never start otherwise.
+func ValidatePlanSchedule(eps []*ExecutionPlan) error {
+	plans := make(map[int64]*ExecutionPlan)
+	for _, ep := range eps {
+		plans[ep.PlanID] = ep
+	}
+	for _, ep := range eps {
+		if ep.StartDelay < 0 {
+			return fmt.Errorf("start_delay of plan %d cannot be negative", ep.PlanID)
+		}
+		if ep.DependsOn == nil {
+			continue
+		}
+		if !contains(planStates, ep.DependsOn.state()) {
+			return fmt.Errorf("Plan %d depends on an unknown state %s. States are %v", ep.PlanID, ep.DependsOn.State, planStates)
+		}
+		if _, ok := plans[ep.DependsOn.PlanID]; !ok {
+			return fmt.Errorf("Plan %d depends on plan %d which is not in the collection", ep.PlanID, ep.DependsOn.PlanID)
+		}
+	}
+	// Every dependency exists now so the chains can be walked safely
+	for _, ep := range eps {
+		visited := map[int64]bool{ep.PlanID: true}
+		for d := ep.DependsOn; d != nil; d = plans[d.PlanID].DependsOn {
+			if visited[d.PlanID] {
+				return fmt.Errorf("Plan %d has a circular dependency", ep.PlanID)
+			}
+			visited[d.PlanID] = true
+		}
+	}
+	return nil
+}
+
+// launchDuration is how long it takes for all the plans to finish. Deferred plans start start_delay seconds
+// after the plan they depend on reaches the state, so the launch lasts as long as the longest chain of plans.
+func launchDuration(eps []*ExecutionPlan) time.Duration {
+	plans := make(map[int64]*ExecutionPlan)
+	for _, ep := range eps {
+		plans[ep.PlanID] = ep
+	}
+	startTimes := make(map[int64]time.Duration)
+	var startTime func(ep *ExecutionPlan, visited map[int64]bool) time.Duration
+	startTime = func(ep *ExecutionPlan, visited map[int64]bool) time.Duration {
+		if t, ok := startTimes[ep.PlanID]; ok {
+			return t
+		}
+		t := time.Duration(ep.StartDelay) * time.Second
+		// The schedule is validated before the launch. Still, a broken chain is not followed.
+		if d := ep.DependsOn; d != nil && plans[d.PlanID] != nil && !visited[d.PlanID] {
+			visited[ep.PlanID] = true
+			dep := plans[d.PlanID]
+			t += startTime(dep, visited)
+			switch d.state() {
+			case PlanRampedUp:
+				t += time.Duration(dep.Rampup) * time.Second
+			case PlanFinished:
+				t += time.Duration(dep.Duration) * time.Minute
+			}
+		}
+		startTimes[ep.PlanID] = t
+		return t
+	}
+	var duration time.Duration
+	for _, ep := range eps {
+		end := startTime(ep, map[int64]bool{}) + time.Duration(ep.Duration)*time.Minute
+		if end > duration {
+			duration = end
+		}
+	}
+	return duration
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingPlan is a plan of the current run which has not started yet
+type PendingPlan struct {
+	CollectionID int64 `json:"collection_id"`
+	PlanID       int64 `json:"plan_id"`
+	RunID        int64 `json:"run_id"`
+	// When the plan will start. Nil while the plan waits for its dependency
+	StartTime *time.Time `json:"start_time"`
+	// The plan is being started. Plans stay pending until their engines are running
+	Starting    bool            `json:"starting"`
+	DependsOn   *PlanDependency `json:"depends_on"`
+	CreatedTime time.Time       `json:"created_time"`
+}
+
+// AddPendingPlan adds the plan to the pending plans of the run. Plans without a dependency get their start
+// time right away. Plans started by the caller itself are added as starting so nobody else starts them.
+func AddPendingPlan(collectionID, runID int64, ep *ExecutionPlan, starting bool) error {
+	var startTime sql.NullTime
+	if ep.DependsOn == nil {
+		startTime = sql.NullTime{Time: time.Now().Add(time.Duration(ep.StartDelay) * time.Second), Valid: true}
+	}
+	var startingDB int8
+	if starting {
+		startingDB = 1
+	}
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into pending_plan (collection_id, plan_id, run_id, context, start_time, starting) values (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(collectionID, ep.PlanID, runID, config.SC.Context, startTime, startingDB)
+	return err
+}
+
+func queryPendingPlans(query string, args ...interface{}) ([]*PendingPlan, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	pps := []*PendingPlan{}
+	for rs.Next() {
+		pp := new(PendingPlan)
+		var startTime sql.NullTime
+		var dependsOnPlanID sql.NullInt64
+		var dependsOnState string
+		var startingDB int8
+		if err := rs.Scan(&pp.CollectionID, &pp.PlanID, &pp.RunID, &startTime, &startingDB, &pp.CreatedTime,
+			&dependsOnPlanID, &dependsOnState); err != nil {
+			return nil, err
+		}
+		pp.Starting = startingDB == 1
+		if startTime.Valid {
+			pp.StartTime = &startTime.Time
+		}
+		if dependsOnPlanID.Valid {
+			pp.DependsOn = &PlanDependency{PlanID: dependsOnPlanID.Int64, State: dependsOnState}
+		}
+		pps = append(pps, pp)
+	}
+	return pps, rs.Err()
+}
+
+const pendingPlanQuery = `select p.collection_id, p.plan_id, p.run_id, p.start_time, p.starting, p.created_time,
+cp.depends_on_plan_id, cp.depends_on_state from pending_plan p
+join collection_plan cp on p.collection_id = cp.collection_id and p.plan_id = cp.plan_id`
+
+// GetPendingPlans returns the pending plans of all the collections in the context
+func GetPendingPlans() ([]*PendingPlan, error) {
+	return queryPendingPlans(pendingPlanQuery+" where p.context=?", config.SC.Context)
+}
+
+func GetPendingPlansByCollection(collectionID int64) ([]*PendingPlan, error) {
+	return queryPendingPlans(pendingPlanQuery+" where p.collection_id=?", collectionID)
+}
+
+func (c *Collection) HasPendingPlan() (bool, error) {
+	pps, err := GetPendingPlansByCollection(c.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(pps) > 0, nil
+}
+
+// SetPendingPlanStartTime is called when the dependency of the plan is met
+func SetPendingPlanStartTime(collectionID, planID int64, startTime time.Time) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("update pending_plan set start_time=? where collection_id=? and plan_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(startTime, collectionID, planID)
+	return err
+}
+
+var ErrPendingPlanTaken = errors.New("Pending plan is already started or cancelled")
+
+// ClaimPendingPlan marks the plan as starting so only one caller starts it
+func ClaimPendingPlan(collectionID, planID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("update pending_plan set starting=1 where collection_id=? and plan_id=? and starting=0")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	r, err := q.Exec(collectionID, planID)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		return ErrPendingPlanTaken
+	}
+	return nil
+}
+
+// DeletePendingPlan is called when the plan is running or failed to start
+func DeletePendingPlan(collectionID, planID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from pending_plan where collection_id=? and plan_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(collectionID, planID)
+	return err
+}
+
+// DeletePendingPlans cancels the plans of the collection which have not started yet
+func DeletePendingPlans(collectionID int64) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from pending_plan where collection_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(collectionID)
+	return err
+}
@@ -0,0 +1,96 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePlanSchedule(t *testing.T) {
+	dependsOn := func(planID int64) *PlanDependency {
+		return &PlanDependency{PlanID: planID}
+	}
+	cases := []struct {
+		name  string
+		plans []*ExecutionPlan
+		valid bool
+	}{
+		{"valid chain", []*ExecutionPlan{
+			{PlanID: 1},
+			{PlanID: 2, DependsOn: dependsOn(1)},
+			{PlanID: 3, DependsOn: &PlanDependency{PlanID: 2, State: PlanRampedUp}, StartDelay: 10},
+		}, true},
+		{"missing plan", []*ExecutionPlan{
+			{PlanID: 1, DependsOn: dependsOn(9)},
+		}, false},
+		{"missing plan down the chain", []*ExecutionPlan{
+			{PlanID: 1, DependsOn: dependsOn(2)},
+			{PlanID: 2, DependsOn: dependsOn(9)},
+		}, false},
+		{"self", []*ExecutionPlan{
+			{PlanID: 1, DependsOn: dependsOn(1)},
+		}, false},
+		{"cycle", []*ExecutionPlan{
+			{PlanID: 1, DependsOn: dependsOn(3)},
+			{PlanID: 2, DependsOn: dependsOn(1)},
+			{PlanID: 3, DependsOn: dependsOn(2)},
+		}, false},
+		{"unknown state", []*ExecutionPlan{
+			{PlanID: 1},
+			{PlanID: 2, DependsOn: &PlanDependency{PlanID: 1, State: "stopped"}},
+		}, false},
+		{"negative delay", []*ExecutionPlan{
+			{PlanID: 1, StartDelay: -1},
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidatePlanSchedule(c.plans)
+			if c.valid {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestLaunchDuration(t *testing.T) {
+	cases := []struct {
+		name     string
+		plans    []*ExecutionPlan
+		duration time.Duration
+	}{
+		{"parallel", []*ExecutionPlan{
+			{PlanID: 1, Duration: 30},
+			{PlanID: 2, Duration: 50},
+		}, 50 * time.Minute},
+		{"start delay", []*ExecutionPlan{
+			{PlanID: 1, Duration: 30},
+			{PlanID: 2, Duration: 30, StartDelay: 1800},
+		}, time.Hour},
+		{"after finished", []*ExecutionPlan{
+			{PlanID: 1, Duration: 30},
+			{PlanID: 2, Duration: 40, DependsOn: &PlanDependency{PlanID: 1}},
+		}, 70 * time.Minute},
+		{"after started", []*ExecutionPlan{
+			{PlanID: 1, Duration: 30},
+			{PlanID: 2, Duration: 20, StartDelay: 60, DependsOn: &PlanDependency{PlanID: 1, State: PlanStarted}},
+		}, 30 * time.Minute},
+		{"after ramped up", []*ExecutionPlan{
+			{PlanID: 1, Duration: 10, Rampup: 300},
+			{PlanID: 2, Duration: 10, DependsOn: &PlanDependency{PlanID: 1, State: PlanRampedUp}},
+		}, 15 * time.Minute},
+		{"chain", []*ExecutionPlan{
+			{PlanID: 3, Duration: 10, StartDelay: 120, DependsOn: &PlanDependency{PlanID: 2}},
+			{PlanID: 2, Duration: 20, DependsOn: &PlanDependency{PlanID: 1, State: PlanFinished}},
+			{PlanID: 1, Duration: 30},
+		}, 62 * time.Minute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.duration, launchDuration(c.plans))
+		})
+	}
+}
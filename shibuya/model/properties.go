@@ -0,0 +1,49 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Prefix of the properties set by shibuya, e.g. shibuya.engine_index
+const BuiltinPropertyPrefix = "shibuya."
+
+var propertyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidateProperties checks the JMeter properties set in the collection config
+func ValidateProperties(props map[string]string) error {
+	for name := range props {
+		if !propertyNamePattern.MatchString(name) {
+			return fmt.Errorf("Invalid property name %q. Only letters, digits, _, . and - are allowed", name)
+		}
+		if strings.HasPrefix(name, BuiltinPropertyPrefix) {
+			return fmt.Errorf("Property %s is reserved. Properties starting with %s are set by shibuya", name, BuiltinPropertyPrefix)
+		}
+	}
+	return nil
+}
+
+func marshalProperties(props map[string]string) (sql.NullString, error) {
+	if len(props) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(props)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func unmarshalProperties(raw sql.NullString) map[string]string {
+	props := map[string]string{}
+	if !raw.Valid || raw.String == "" {
+		return props
+	}
+	if err := json.Unmarshal([]byte(raw.String), &props); err != nil {
+		return map[string]string{}
+	}
+	return props
+}
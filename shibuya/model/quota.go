@@ -0,0 +1,165 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+// A quota can be set on a project or on an owner group, which is the owner of the projects.
+const (
+	ProjectQuotaScope = "project"
+	OwnerQuotaScope   = "owner"
+)
+
+// Quota limits the launches of a project or an owner group. 0 means unlimited.
+// Engines and VU are counted across all the collections being launched at the same time.
+type Quota struct {
+	Scope         string `json:"scope"`
+	ScopeID       string `json:"scope_id"`
+	MaxEngines    int64  `json:"max_engines"`
+	MaxVU         int64  `json:"max_vu"`
+	MaxMonthlyVUH int64  `json:"max_monthly_vuh"`
+}
+
+type QuotaUsage struct {
+	Engines    int64   `json:"engines"`
+	VU         int64   `json:"vu"`
+	MonthlyVUH float64 `json:"monthly_vuh"`
+}
+
+func IsValidQuotaScope(scope string) bool {
+	return scope == ProjectQuotaScope || scope == OwnerQuotaScope
+}
+
+// GetQuota returns nil if there is no quota for the scope
+func GetQuota(scope, scopeID string) (*Quota, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select scope, scope_id, max_engines, max_vu, max_monthly_vuh from quota where scope=? and scope_id=?")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	quota := new(Quota)
+	err = q.QueryRow(scope, scopeID).Scan(&quota.Scope, &quota.ScopeID, &quota.MaxEngines, &quota.MaxVU, &quota.MaxMonthlyVUH)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+func GetQuotas() ([]*Quota, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select scope, scope_id, max_engines, max_vu, max_monthly_vuh from quota order by scope, scope_id")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	r := []*Quota{}
+	for rs.Next() {
+		quota := new(Quota)
+		rs.Scan(&quota.Scope, &quota.ScopeID, &quota.MaxEngines, &quota.MaxVU, &quota.MaxMonthlyVUH)
+		r = append(r, quota)
+	}
+	return r, rs.Err()
+}
+
+func SetQuota(quota *Quota) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into quota (scope, scope_id, max_engines, max_vu, max_monthly_vuh) values (?,?,?,?,?) on duplicate key update max_engines=?, max_vu=?, max_monthly_vuh=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(quota.Scope, quota.ScopeID, quota.MaxEngines, quota.MaxVU, quota.MaxMonthlyVUH,
+		quota.MaxEngines, quota.MaxVU, quota.MaxMonthlyVUH)
+	return err
+}
+
+func DeleteQuota(scope, scopeID string) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("delete from quota where scope=? and scope_id=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(scope, scopeID)
+	return err
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// GetQuotaUsage calculates the usage of the scope from the launch history. Engines and VU are from the
+// collections being launched. VUH includes the launches being run and the ones finished in this month, billed
+// in the same way as the usage report.
+func GetQuotaUsage(scope, scopeID string) (*QuotaUsage, error) {
+	db := config.SC.DBC
+	query := "select h.engines_count, h.vu, h.started_time, h.end_time from collection_launch_history2 h join collection c on h.collection_id = c.id join project p on c.project_id = p.id where %s and (h.end_time >= ? or h.end_time is null)"
+	switch scope {
+	case ProjectQuotaScope:
+		query = fmt.Sprintf(query, "p.id=?")
+	case OwnerQuotaScope:
+		query = fmt.Sprintf(query, "p.owner=?")
+	default:
+		return nil, fmt.Errorf("Unknown quota scope %s", scope)
+	}
+	q, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	now := time.Now()
+	rs, err := q.Query(scopeID, startOfMonth(now).Format(MySQLFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	usage := new(QuotaUsage)
+	for rs.Next() {
+		var enginesCount, vu sql.NullInt64
+		var startedTime time.Time
+		var endTime mysql.NullTime
+		rs.Scan(&enginesCount, &vu, &startedTime, &endTime)
+		end := now
+		if endTime.Valid {
+			end = endTime.Time
+		} else {
+			usage.Engines += enginesCount.Int64
+			usage.VU += vu.Int64
+		}
+		usage.MonthlyVUH += calVUH(calBillingHours(startedTime, end), float64(vu.Int64))
+	}
+	return usage, rs.Err()
+}
+
+// Check returns QuotaExceededError if launching the estimated usage on top of the current usage exceeds the quota
+func (quota *Quota) Check(usage *QuotaUsage, estimate *UsageEstimate) error {
+	if quota.MaxEngines > 0 && usage.Engines+estimate.Engines > quota.MaxEngines {
+		return &QuotaExceededError{Message: fmt.Sprintf("Engines quota of %s %s is exceeded. In use: %d, requesting: %d, quota: %d",
+			quota.Scope, quota.ScopeID, usage.Engines, estimate.Engines, quota.MaxEngines), Retryable: true}
+	}
+	if quota.MaxVU > 0 && usage.VU+estimate.VU > quota.MaxVU {
+		return &QuotaExceededError{Message: fmt.Sprintf("VU quota of %s %s is exceeded. In use: %d, requesting: %d, quota: %d",
+			quota.Scope, quota.ScopeID, usage.VU, estimate.VU, quota.MaxVU), Retryable: true}
+	}
+	if quota.MaxMonthlyVUH > 0 && usage.MonthlyVUH+estimate.VUH > float64(quota.MaxMonthlyVUH) {
+		return &QuotaExceededError{Message: fmt.Sprintf("Monthly VUH quota of %s %s is not enough. Used: %.0f, estimated: %.0f, quota: %d",
+			quota.Scope, quota.ScopeID, usage.MonthlyVUH, estimate.VUH, quota.MaxMonthlyVUH)}
+	}
+	return nil
+}
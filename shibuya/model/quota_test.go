@@ -0,0 +1,47 @@
+package model
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	quota := &Quota{Scope: ProjectQuotaScope, ScopeID: "1", MaxEngines: 10, MaxVU: 1000, MaxMonthlyVUH: 5000}
+	cases := []struct {
+		name      string
+		quota     *Quota
+		usage     *QuotaUsage
+		estimate  *UsageEstimate
+		exceeded  bool
+		retryable bool
+	}{
+		{"within the quota", quota, &QuotaUsage{Engines: 5, VU: 500, MonthlyVUH: 1000},
+			&UsageEstimate{Engines: 5, VU: 500, VUH: 500}, false, false},
+		{"no limits", &Quota{Scope: ProjectQuotaScope, ScopeID: "1"}, &QuotaUsage{Engines: 100, VU: 10000, MonthlyVUH: 100000},
+			&UsageEstimate{Engines: 100, VU: 10000, VUH: 10000}, false, false},
+		{"engines in use", quota, &QuotaUsage{Engines: 6},
+			&UsageEstimate{Engines: 5}, true, true},
+		{"vu in use", quota, &QuotaUsage{VU: 600},
+			&UsageEstimate{VU: 500}, true, true},
+		{"monthly vuh used up", quota, &QuotaUsage{MonthlyVUH: 4800},
+			&UsageEstimate{VUH: 500}, true, false},
+		{"launch larger than the quota", quota, &QuotaUsage{},
+			&UsageEstimate{Engines: 5, VU: 500, VUH: 6000}, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.quota.Check(c.usage, c.estimate)
+			if !c.exceeded {
+				assert.Nil(t, err)
+				return
+			}
+			var qe *QuotaExceededError
+			if !errors.As(err, &qe) {
+				t.Fatalf("expected QuotaExceededError, got %v", err)
+			}
+			assert.Equal(t, c.retryable, qe.Retryable)
+		})
+	}
+}
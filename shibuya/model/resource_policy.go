@@ -0,0 +1,150 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourcePolicy restricts the engine resources the plans in a project can request.
+// Empty bounds are not limited. Images are the approved images on top of the default engine image.
+type ResourcePolicy struct {
+	ProjectID int64    `json:"project_id"`
+	MinCPU    string   `json:"min_cpu"`
+	MaxCPU    string   `json:"max_cpu"`
+	MinMem    string   `json:"min_mem"`
+	MaxMem    string   `json:"max_mem"`
+	Images    []string `json:"images"`
+}
+
+// GetResourcePolicy returns nil if the admins have not configured a policy for the project
+func GetResourcePolicy(projectID int64) (*ResourcePolicy, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select project_id, min_cpu, max_cpu, min_mem, max_mem, images from project_resource_policy where project_id=?")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rp := new(ResourcePolicy)
+	var images sql.NullString
+	err = q.QueryRow(projectID).Scan(&rp.ProjectID, &rp.MinCPU, &rp.MaxCPU, &rp.MinMem, &rp.MaxMem, &images)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rp.Images = []string{}
+	if images.String != "" {
+		rp.Images = strings.Split(images.String, ",")
+	}
+	return rp, nil
+}
+
+func SetResourcePolicy(rp *ResourcePolicy) error {
+	db := config.SC.DBC
+	q, err := db.Prepare("insert into project_resource_policy (project_id, min_cpu, max_cpu, min_mem, max_mem, images) values (?,?,?,?,?,?) on duplicate key update min_cpu=?, max_cpu=?, min_mem=?, max_mem=?, images=?")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	images := strings.Join(rp.Images, ",")
+	_, err = q.Exec(rp.ProjectID, rp.MinCPU, rp.MaxCPU, rp.MinMem, rp.MaxMem, images,
+		rp.MinCPU, rp.MaxCPU, rp.MinMem, rp.MaxMem, images)
+	return err
+}
+
+func (rp *ResourcePolicy) Validate() error {
+	for _, q := range []string{rp.MinCPU, rp.MaxCPU, rp.MinMem, rp.MaxMem} {
+		if q == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(q); err != nil {
+			return fmt.Errorf("Invalid resource quantity %s", q)
+		}
+	}
+	return nil
+}
+
+func (rp *ResourcePolicy) imageApproved(image string) bool {
+	for _, i := range rp.Images {
+		if i == image {
+			return true
+		}
+	}
+	return false
+}
+
+func checkResourceRange(name, value, min, max string) error {
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %s", name, value)
+	}
+	if min != "" {
+		if m, err := resource.ParseQuantity(min); err == nil && q.Cmp(m) < 0 {
+			return fmt.Errorf("The %s %s is less than the minimum %s of the project", name, value, min)
+		}
+	}
+	if max != "" {
+		if m, err := resource.ParseQuantity(max); err == nil && q.Cmp(m) > 0 {
+			return fmt.Errorf("The %s %s is more than the maximum %s of the project", name, value, max)
+		}
+	}
+	return nil
+}
+
+var heapPattern = regexp.MustCompile(`^([1-9][0-9]*)([kKmMgG])$`)
+
+// ParseHeap converts the JVM heap size, e.g. 512m, into a quantity so it can be compared with the memory
+func ParseHeap(heap string) (resource.Quantity, error) {
+	m := heapPattern.FindStringSubmatch(heap)
+	if m == nil {
+		return resource.Quantity{}, fmt.Errorf("Invalid heap %s. It should be like 512m or 2g", heap)
+	}
+	return resource.ParseQuantity(m[1] + strings.ToUpper(m[2]) + "i")
+}
+
+// ValidateResources checks the resource overrides of the plan. The policy is nil when the admins
+// have not configured it for the project. In this case, only the heap can be changed.
+// Curated engine images are picked by their name and need to be approved like any other image.
+func (ep *ExecutionPlan) ValidateResources(rp *ResourcePolicy, jc *config.JmeterContainer) error {
+	if rp == nil && (ep.CPU != "" || ep.Mem != "" || ep.Image != "") {
+		return errors.New("Engine resources cannot be changed in this project. Please ask the admins to configure the allowed ranges")
+	}
+	if ep.CPU != "" {
+		if err := checkResourceRange("cpu", ep.CPU, rp.MinCPU, rp.MaxCPU); err != nil {
+			return err
+		}
+	}
+	if ep.Mem != "" {
+		if err := checkResourceRange("mem", ep.Mem, rp.MinMem, rp.MaxMem); err != nil {
+			return err
+		}
+	}
+	if ep.Image != "" {
+		image := jc.ResolveImage(ep.Image)
+		if image != jc.Image && !rp.imageApproved(ep.Image) && !rp.imageApproved(image) {
+			return fmt.Errorf("Image %s is not approved for this project", ep.Image)
+		}
+	}
+	if ep.Heap != "" {
+		heap, err := ParseHeap(ep.Heap)
+		if err != nil {
+			return err
+		}
+		mem := jc.Mem
+		if ep.Mem != "" {
+			mem = ep.Mem
+		}
+		// The JVM needs some memory outside of the heap as well
+		if m, err := resource.ParseQuantity(mem); err == nil && heap.Cmp(m) >= 0 {
+			return fmt.Errorf("The heap %s should be less than the engine memory %s", ep.Heap, mem)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeap(t *testing.T) {
+	cases := []struct {
+		heap  string
+		bytes int64
+		valid bool
+	}{
+		{"512m", 512 * 1024 * 1024, true},
+		{"512M", 512 * 1024 * 1024, true},
+		{"2g", 2 * 1024 * 1024 * 1024, true},
+		{"1024k", 1024 * 1024, true},
+		{"", 0, false},
+		{"512", 0, false},
+		{"0m", 0, false},
+		{"-1g", 0, false},
+		{"1.5g", 0, false},
+		{"2gb", 0, false},
+		{"2Gi", 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.heap, func(t *testing.T) {
+			q, err := ParseHeap(c.heap)
+			if !c.valid {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.bytes, q.Value())
+		})
+	}
+}
@@ -191,3 +191,122 @@ func GetUsageSummaryBySid(sid, startedTime, endTime string) (*OwnerUsageSummary,
 	s.History = sidHistory
 	return s, nil
 }
+
+// UsageEstimate is the expected usage of launching a collection and running its plans once.
+// It's billed in the same way as the usage summary so it can be compared with the quotas.
+type UsageEstimate struct {
+	Context      string  `json:"context"`
+	Engines      int64   `json:"engines"`
+	Nodes        int64   `json:"nodes"`
+	VU           int64   `json:"vu"`
+	BillingHours float64 `json:"billing_hours"`
+	VUH          float64 `json:"vuh"`
+	Cost         float64 `json:"cost"`
+	Currency     string  `json:"currency"`
+}
+
+// EstimateUsage estimates the usage of the plans in the context. The launch lasts until the last plan is
+// finished, following the start delays and the dependencies of the plans. Cost is 0 if there is no rate
+// configured for the context.
+func EstimateUsage(eps []*ExecutionPlan, cxt string) *UsageEstimate {
+	ue := &UsageEstimate{Context: cxt}
+	for _, ep := range eps {
+		ue.Engines += int64(ep.Engines)
+		ue.VU += int64(ep.Engines * ep.Concurrency)
+	}
+	// Same as the history, 1 hour is the minimum charging unit.
+	ue.BillingHours = math.Max(1, math.Ceil(launchDuration(eps).Hours()))
+	ue.VUH = calVUH(ue.BillingHours, float64(ue.VU))
+	rate, ok := config.SC.UsageRates[cxt]
+	if !ok {
+		return ue
+	}
+	if rate.EnginesPerNode > 0 {
+		ue.Nodes = int64(math.Ceil(float64(ue.Engines) / float64(rate.EnginesPerNode)))
+	}
+	ue.Currency = rate.Currency
+	ue.Cost = ue.VUH*rate.VUH + float64(ue.Nodes)*ue.BillingHours*rate.NodeHour
+	return ue
+}
+
+// VisibleSIDs returns the SIDs the account can see the usage of, which are the SIDs of the projects
+// owned by the account. Groups of the account are included as well because launches can be owned by them.
+func (a *Account) VisibleSIDs() (map[string]bool, error) {
+	sids := make(map[string]bool)
+	for _, m := range a.ML {
+		sids[m] = true
+	}
+	if len(a.ML) == 0 {
+		return sids, nil
+	}
+	projects, err := GetProjectsByOwners(a.ML)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range projects {
+		if p.SID != "" {
+			sids[p.SID] = true
+		}
+	}
+	return sids, nil
+}
+
+func (a *Account) canSeeUsage(sids map[string]bool, sid string, owners []string) bool {
+	if sids[sid] {
+		return true
+	}
+	for _, o := range owners {
+		if _, ok := a.MLMap[o]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterByAccount removes the usage of the SIDs the account cannot see. Total VUH only counts the rest.
+func (s *TotalUsageSummary) FilterByAccount(a *Account) error {
+	sids, err := a.VisibleSIDs()
+	if err != nil {
+		return err
+	}
+	totalVUH := make(map[string]float64)
+	for sid, vuh := range s.VUHByOnwer {
+		if !a.canSeeUsage(sids, sid, s.Contacts[sid]) {
+			delete(s.VUHByOnwer, sid)
+			delete(s.Contacts, sid)
+			continue
+		}
+		for cxt, v := range vuh {
+			totalVUH[cxt] += v
+		}
+	}
+	for sid, contacts := range s.Contacts {
+		if !a.canSeeUsage(sids, sid, contacts) {
+			delete(s.Contacts, sid)
+		}
+	}
+	s.TotalVUH = totalVUH
+	return nil
+}
+
+func (a *Account) CanSeeSIDUsage(sid string) (bool, error) {
+	sids, err := a.VisibleSIDs()
+	if err != nil {
+		return false, err
+	}
+	return sids[sid], nil
+}
+
+func FilterUsageReportByAccount(report []*UsageReportRow, a *Account) ([]*UsageReportRow, error) {
+	sids, err := a.VisibleSIDs()
+	if err != nil {
+		return nil, err
+	}
+	r := []*UsageReportRow{}
+	for _, row := range report {
+		if a.canSeeUsage(sids, row.SID, []string{row.Owner}) {
+			r = append(r, row)
+		}
+	}
+	return r, nil
+}
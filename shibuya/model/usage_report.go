@@ -0,0 +1,178 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+const (
+	GroupByDay   = "day"
+	GroupByWeek  = "week"
+	GroupByMonth = "month"
+)
+
+func IsValidReportGroup(groupBy string) bool {
+	return groupBy == GroupByDay || groupBy == GroupByWeek || groupBy == GroupByMonth
+}
+
+// UsageReportRow is the usage of a collection in a period. Launches are put into the period they ended in, so
+// every launch is reported once even when it crosses the periods.
+type UsageReportRow struct {
+	Period       string  `json:"period"`
+	ProjectID    int64   `json:"project_id"`
+	ProjectName  string  `json:"project_name"`
+	CollectionID int64   `json:"collection_id"`
+	Owner        string  `json:"owner"`
+	SID          string  `json:"sid"`
+	Context      string  `json:"context"`
+	Launches     int     `json:"launches"`
+	BillingHours float64 `json:"billing_hours"`
+	VUH          float64 `json:"vuh"`
+}
+
+var usageReportHeader = []string{"period", "project_id", "project_name", "collection_id", "owner", "sid", "context",
+	"launches", "billing_hours", "vuh"}
+
+// reportedLaunch is a finished launch in the history together with its project
+type reportedLaunch struct {
+	CollectionID int64
+	Context      string
+	Owner        string
+	VU           int64
+	StartedTime  time.Time
+	EndTime      time.Time
+	ProjectID    int64
+	ProjectName  string
+	ProjectOwner string
+	SID          string
+}
+
+// findPeriod returns the first day of the period, e.g. 2006-01-02. Weeks start on Monday.
+func findPeriod(t time.Time, groupBy string) string {
+	switch groupBy {
+	case GroupByWeek:
+		offset := (int(t.Weekday()) + 6) % 7
+		return t.AddDate(0, 0, -offset).Format("2006-01-02")
+	case GroupByMonth:
+		return startOfMonth(t).Format("2006-01-02")
+	}
+	return t.Format("2006-01-02")
+}
+
+// GetUsageReport aggregates the launches finished between the times. Launches of deleted projects are still
+// reported with the owner recorded in the history.
+func GetUsageReport(startedTime, endTime, groupBy string) ([]*UsageReportRow, error) {
+	db := config.SC.DBC
+	q, err := db.Prepare("select h.collection_id, h.context, h.owner, h.vu, h.started_time, h.end_time, p.id, p.name, p.owner, p.sid from collection_launch_history2 h left join collection c on h.collection_id = c.id left join project p on c.project_id = p.id where h.end_time >= ? and h.end_time < ?")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rs, err := q.Query(startedTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	launches := []*reportedLaunch{}
+	for rs.Next() {
+		l := new(reportedLaunch)
+		var ended mysql.NullTime
+		var projectID sql.NullInt64
+		var projectName, projectOwner, sid sql.NullString
+		if err := rs.Scan(&l.CollectionID, &l.Context, &l.Owner, &l.VU, &l.StartedTime, &ended, &projectID,
+			&projectName, &projectOwner, &sid); err != nil {
+			return nil, err
+		}
+		l.EndTime = ended.Time
+		l.ProjectID = projectID.Int64
+		l.ProjectName = projectName.String
+		l.ProjectOwner = projectOwner.String
+		l.SID = sid.String
+		launches = append(launches, l)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return aggregateUsage(launches, groupBy), nil
+}
+
+func aggregateUsage(launches []*reportedLaunch, groupBy string) []*UsageReportRow {
+	rows := make(map[string]*UsageReportRow)
+	for _, l := range launches {
+		row := &UsageReportRow{
+			Period:       findPeriod(l.EndTime, groupBy),
+			ProjectID:    l.ProjectID,
+			ProjectName:  l.ProjectName,
+			CollectionID: l.CollectionID,
+			Owner:        l.ProjectOwner,
+			SID:          findOwner(l.Owner, Project{SID: l.SID}),
+			Context:      l.Context,
+		}
+		if row.SID == "" {
+			row.SID = "unknown"
+		}
+		key := fmt.Sprintf("%s-%d-%d-%s-%s", row.Period, row.ProjectID, row.CollectionID, row.SID, row.Context)
+		if r, ok := rows[key]; ok {
+			row = r
+		} else {
+			rows[key] = row
+		}
+		billingHours := calBillingHours(l.StartedTime, l.EndTime)
+		row.Launches += 1
+		row.BillingHours += billingHours
+		row.VUH += calVUH(billingHours, float64(l.VU))
+	}
+	report := make([]*UsageReportRow, 0, len(rows))
+	for _, r := range rows {
+		report = append(report, r)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		ri, rj := report[i], report[j]
+		if ri.Period != rj.Period {
+			return ri.Period < rj.Period
+		}
+		if ri.ProjectID != rj.ProjectID {
+			return ri.ProjectID < rj.ProjectID
+		}
+		if ri.CollectionID != rj.CollectionID {
+			return ri.CollectionID < rj.CollectionID
+		}
+		return ri.Context < rj.Context
+	})
+	return report
+}
+
+func WriteUsageReportCSV(w io.Writer, report []*UsageReportRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageReportHeader); err != nil {
+		return err
+	}
+	for _, r := range report {
+		record := []string{
+			r.Period,
+			strconv.FormatInt(r.ProjectID, 10),
+			r.ProjectName,
+			strconv.FormatInt(r.CollectionID, 10),
+			r.Owner,
+			r.SID,
+			r.Context,
+			strconv.Itoa(r.Launches),
+			strconv.FormatFloat(r.BillingHours, 'f', -1, 64),
+			strconv.FormatFloat(r.VUH, 'f', -1, 64),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateUsage(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, _ := time.Parse(MySQLFormat, value)
+		return parsed
+	}
+	launch := func(started, ended string) *reportedLaunch {
+		return &reportedLaunch{CollectionID: 1, Context: "test", VU: 10, StartedTime: at(started), EndTime: at(ended),
+			ProjectID: 1, SID: "sid"}
+	}
+	cases := []struct {
+		name     string
+		launches []*reportedLaunch
+		groupBy  string
+		periods  []string
+		vuh      []float64
+	}{
+		{"within the month", []*reportedLaunch{
+			launch("2026-01-10 10:00:00", "2026-01-10 11:00:00"),
+			launch("2026-01-20 10:00:00", "2026-01-20 11:30:00"),
+		}, GroupByMonth, []string{"2026-01-01"}, []float64{30}},
+		{"crossing the month", []*reportedLaunch{
+			launch("2026-01-10 10:00:00", "2026-01-10 11:00:00"),
+			launch("2026-01-31 23:00:00", "2026-02-01 01:00:00"),
+		}, GroupByMonth, []string{"2026-01-01", "2026-02-01"}, []float64{10, 20}},
+		{"crossing the week", []*reportedLaunch{
+			launch("2026-01-04 23:30:00", "2026-01-05 00:30:00"),
+		}, GroupByWeek, []string{"2026-01-05"}, []float64{10}},
+		{"crossing the day", []*reportedLaunch{
+			launch("2026-01-04 23:30:00", "2026-01-05 00:30:00"),
+			launch("2026-01-05 10:00:00", "2026-01-05 10:30:00"),
+		}, GroupByDay, []string{"2026-01-05"}, []float64{20}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report := aggregateUsage(c.launches, c.groupBy)
+			periods := []string{}
+			vuh := []float64{}
+			launches := 0
+			for _, r := range report {
+				periods = append(periods, r.Period)
+				vuh = append(vuh, r.VUH)
+				launches += r.Launches
+			}
+			assert.Equal(t, c.periods, periods)
+			assert.Equal(t, c.vuh, vuh)
+			assert.Equal(t, len(c.launches), launches)
+		})
+	}
+}
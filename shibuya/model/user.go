@@ -1,7 +1,9 @@
 package model
 
 import (
+	"crypto/subtle"
 	"net/http"
+	"strings"
 
 	"github.com/rakutentech/shibuya/shibuya/auth"
 	"github.com/rakutentech/shibuya/shibuya/config"
@@ -40,6 +42,34 @@ func GetAccountBySession(r *http.Request) *Account {
 	return a
 }
 
+// Only the Authorization headers with this scheme carry API tokens. Others, e.g. Basic auth added by a proxy,
+// are left to the session auth.
+const BearerPrefix = "Bearer "
+
+// HasBearerToken tells whether the request should be authenticated by an API token instead of the session
+func HasBearerToken(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), BearerPrefix)
+}
+
+// GetAccountByToken finds the account of the bearer token in the Authorization header
+func GetAccountByToken(r *http.Request) *Account {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), BearerPrefix)
+	if !found || token == "" {
+		return nil
+	}
+	for _, t := range config.SC.AuthConfig.APITokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) != 1 {
+			continue
+		}
+		a := &Account{Name: t.Name, ML: t.ML, MLMap: make(map[string]interface{})}
+		for _, m := range a.ML {
+			a.MLMap[m] = es
+		}
+		return a
+	}
+	return nil
+}
+
 func (a *Account) IsAdmin() bool {
 	for _, ml := range a.ML {
 		for _, admin := range config.SC.AuthConfig.AdminUsers {
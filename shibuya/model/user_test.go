@@ -0,0 +1,55 @@
+package model
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rakutentech/shibuya/shibuya/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAccountByToken(t *testing.T) {
+	tokens, noAuth := config.SC.AuthConfig.APITokens, config.SC.AuthConfig.NoAuth
+	defer func() {
+		config.SC.AuthConfig.APITokens, config.SC.AuthConfig.NoAuth = tokens, noAuth
+	}()
+	config.SC.AuthConfig.APITokens = []*config.APIToken{
+		{Name: "ci", Token: "secret", ML: []string{"tech-rwasp"}},
+	}
+	cases := []struct {
+		name    string
+		header  string
+		bearer  bool
+		account string
+	}{
+		{"matching token", "Bearer secret", true, "ci"},
+		{"wrong token", "Bearer wrong", true, ""},
+		{"empty token", "Bearer ", true, ""},
+		{"basic auth", "Basic c2VjcmV0", false, ""},
+		{"no header", "", false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/api/projects", nil)
+			if c.header != "" {
+				r.Header.Set("Authorization", c.header)
+			}
+			assert.Equal(t, c.bearer, HasBearerToken(r))
+			a := GetAccountByToken(r)
+			if c.account == "" {
+				assert.Nil(t, a)
+				return
+			}
+			assert.Equal(t, c.account, a.Name)
+			assert.Contains(t, a.MLMap, "tech-rwasp")
+		})
+	}
+	// Requests without a bearer token are authenticated by the session
+	config.SC.AuthConfig.NoAuth = true
+	r, _ := http.NewRequest("GET", "/api/projects", nil)
+	r.Header.Set("Authorization", "Basic c2VjcmV0")
+	assert.False(t, HasBearerToken(r))
+	a := GetAccountBySession(r)
+	assert.NotNil(t, a)
+	assert.Equal(t, "shibuya", a.Name)
+}
@@ -4,11 +4,32 @@ import (
 	"io"
 )
 
+// Files can be a few GBs so they are always streamed instead of being loaded into memory
 type StorageInterface interface {
 	Upload(filename string, content io.ReadCloser) error
 	Delete(filename string) error
 	GetUrl(filename string) string
-	Download(filename string) ([]byte, error)
+	Size(filename string) (int64, error)
+	Open(filename string) (io.ReadCloser, error)
+}
+
+// Download reads the whole file. It should only be used for small files, e.g. test plans
+func Download(s StorageInterface, filename string) ([]byte, error) {
+	rc, err := s.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
 }
 
 type FileNotFound struct {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"strings"
 	"time"
 	"golang.org/x/oauth2/google"
@@ -97,20 +96,28 @@ func (gs *gcpStorage) GetUrl(filename string) string {
 	return fmt.Sprintf("/api/files/%s", filename)
 }
 
-func (gs *gcpStorage) Download(filename string) ([]byte, error) {
+func (gs *gcpStorage) Size(filename string) (int64, error) {
+	ctx, cancel := context.WithTimeout(gs.ctx, time.Second*10)
+	defer cancel()
+	attrs, err := gs.client.Bucket(gs.bucket).Object(filename).Attrs(ctx)
+	if err != nil {
+		return 0, gs.IfFileNotFoundWrapper(err)
+	}
+	return attrs.Size, nil
+}
+
+func (gs *gcpStorage) Open(filename string) (io.ReadCloser, error) {
 	// Need long timeout for downloading large files
 	ctx, cancel := context.WithTimeout(gs.ctx, time.Minute*30)
-	defer cancel()
 	rc, err := gs.client.Bucket(gs.bucket).Object(filename).NewReader(ctx)
 	if err != nil {
+		cancel()
 		return nil, gs.IfFileNotFoundWrapper(err)
 	}
-	defer rc.Close()
-	data, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return readCloser{Reader: rc, close: func() error {
+		defer cancel()
+		return rc.Close()
+	}}, nil
 }
 
 func (gs *gcpStorage) IfFileNotFoundWrapper(err error) error {
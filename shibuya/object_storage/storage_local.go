@@ -1,11 +1,9 @@
 package object_storage
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 
@@ -30,21 +28,24 @@ func (l localStorage) GetUrl(filename string) string {
 func (l localStorage) Upload(filename string, content io.ReadCloser) error {
 	defer content.Close()
 
-	var b bytes.Buffer
-	var err error
-	w := multipart.NewWriter(&b)
-	var fw io.Writer
-	if fw, err = w.CreateFormFile("file", filename); err != nil {
-		return err
-	}
-	if _, err = io.Copy(fw, content); err != nil {
-		return err
-	}
-	w.Close()
+	// Stream the multipart body instead of buffering the whole file
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	go func() {
+		fw, err := w.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(fw, content)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
 
 	url := l.GetUrl(filename)
-	req, err := http.NewRequest("PUT", url, &b)
+	req, err := http.NewRequest("PUT", url, pr)
 	if err != nil {
+		pr.CloseWithError(err)
 		return err
 	}
 	req.Header.Set("Content-Type", w.FormDataContentType())
@@ -53,6 +54,7 @@ func (l localStorage) Upload(filename string, content io.ReadCloser) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 201 {
 		return nil
 	}
@@ -77,7 +79,28 @@ func (l localStorage) Delete(filename string) error {
 	return err
 }
 
-func (l localStorage) Download(filename string) ([]byte, error) {
+func (l localStorage) Size(filename string) (int64, error) {
+	url := l.GetUrl(filename)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := config.SC.HTTPClient
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return 0, FileNotFoundError()
+	}
+	if resp.StatusCode != 200 || resp.ContentLength < 0 {
+		return 0, errors.New("Bad response from Local storage")
+	}
+	return resp.ContentLength, nil
+}
+
+func (l localStorage) Open(filename string) (io.ReadCloser, error) {
 	url := l.GetUrl(filename)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -88,16 +111,13 @@ func (l localStorage) Download(filename string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode == 404 {
+		resp.Body.Close()
 		return nil, FileNotFoundError()
 	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, errors.New("Bad response from Local storage")
 	}
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	return bytes, nil
+	return resp.Body, nil
 }
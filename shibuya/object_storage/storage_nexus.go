@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/rakutentech/shibuya/shibuya/config"
@@ -70,7 +69,29 @@ func (n nexusStorage) Delete(filename string) error {
 	return err
 }
 
-func (n nexusStorage) Download(filename string) ([]byte, error) {
+func (n nexusStorage) Size(filename string) (int64, error) {
+	url := n.GetUrl(filename)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.SetBasicAuth(n.username, n.password)
+	client := config.SC.HTTPClient
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return 0, FileNotFoundError()
+	}
+	if resp.StatusCode != 200 || resp.ContentLength < 0 {
+		return 0, errors.New("Bad response from Nexus")
+	}
+	return resp.ContentLength, nil
+}
+
+func (n nexusStorage) Open(filename string) (io.ReadCloser, error) {
 	url := n.GetUrl(filename)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -82,16 +103,13 @@ func (n nexusStorage) Download(filename string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode == 404 {
+		resp.Body.Close()
 		return nil, FileNotFoundError()
 	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, errors.New("Bad response from Nexus")
 	}
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	return bytes, nil
+	return resp.Body, nil
 }
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -74,6 +75,13 @@ func (cr *CloudRun) makeService(projectID, collectionID, planID int64, engineID
 		"cpu":    ec.CPU,
 		"memory": ec.Mem,
 	}
+	envvars := []*run.EnvVar{}
+	if ec.Heap != "" {
+		envvars = append(envvars, &run.EnvVar{
+			Name:  "JVM_ARGS",
+			Value: fmt.Sprintf("-Xms%s -Xmx%s", ec.Heap, ec.Heap),
+		})
+	}
 	return &run.Service{
 		ApiVersion: "serving.knative.dev/v1",
 		Kind:       "Service",
@@ -97,6 +105,7 @@ func (cr *CloudRun) makeService(projectID, collectionID, planID int64, engineID
 					Containers: []*run.Container{
 						{
 							Image: ec.Image,
+							Env:   envvars,
 							Ports: []*run.ContainerPort{
 								{
 									ContainerPort: 8080,
@@ -358,6 +367,14 @@ func (cr *CloudRun) GetCollectionEnginesDetail(projectID, collectionID int64) (*
 	return nil, nil
 }
 
+func (cr *CloudRun) GetFailedEngines(collectionID int64) ([]*smodel.FailedEngine, error) {
+	return nil, FeatureUnavailable
+}
+
+func (cr *CloudRun) GetNodesInfo() (smodel.AllNodesInfo, error) {
+	return nil, FeatureUnavailable
+}
+
 func (cr *CloudRun) ExposeProject(projectID int64) error {
 	return nil
 }
@@ -391,3 +408,49 @@ func (cr *CloudRun) DownloadPodLog(collectionID, planID int64) (string, error) {
 	r, _ := ioutil.ReadAll(resp.Body)
 	return string(r), nil
 }
+
+// StreamEngineLogs reads the output of the engines as Cloud Run does not support following the logs.
+// Streams are not limited by the timeout of the client as they can last for the whole test.
+func (cr *CloudRun) StreamEngineLogs(ctx context.Context, collectionID, planID int64, engineID int,
+	follow bool) (map[int]io.ReadCloser, error) {
+	engines, err := cr.getEnginesByCollectionPlan(collectionID, planID)
+	if err != nil {
+		return nil, err
+	}
+	logs := make(map[int]io.ReadCloser)
+	closeLogs := func() {
+		for _, l := range logs {
+			l.Close()
+		}
+	}
+	for _, e := range engines {
+		id, err := strconv.Atoi(e.Metadata.Labels["engine"])
+		if err != nil {
+			continue
+		}
+		if engineID != AllEngines && id != engineID {
+			continue
+		}
+		logUrl := fmt.Sprintf("%s/output?follow=%t", e.Status.Url, follow)
+		req, err := http.NewRequestWithContext(ctx, "GET", logUrl, nil)
+		if err != nil {
+			closeLogs()
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			closeLogs()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			closeLogs()
+			return nil, fmt.Errorf("Cannot read the logs of engine %d: %s", id, resp.Status)
+		}
+		logs[id] = resp.Body
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("Cannot find engines for the plan %d", planID)
+	}
+	return logs, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	e "errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -81,6 +82,19 @@ func prepareEngineMetaEnvvars(collectionID, planID int64) []apiv1.EnvVar {
 	}
 }
 
+// JVM_ARGS are appended after the default heap settings of JMeter so they take precedence
+func prepareHeapEnvvars(containerConfig *config.ExecutorContainer) []apiv1.EnvVar {
+	if containerConfig.Heap == "" {
+		return []apiv1.EnvVar{}
+	}
+	return []apiv1.EnvVar{
+		{
+			Name:  "JVM_ARGS",
+			Value: fmt.Sprintf("-Xms%s -Xmx%s", containerConfig.Heap, containerConfig.Heap),
+		},
+	}
+}
+
 func makeTolerations(key string, value string, effect apiv1.TaintEffect) apiv1.Toleration {
 	toleration := apiv1.Toleration{
 		Effect:   effect,
@@ -306,6 +320,7 @@ func (kcm *K8sClientManager) generateEngineDeployment(engineName string, labels
 							Name:            engineName,
 							Image:           containerConfig.Image,
 							ImagePullPolicy: kcm.ImagePullPolicy,
+							Env:             prepareHeapEnvvars(containerConfig),
 							Resources: apiv1.ResourceRequirements{
 								Limits: apiv1.ResourceList{
 									apiv1.ResourceCPU:    resource.MustParse(containerConfig.CPU),
@@ -409,9 +424,20 @@ func (kcm *K8sClientManager) CreateService(serviceName string, engine appsv1.Dep
 	return nil
 }
 
+// DeployEngine creates a single engine. If the engine is already deployed, it will be recreated.
+// Engines of a plan are owned by the stateful set of the plan, so we delete the engine pod and
+// let the stateful set recreate it with the same identity.
 func (kcm *K8sClientManager) DeployEngine(projectID, collectionID, planID int64,
 	engineID int, containerConfig *config.ExecutorContainer) error {
 	engineName := makeEngineName(projectID, collectionID, planID, engineID)
+	planName := makePlanName(projectID, collectionID, planID)
+	_, err := kcm.client.AppsV1().StatefulSets(kcm.Namespace).Get(context.TODO(), planName, metav1.GetOptions{})
+	if err == nil {
+		return kcm.deletePod(engineName)
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
 	labels := makeEngineLabel(projectID, collectionID, planID, engineName)
 	affinity := prepareAffinity(collectionID)
 	tolerations := prepareTolerations()
@@ -419,6 +445,19 @@ func (kcm *K8sClientManager) DeployEngine(projectID, collectionID, planID int64,
 	if err := kcm.deploy(&engineConfig); err != nil && !errors.IsAlreadyExists(err) {
 		return err
 	}
+	// The deployment already exists. Failed pods will be recreated by its replica set after deletion.
+	pods, err := kcm.GetPods(fmt.Sprintf("app=%s", engineName), "")
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if podFailureReason(pod) == "" {
+			continue
+		}
+		if err := kcm.deletePod(pod.Name); err != nil {
+			return err
+		}
+	}
 	engineSvcName := makeEngineName(projectID, collectionID, planID, engineID)
 	if err := kcm.CreateService(engineSvcName, engineConfig); err != nil {
 		return err
@@ -432,6 +471,74 @@ func (kcm *K8sClientManager) DeployEngine(projectID, collectionID, planID int64,
 	return nil
 }
 
+func (kcm *K8sClientManager) deletePod(podName string) error {
+	err := kcm.client.CoreV1().Pods(kcm.Namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{
+		GracePeriodSeconds: new(int64),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// These waiting reasons mean the engine will not become ready by itself
+var unrecoverableWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// podFailureReason returns why the engine pod is failed. Empty string means the pod is healthy
+// or still starting.
+func podFailureReason(pod apiv1.Pod) string {
+	if pod.Status.Phase == apiv1.PodFailed {
+		// Evicted pods have the reason here
+		if pod.Status.Reason != "" {
+			return pod.Status.Reason
+		}
+		return string(apiv1.PodFailed)
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Waiting != nil && unrecoverableWaitingReasons[cs.State.Waiting.Reason] {
+			return cs.State.Waiting.Reason
+		}
+	}
+	return ""
+}
+
+func (kcm *K8sClientManager) GetFailedEngines(collectionID int64) ([]*smodel.FailedEngine, error) {
+	labelSelector := fmt.Sprintf("collection=%d, kind=executor", collectionID)
+	pods, err := kcm.GetPods(labelSelector, "")
+	if err != nil {
+		return nil, err
+	}
+	failedEngines := []*smodel.FailedEngine{}
+	for _, pod := range pods {
+		reason := podFailureReason(pod)
+		if reason == "" {
+			continue
+		}
+		planID, err := strconv.ParseInt(pod.Labels["plan"], 10, 64)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		engineID, err := strconv.Atoi(getEngineNumber(pod.Name))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		failedEngines = append(failedEngines, &smodel.FailedEngine{
+			PlanID:   planID,
+			EngineID: engineID,
+			Reason:   reason,
+		})
+	}
+	return failedEngines, nil
+}
+
 func (kcm *K8sClientManager) makePlanService(name string, label map[string]string) *apiv1.Service {
 	service := &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -461,6 +568,7 @@ func (kcm *K8sClientManager) DeployPlan(projectID, collectionID, planID int64, e
 	labels := makePlanLabel(projectID, collectionID, planID)
 	affinity := prepareAffinity(collectionID)
 	envvars := prepareEngineMetaEnvvars(collectionID, planID)
+	envvars = append(envvars, prepareHeapEnvvars(containerconfig)...)
 	tolerations := prepareTolerations()
 	planConfig := kcm.generatePlanDeployment(planName, enginesNo, labels, containerconfig, affinity, tolerations, envvars)
 	if _, err := kcm.client.AppsV1().StatefulSets(kcm.Namespace).Create(context.TODO(), &planConfig, metav1.CreateOptions{}); err != nil {
@@ -664,6 +772,65 @@ func (kcm *K8sClientManager) DownloadPodLog(collectionID, planID int64) (string,
 	return "", fmt.Errorf("Cannot find pod for the plan %d", planID)
 }
 
+// StreamEngineLogs returns the logs of the engines of the plan by their engine IDs. The output is read from the
+// engines through the ingress, the same way as Cloud Run, so the pod logs are not needed. The logs are closed
+// when the context is done.
+func (kcm *K8sClientManager) StreamEngineLogs(ctx context.Context, collectionID, planID int64, engineID int,
+	follow bool) (map[int]io.ReadCloser, error) {
+	pods, err := kcm.GetPodsByCollectionPlan(collectionID, planID)
+	if err != nil {
+		return nil, err
+	}
+	logs := make(map[int]io.ReadCloser)
+	closeLogs := func() {
+		for _, l := range logs {
+			l.Close()
+		}
+	}
+	ingressUrl := ""
+	for _, pod := range pods {
+		id, err := strconv.Atoi(getEngineNumber(pod.Name))
+		if err != nil {
+			continue
+		}
+		if engineID != AllEngines && id != engineID {
+			continue
+		}
+		projectID, err := strconv.ParseInt(pod.Labels["project"], 10, 64)
+		if err != nil {
+			continue
+		}
+		if ingressUrl == "" {
+			if ingressUrl, err = kcm.GetIngressUrl(projectID); err != nil {
+				closeLogs()
+				return nil, err
+			}
+		}
+		engineName := makeEngineName(projectID, collectionID, planID, id)
+		logUrl := fmt.Sprintf("http://%s/%s/output?follow=%t", ingressUrl, engineName, follow)
+		req, err := http.NewRequestWithContext(ctx, "GET", logUrl, nil)
+		if err != nil {
+			closeLogs()
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			closeLogs()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			closeLogs()
+			return nil, fmt.Errorf("Cannot read the logs of engine %d: %s", id, resp.Status)
+		}
+		logs[id] = resp.Body
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("Cannot find engines for the plan %d", planID)
+	}
+	return logs, nil
+}
+
 func (kcm *K8sClientManager) PodReadyCount(collectionID int64) int {
 	label := makeCollectionLabel(collectionID)
 	podsClient, err := kcm.client.CoreV1().Pods(kcm.Namespace).
@@ -982,6 +1149,7 @@ func (kcm *K8sClientManager) GetCollectionEnginesDetail(projectID, collectionID
 		es.Name = p.Name
 		es.CreatedTime = p.ObjectMeta.CreationTimestamp.Time
 		es.Status = string(p.Status.Phase)
+		es.Reason = podFailureReason(p)
 		engines = append(engines, es)
 	}
 	collectionDetails.Engines = engines
@@ -989,6 +1157,111 @@ func (kcm *K8sClientManager) GetCollectionEnginesDetail(projectID, collectionID
 	return collectionDetails, nil
 }
 
+// Labels the cloud providers put on the nodes to tell which pool they belong to
+var nodePoolLabels = []string{"cloud.google.com/gke-nodepool", "eks.amazonaws.com/nodegroup", "agentpool"}
+
+// findNodePool prefers the label used for the node affinity of the engines as it's how the admins
+// separate the engine nodes from the others.
+func findNodePool(node *apiv1.Node) string {
+	na := config.SC.ExecutorConfig.NodeAffinity
+	if len(na) > 0 {
+		if pool, ok := node.Labels[na[0]["key"]]; ok {
+			return pool
+		}
+	}
+	for _, l := range nodePoolLabels {
+		if pool, ok := node.Labels[l]; ok {
+			return pool
+		}
+	}
+	return "default"
+}
+
+type nodeRequests struct {
+	cpu         resource.Quantity
+	mem         resource.Quantity
+	collections []int64
+}
+
+func (nr *nodeRequests) addCollection(collectionID int64) {
+	for _, c := range nr.collections {
+		if c == collectionID {
+			return
+		}
+	}
+	nr.collections = append(nr.collections, collectionID)
+}
+
+// GetNodesInfo groups the nodes running engines by their pools. The requested resources only count
+// the pods in the engines namespace as shibuya does not have access to the other namespaces.
+func (kcm *K8sClientManager) GetNodesInfo() (smodel.AllNodesInfo, error) {
+	pods, err := kcm.GetPods("", "")
+	if err != nil {
+		return nil, err
+	}
+	requests := make(map[string]*nodeRequests)
+	for _, pod := range pods {
+		nodeName := pod.Spec.NodeName
+		if nodeName == "" || pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+		nr, ok := requests[nodeName]
+		if !ok {
+			nr = new(nodeRequests)
+			requests[nodeName] = nr
+		}
+		for _, c := range pod.Spec.Containers {
+			nr.cpu.Add(*c.Resources.Requests.Cpu())
+			nr.mem.Add(*c.Resources.Requests.Memory())
+		}
+		if pod.Labels["kind"] != "executor" {
+			continue
+		}
+		collectionID, err := strconv.ParseInt(pod.Labels["collection"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nr.addCollection(collectionID)
+	}
+	nodesInfo := make(smodel.AllNodesInfo)
+	for nodeName, nr := range requests {
+		if len(nr.collections) == 0 {
+			continue
+		}
+		node, err := kcm.client.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		pool := findNodePool(node)
+		ni, ok := nodesInfo[pool]
+		if !ok {
+			ni = &smodel.NodesInfo{LaunchTime: node.CreationTimestamp.Time}
+			nodesInfo[pool] = ni
+		}
+		if node.CreationTimestamp.Time.Before(ni.LaunchTime) {
+			ni.LaunchTime = node.CreationTimestamp.Time
+		}
+		ni.Size++
+		sort.Slice(nr.collections, func(i, j int) bool {
+			return nr.collections[i] < nr.collections[j]
+		})
+		ni.Nodes = append(ni.Nodes, &smodel.NodeUsage{
+			Name:           nodeName,
+			AllocatableCPU: node.Status.Allocatable.Cpu().String(),
+			AllocatableMem: node.Status.Allocatable.Memory().String(),
+			RequestedCPU:   nr.cpu.String(),
+			RequestedMem:   nr.mem.String(),
+			Collections:    nr.collections,
+		})
+	}
+	for _, ni := range nodesInfo {
+		sort.Slice(ni.Nodes, func(i, j int) bool {
+			return ni.Nodes[i].Name < ni.Nodes[j].Name
+		})
+	}
+	return nodesInfo, nil
+}
+
 func getEngineNumber(podName string) string {
 	return strings.Split(podName, "-")[4]
 }
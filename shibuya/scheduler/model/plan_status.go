@@ -19,6 +19,11 @@ type CollectionStatus struct {
 	Plans      []*PlanStatus `json:"status"`
 	PoolSize   int           `json:"pool_size"`
 	PoolStatus string        `json:"pool_status"`
+	Paused     bool          `json:"paused"`
+	// Position of the collection in the launch queue. 0 means it's not queued
+	QueuePosition int `json:"queue_position"`
+	// Plans of the current run waiting for their start delay or dependency
+	PendingPlans []*model.PendingPlan `json:"pending_plans"`
 }
 
 type EngineOwnerRef struct {
@@ -27,9 +32,22 @@ type EngineOwnerRef struct {
 	PlanID       int64
 }
 
+// NodeUsage is how much of a node is requested by the pods in the engines namespace.
+// Quantities are in the k8s format, e.g. 500m or 2Gi
+type NodeUsage struct {
+	Name           string  `json:"name"`
+	AllocatableCPU string  `json:"allocatable_cpu"`
+	AllocatableMem string  `json:"allocatable_mem"`
+	RequestedCPU   string  `json:"requested_cpu"`
+	RequestedMem   string  `json:"requested_mem"`
+	Collections    []int64 `json:"collections"`
+}
+
+// NodesInfo is about the nodes of a pool that are running engines
 type NodesInfo struct {
-	Size       int       `json:"size"`
-	LaunchTime time.Time `json:"launch_time"`
+	Size       int          `json:"size"`
+	LaunchTime time.Time    `json:"launch_time"`
+	Nodes      []*NodeUsage `json:"nodes"`
 }
 
 type AllNodesInfo map[string]*NodesInfo
@@ -38,6 +56,15 @@ type EngineStatus struct {
 	Name        string    `json:"name"`
 	Status      string    `json:"status"`
 	CreatedTime time.Time `json:"created_time"`
+	// Why the engine is failed. Empty when the engine is healthy
+	Reason string `json:"reason"`
+}
+
+// FailedEngine is an engine that cannot become ready again without being recreated
+type FailedEngine struct {
+	PlanID   int64
+	EngineID int
+	Reason   string
 }
 
 type CollectionDetails struct {
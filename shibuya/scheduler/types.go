@@ -1,7 +1,9 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
+	"io"
 	"log"
 	"time"
 
@@ -21,15 +23,21 @@ type EngineScheduler interface {
 	GetPodsMetrics(collectionID, planID int64) (map[string]apiv1.ResourceList, error)
 	PodReadyCount(collectionID int64) int
 	DownloadPodLog(collectionID, planID int64) (string, error)
+	StreamEngineLogs(ctx context.Context, collectionID, planID int64, engineID int, follow bool) (map[int]io.ReadCloser, error)
 	GetCollectionEnginesDetail(projectID, collectionID int64) (*smodel.CollectionDetails, error)
+	GetFailedEngines(collectionID int64) ([]*smodel.FailedEngine, error)
 	GetDeployedServices() (map[int64]time.Time, error)
 	ExposeProject(projectID int64) error
 	PurgeProjectIngress(projectID int64) error
 	GetEnginesByProject(projectID int64) ([]apiv1.Pod, error)
+	GetNodesInfo() (smodel.AllNodesInfo, error)
 }
 
 var FeatureUnavailable = errors.New("Feature unavailable")
 
+// Used as the engine ID for streaming the logs of all the engines of a plan
+const AllEngines = -1
+
 func NewEngineScheduler(cfg *config.ClusterConfig) EngineScheduler {
 	switch cfg.Kind {
 	case "k8s":
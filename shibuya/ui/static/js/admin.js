@@ -8,6 +8,7 @@ var CollectionAdmin = Vue.component("collection-admin", {
     data: function () {
         return {
             running_collections: [],
+            launch_queue: [],
             node_pools: {}
         }
     },
@@ -23,6 +24,7 @@ var CollectionAdmin = Vue.component("collection-admin", {
             this.$http.get("admin/collections").then(
                 function (resp) {
                     this.running_collections = resp.body.running_collections;
+                    this.launch_queue = resp.body.launch_queue;
                     this.node_pools = resp.body.node_pools;
                 },
                 function (resp) {
@@ -28,6 +28,9 @@ var Collection = Vue.component("collection", {
             showing_engines_detail: false,
             log_content: "",
             log_modal_title: "",
+            log_plan_id: null,
+            log_level: "",
+            log_source: null,
             engines_detail: {},
             upload_url: ""
         }
@@ -97,6 +100,12 @@ var Collection = Vue.component("collection", {
         stoppable: function () {
             return this.triggered;
         },
+        paused: function () {
+            return this.triggered && this.collection_status.paused;
+        },
+        pausable: function () {
+            return this.triggered && !this.collection_status.paused;
+        },
         purge_tip: function () {
             var t = true;
             _.all(this.collection_status.status, function (plan) {
@@ -136,6 +145,7 @@ var Collection = Vue.component("collection", {
     },
     destroyed: function () {
         clearInterval(this.interval);
+        this.stopFollowingLog();
     },
     methods: {
         updateCache: function (collection_status) {
@@ -161,6 +171,10 @@ var Collection = Vue.component("collection", {
                 function (resp) {
                     this.collection_status = resp.body;
                     this.updateCache(this.collection_status.status);
+                    // The run goes on while some plans are waiting to start
+                    if (this.collection_status.pending_plans && this.collection_status.pending_plans.length > 0) {
+                        this.triggered = true;
+                    }
                 },
                 function (resp) {
                     alert(resp.body.message);
@@ -171,9 +185,35 @@ var Collection = Vue.component("collection", {
             return "#plans/" + plan_id;
         },
         launch: function () {
+            var url = "collections/" + this.collection_id + "/estimate"
+            this.$http.get(url).then(
+                function (resp) {
+                    var e = resp.body;
+                    var msg = "You are going to launch " + e.engines + " engines with " + e.vu + " VU";
+                    if (e.nodes > 0) {
+                        msg += " on about " + e.nodes + " nodes";
+                    }
+                    msg += ". Estimated usage is " + e.vuh + " VUH over " + e.billing_hours + " hours";
+                    if (e.currency) {
+                        msg += ", costing about " + e.cost.toFixed(2) + " " + e.currency;
+                    }
+                    if (!confirm(msg + ". Continue?")) return;
+                    this.deploy();
+                },
+                function (resp) {
+                    alert(resp.body.message);
+                }
+            )
+        },
+        deploy: function () {
             var url = "collections/" + this.collection_id + "/deploy"
             this.$http.post(url).then(
                 function (resp) {
+                    // 202 means the launch is queued until the capacity is available
+                    if (resp.status === 202) {
+                        alert("The launch is queued at position " + resp.body.position + ". " + resp.body.reason);
+                        return;
+                    }
                     this.launched = true;
                     this.purged = false;
                 },
@@ -210,6 +250,23 @@ var Collection = Vue.component("collection", {
                 }
             );
         },
+        changeSampling: function (action) {
+            var url = "collections/" + this.collection_id + "/" + action
+            this.$http.post(url).then(
+                function (resp) {
+                    this.collection_status.paused = action === "pause";
+                },
+                function (resp) {
+                    alert(resp.body.message);
+                }
+            );
+        },
+        pause: function () {
+            this.changeSampling("pause");
+        },
+        resume: function () {
+            this.changeSampling("resume");
+        },
         purge: function () {
             var url = "collections/" + this.collection_id + "/purge"
             this.purge_in_progress = true;
@@ -279,6 +336,22 @@ var Collection = Vue.component("collection", {
             style.width = "50%";
             return style;
         },
+        pendingPlan: function (plan) {
+            var pending = this.collection_status.pending_plans || [];
+            return _.find(pending, function (pp) {
+                return pp.plan_id === plan.plan_id;
+            });
+        },
+        pendingText: function (plan) {
+            var pp = this.pendingPlan(plan);
+            if (pp.starting) {
+                return "Starting";
+            }
+            if (pp.start_time) {
+                return "Starts at " + this.toLocalTZ(pp.start_time);
+            }
+            return "Waiting for plan " + pp.depends_on.plan_id + " to be " + pp.depends_on.state;
+        },
         planStarted: function (plan) {
             var plan_status = this.cache[plan.plan_id];
             if (plan_status === undefined) {
@@ -319,21 +392,47 @@ var Collection = Vue.component("collection", {
         },
         viewPlanLog: function (e, plan_id) {
             e.preventDefault();
-            var url = "collections/" + this.collection.id + "/logs/" + plan_id;
+            if (!this.triggered) {
+                alert("The collection has not been triggered!");
+                return;
+            }
             this.log_modal_title = this.collection.name + "/" + plan_id;
-            this.$http.get(url).then(
-                function (resp) {
-                    this.showing_log = true;
-                    this.log_content = resp.body.c;
-                },
-                function (resp) {
-                    if (!this.triggered) {
-                        alert("The collection has not been triggered!");
-                        return
-                    }
-                    console.log(resp.body.message);
+            this.log_plan_id = plan_id;
+            this.showing_log = true;
+            this.followPlanLog();
+        },
+        followPlanLog: function () {
+            this.stopFollowingLog();
+            this.log_content = "";
+            var url = "/api/collections/" + this.collection.id + "/logs/" + this.log_plan_id + "/stream?level=" + this.log_level;
+            var source = new EventSource(url);
+            var that = this;
+            source.onmessage = function (event) {
+                that.log_content += event.data + "\n";
+                // Only the tail is kept so the page stays responsive during long tests
+                if (that.log_content.length > 1000000) {
+                    that.log_content = that.log_content.slice(-500000);
                 }
-            )
+            };
+            // Sent when the logs of an engine cannot be followed anymore
+            source.addEventListener("stream_error", function (event) {
+                that.log_content += event.data + "\n";
+            });
+            // The browser would reconnect and receive the buffered logs again
+            source.onerror = function () {
+                source.close();
+            };
+            this.log_source = source;
+        },
+        stopFollowingLog: function () {
+            if (this.log_source !== null) {
+                this.log_source.close();
+                this.log_source = null;
+            }
+        },
+        closePlanLog: function () {
+            this.stopFollowingLog();
+            this.showing_log = false;
         },
         runGrafanaUrl: function (run) {
             //buffer 1 minute before and after because of time lag in shipping of results
@@ -24,12 +24,30 @@ var UploadMixin = {
                 req.open("put", "/api/" + self.upload_url);
                 req.send(formData);
                 req.addEventListener("loadend", function () {
+                    var formatIssues = function (issues) {
+                        return issues.map(function (i) {
+                            return "[" + i.level + "] " + (i.element ? i.element + ": " : "") + i.message;
+                        }).join("\n");
+                    };
                     switch (req.status) {
                         case 200:
+                            // Test plans are validated on upload
+                            var issues = [];
+                            try {
+                                issues = JSON.parse(req.response);
+                            } catch (e) { }
+                            if (Array.isArray(issues) && issues.length > 0) {
+                                alert("upload success with issues in the test plan:\n" + formatIssues(issues));
+                                break;
+                            }
                             alert("upload success!");
                             break;
                         default:
                             var resp = JSON.parse(req.response);
+                            if (Array.isArray(resp.issues)) {
+                                alert(resp.message + ":\n" + formatIssues(resp.issues));
+                                break;
+                            }
                             alert(resp.message);
                     }
                     event.target.value = "";
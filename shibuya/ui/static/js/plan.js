@@ -1,9 +1,11 @@
 var Plan = Vue.component("plans", {
     template: "#plan-tmpl",
-    mixins: [DelimitorMixin, UploadMixin],
+    mixins: [DelimitorMixin, UploadMixin, TZMixin],
     data: function () {
         return {
             plan: {},
+            files: [],
+            issues: null,
             upload_file_help: upload_file_help
         }
     },
@@ -31,6 +33,24 @@ var Plan = Vue.component("plans", {
                 function (resp) {
                     console.log(resp.body)
                 }
+            );
+            this.$http.get("plans/" + this.plan_id + "/files").then(
+                function (resp) {
+                    this.files = resp.body;
+                },
+                function (resp) {
+                    console.log(resp.body)
+                }
+            )
+        },
+        validate: function () {
+            this.$http.get("plans/" + this.plan_id + "/validation").then(
+                function (resp) {
+                    this.issues = resp.body;
+                },
+                function (resp) {
+                    alert(resp.body.message);
+                }
             )
         },
         remove: function () {
@@ -46,6 +66,23 @@ var Plan = Vue.component("plans", {
                 }
             )
         },
+        updateCSVSettings: function (f) {
+            var url = "plans/" + this.plan_id + "/files/csv_settings";
+            var payload = {
+                filename: f.filename,
+                split: f.csv_settings.split,
+                split_mode: f.csv_settings.split_mode,
+                keep_header: f.csv_settings.keep_header
+            };
+            this.$http.put(url, payload).then(
+                function (resp) {
+                    this.fetchPlan();
+                },
+                function (resp) {
+                    alert(resp.body.message);
+                }
+            )
+        },
         deletePlanFile: function (filename) {
             var url = encodeURI("plans/" + this.plan_id + "/files?filename=" + filename);
             this.$http.delete(url).then(
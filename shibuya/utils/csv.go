@@ -1,50 +1,176 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/csv"
 	"errors"
+	"io"
 	"log"
 )
 
-func calCSVRange(totalRows, totalSplits, currentSplit int) (int, int) {
-	/*
-		Splits are done using lower ceiling. For 80 lines of CSV with 3 splits,
-		each split gets 26 lines. Since Golang slices exclude high bound we need to
-		make sure the end is actually lastLine+1. So csv[0:26] actually means 0 to 25th line
-		currentSplit starts from 0
-	*/
-	if totalRows < totalSplits {
-		return 0, totalRows
+// CalCSVRange returns the range of the rows of the split, from start to end exclusive. Every split gets
+// rows/totalSplits rows, the first splits get one more when it cannot be divided evenly.
+// currentSplit starts from 0.
+func CalCSVRange(rows int64, totalSplits, currentSplit int) (int64, int64, error) {
+	if currentSplit >= totalSplits {
+		return 0, 0, errors.New("Cannot split more than total number of engines")
+	}
+	start := rows * int64(currentSplit) / int64(totalSplits)
+	end := rows * int64(currentSplit+1) / int64(totalSplits)
+	log.Printf("rows %d, start %d, end %d", rows, start, end)
+	return start, end, nil
+}
+
+// readCSVRow reads the next row. New lines in quoted fields do not end the row. Quotes in the fields are
+// escaped by doubling them, so the row is only complete when the number of quotes read is even.
+func readCSVRow(br *bufio.Reader) ([]byte, error) {
+	row, err := br.ReadBytes('\n')
+	quotes := bytes.Count(row, []byte{'"'})
+	for err == nil && quotes%2 == 1 {
+		var next []byte
+		next, err = br.ReadBytes('\n')
+		row = append(row, next...)
+		quotes += bytes.Count(next, []byte{'"'})
+	}
+	return row, err
+}
+
+// CSVRowCounter counts the rows written to it without keeping them, e.g. while the file is uploaded.
+// It counts the same rows as readCSVRow.
+type CSVRowCounter struct {
+	rows    int64
+	quoted  bool
+	started bool // the current row has no new line yet
+}
+
+func (c *CSVRowCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '"' {
+			c.quoted = !c.quoted
+		}
+		if b == '\n' && !c.quoted {
+			c.rows += 1
+			c.started = false
+			continue
+		}
+		c.started = true
+	}
+	return len(p), nil
+}
+
+// Rows counts the last row even if it does not end with a new line
+func (c *CSVRowCounter) Rows() int64 {
+	if c.started {
+		return c.rows + 1
+	}
+	return c.rows
+}
+
+// CountCSVRows counts the rows of the file, including the header
+func CountCSVRows(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var rows int64
+	for {
+		row, err := readCSVRow(br)
+		if len(row) > 0 {
+			rows += 1
+		}
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
 	}
-	chunk := totalRows / totalSplits
-	start := chunk * currentSplit
-	end := start + chunk
-	log.Printf("chunk %d, start %d, end %d", chunk, start, end)
-	return start, end
 }
 
-func SplitCSV(file []byte, totalSplits, currentSplit int) ([]byte, error) {
+// ReadCSVHeader returns the first row of the file including its new line
+func ReadCSVHeader(r io.Reader) ([]byte, error) {
+	header, err := readCSVRow(bufio.NewReader(r))
+	if err == io.EOF {
+		return header, nil
+	}
+	return header, err
+}
+
+// writeRow makes sure every row ends with a new line as the last row of a file may not have one
+func writeRow(w *bufio.Writer, row []byte) error {
+	if _, err := w.Write(row); err != nil {
+		return err
+	}
+	if row[len(row)-1] != '\n' {
+		return w.WriteByte('\n')
+	}
+	return nil
+}
+
+// SplitCSV copies the rows of the split from r into w without loading the file into memory and returns
+// the number of rows copied. r is the whole file and the rows are counted from the first row after the
+// header. The file is only read until the end of the split.
+// The header is skipped in r and written before the rows when it's not empty.
+func SplitCSV(r io.Reader, w io.Writer, start, end int64, header []byte) (int64, error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	if len(header) > 0 {
+		if _, err := br.Discard(len(header)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if err := writeRow(bw, header); err != nil {
+			return 0, err
+		}
+	}
+	var rows int64
+	for i := int64(0); i < end; i++ {
+		row, err := readCSVRow(br)
+		if len(row) > 0 && i >= start {
+			if werr := writeRow(bw, row); werr != nil {
+				return rows, werr
+			}
+			rows += 1
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+	}
+	return rows, bw.Flush()
+}
+
+// SplitCSVRoundRobin reads the whole file from r and copies every totalSplits-th row starting from
+// currentSplit into w. It returns the number of rows copied. Rows of the split are spread over the file
+// so every engine gets a similar mix of the data when the file is sorted.
+// The header is skipped in r and written before the rows when it's not empty.
+func SplitCSVRoundRobin(r io.Reader, w io.Writer, totalSplits, currentSplit int, header []byte) (int64, error) {
 	if currentSplit >= totalSplits {
-		// currentSplit starts at 0
-		return nil, errors.New("Cannot split more than total number of engines")
-	}
-	csvReader := csv.NewReader(bytes.NewReader(file))
-	csvReader.FieldsPerRecord = -1
-	csvFile, err := csvReader.ReadAll()
-	if err != nil {
-		return nil, err
-	}
-	start, end := calCSVRange(len(csvFile), totalSplits, currentSplit)
-	splittedCSV := csvFile[start:end]
-	var buf bytes.Buffer
-	w := csv.NewWriter(&buf)
-	for _, s := range splittedCSV {
-		w.Write(s)
-	}
-	w.Flush()
-	if err := w.Error(); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+		return 0, errors.New("Cannot split more than total number of engines")
+	}
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	if len(header) > 0 {
+		if _, err := br.Discard(len(header)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if err := writeRow(bw, header); err != nil {
+			return 0, err
+		}
+	}
+	var rows int64
+	for i := 0; ; i++ {
+		row, err := readCSVRow(br)
+		if len(row) > 0 && i%totalSplits == currentSplit {
+			if werr := writeRow(bw, row); werr != nil {
+				return rows, werr
+			}
+			rows += 1
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+	}
+	return rows, bw.Flush()
 }
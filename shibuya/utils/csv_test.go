@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func makeCSV(rows int) string {
+	var b strings.Builder
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "user%03d,password%03d\n", i, i)
+	}
+	return b.String()
+}
+
+// splitContiguous splits the file the same way as the agent
+func splitContiguous(t *testing.T, file string, header []byte, totalSplits, currentSplit int) (string, int64) {
+	rows, err := CountCSVRows(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) > 0 {
+		rows -= 1
+	}
+	start, end, err := CalCSVRange(rows, totalSplits, currentSplit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	copied, err := SplitCSV(strings.NewReader(file), &out, start, end, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), copied
+}
+
+func TestSplitCSVCoversAllRows(t *testing.T) {
+	file := makeCSV(80)
+	var joined strings.Builder
+	var total int64
+	for i := 0; i < 3; i++ {
+		split, rows := splitContiguous(t, file, nil, 3, i)
+		if rows < 26 || rows > 27 {
+			t.Errorf("split %d got %d rows", i, rows)
+		}
+		joined.WriteString(split)
+		total += rows
+	}
+	if total != 80 {
+		t.Errorf("expected 80 rows, got %d", total)
+	}
+	if joined.String() != file {
+		t.Error("splits should be the file in order")
+	}
+}
+
+func TestSplitCSVBalancedByRows(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 50; i++ {
+		// Rows get longer and longer so a split by bytes would give the first engines more rows
+		fmt.Fprintf(&b, "user%d,%s\n", i, strings.Repeat("x", i*i))
+	}
+	file := b.String()
+	var joined strings.Builder
+	for i := 0; i < 4; i++ {
+		split, rows := splitContiguous(t, file, nil, 4, i)
+		if rows < 12 || rows > 13 {
+			t.Errorf("split %d got %d rows", i, rows)
+		}
+		joined.WriteString(split)
+	}
+	if joined.String() != file {
+		t.Error("splits should be the file in order")
+	}
+}
+
+func TestSplitCSVKeepHeader(t *testing.T) {
+	header := "username,password\n"
+	file := header + makeCSV(10)
+	var total int64
+	for i := 0; i < 4; i++ {
+		split, rows := splitContiguous(t, file, []byte(header), 4, i)
+		if !strings.HasPrefix(split, header) {
+			t.Errorf("split %d should start with the header", i)
+		}
+		if strings.Count(split, header) != 1 {
+			t.Errorf("split %d should have only one header", i)
+		}
+		total += rows
+	}
+	if total != 10 {
+		t.Errorf("expected 10 rows, got %d", total)
+	}
+}
+
+func TestSplitCSVRoundRobin(t *testing.T) {
+	header := "username,password\n"
+	file := header + "a,1\nb,2\nc,3\nd,4\ne,5"
+	expected := []string{
+		header + "a,1\nc,3\ne,5\n",
+		header + "b,2\nd,4\n",
+	}
+	for i, e := range expected {
+		var out bytes.Buffer
+		rows, err := SplitCSVRoundRobin(strings.NewReader(file), &out, 2, i, []byte(header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != e {
+			t.Errorf("split %d: expected %q, got %q", i, e, out.String())
+		}
+		if rows != int64(strings.Count(e, "\n")-1) {
+			t.Errorf("split %d got %d rows", i, rows)
+		}
+	}
+	if _, err := SplitCSVRoundRobin(strings.NewReader(file), &bytes.Buffer{}, 2, 2, nil); err == nil {
+		t.Error("current split should be smaller than total splits")
+	}
+}
+
+func TestReadCSVHeader(t *testing.T) {
+	header, err := ReadCSVHeader(strings.NewReader("username,password\na,1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "username,password\n" {
+		t.Errorf("unexpected header %q", header)
+	}
+	header, err = ReadCSVHeader(strings.NewReader("username,password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "username,password" {
+		t.Errorf("unexpected header %q", header)
+	}
+}
+
+func TestSplitCSVQuotedNewLines(t *testing.T) {
+	header := "username,address\n"
+	rows := []string{
+		"a,\"1 Main St\nApt 2\"\n",
+		"b,\"say \"\"hi\"\"\"\n",
+		"c,\"line\nline\nline\"\n",
+		"d,plain\n",
+	}
+	file := header + strings.Join(rows, "")
+	counter := &CSVRowCounter{}
+	counter.Write([]byte(file))
+	if counter.Rows() != 5 {
+		t.Errorf("expected 5 rows with the header, got %d", counter.Rows())
+	}
+	for i := 0; i < 2; i++ {
+		split, copied := splitContiguous(t, file, []byte(header), 2, i)
+		if expected := header + rows[2*i] + rows[2*i+1]; split != expected {
+			t.Errorf("split %d: expected %q, got %q", i, expected, split)
+		}
+		if copied != 2 {
+			t.Errorf("split %d got %d rows", i, copied)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := SplitCSVRoundRobin(strings.NewReader(file), &out, 2, 1, []byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := header + rows[1] + rows[3]; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestCSVRowCounterWithoutLastNewLine(t *testing.T) {
+	counter := &CSVRowCounter{}
+	counter.Write([]byte("a,1\nb,"))
+	counter.Write([]byte("2"))
+	if counter.Rows() != 2 {
+		t.Errorf("expected 2 rows, got %d", counter.Rows())
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+// LineBuffer keeps the last lines written to it so the memory used by the logs is bounded. New lines are
+// also sent to the subscribers so the logs can be followed.
+type LineBuffer struct {
+	mu          sync.Mutex
+	lines       []string
+	next        int // where the next line goes once the buffer is full
+	full        bool
+	subscribers map[chan string]bool
+}
+
+// Subscribers slower than this number of lines miss the new lines instead of blocking the writer
+const subscriberBacklog = 1000
+
+func NewLineBuffer(capacity int) *LineBuffer {
+	return &LineBuffer{
+		lines:       make([]string, 0, capacity),
+		subscribers: make(map[chan string]bool),
+	}
+}
+
+func (lb *LineBuffer) Add(line string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if !lb.full {
+		lb.lines = append(lb.lines, line)
+		lb.full = len(lb.lines) == cap(lb.lines)
+	} else {
+		lb.lines[lb.next] = line
+		lb.next = (lb.next + 1) % len(lb.lines)
+	}
+	for c := range lb.subscribers {
+		select {
+		case c <- line:
+		default:
+		}
+	}
+}
+
+func (lb *LineBuffer) snapshot() []string {
+	lines := make([]string, 0, len(lb.lines))
+	lines = append(lines, lb.lines[lb.next:]...)
+	return append(lines, lb.lines[:lb.next]...)
+}
+
+// Lines returns the buffered lines from the oldest
+func (lb *LineBuffer) Lines() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.snapshot()
+}
+
+// Subscribe returns the buffered lines and a channel of the lines added after them, so no line is
+// missed or repeated between the two. The channel should be given back with Unsubscribe.
+func (lb *LineBuffer) Subscribe() ([]string, chan string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	c := make(chan string, subscriberBacklog)
+	lb.subscribers[c] = true
+	return lb.snapshot(), c
+}
+
+func (lb *LineBuffer) Unsubscribe(c chan string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	delete(lb.subscribers, c)
+}
+
+var logLevels = map[string]int{
+	"TRACE": 0,
+	"DEBUG": 1,
+	"INFO":  2,
+	"WARN":  3,
+	"ERROR": 4,
+	"FATAL": 5,
+}
+
+// IsValidLogLevel tells whether the level can be used for filtering the logs. Empty means no filtering.
+func IsValidLogLevel(level string) bool {
+	if level == "" {
+		return true
+	}
+	_, ok := logLevels[strings.ToUpper(level)]
+	return ok
+}
+
+// LogLevelFilter keeps the lines at the level or above. JMeter logs the level after the time, e.g.
+// "2020-01-01 00:00:00,000 INFO o.a.j.e.StandardJMeterEngine: Running the test!". Lines of the agent
+// start with the time but have no level so they are treated as INFO. Other lines, like stack traces,
+// belong to the line before them.
+type LogLevelFilter struct {
+	min  int
+	last int
+}
+
+func NewLogLevelFilter(level string) *LogLevelFilter {
+	return &LogLevelFilter{
+		min:  logLevels[strings.ToUpper(level)],
+		last: logLevels["INFO"],
+	}
+}
+
+func (f *LogLevelFilter) Keep(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 4 {
+		fields = fields[:4]
+	}
+	found := false
+	for _, field := range fields {
+		if level, ok := logLevels[field]; ok {
+			f.last = level
+			found = true
+			break
+		}
+	}
+	if !found && len(line) > 0 && line[0] >= '0' && line[0] <= '9' {
+		f.last = logLevels["INFO"]
+	}
+	return f.last >= f.min
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLineBufferIsBounded(t *testing.T) {
+	lb := NewLineBuffer(3)
+	for i := 0; i < 5; i++ {
+		lb.Add(fmt.Sprintf("line %d", i))
+	}
+	if lines := strings.Join(lb.Lines(), ","); lines != "line 2,line 3,line 4" {
+		t.Errorf("unexpected lines %s", lines)
+	}
+}
+
+func TestLineBufferSubscribe(t *testing.T) {
+	lb := NewLineBuffer(10)
+	lb.Add("before")
+	lines, c := lb.Subscribe()
+	defer lb.Unsubscribe(c)
+	lb.Add("after")
+	if len(lines) != 1 || lines[0] != "before" {
+		t.Errorf("unexpected buffered lines %v", lines)
+	}
+	if line := <-c; line != "after" {
+		t.Errorf("expected the new line, got %s", line)
+	}
+}
+
+func TestLogLevelFilter(t *testing.T) {
+	logs := []string{
+		"2020-01-01 00:00:00,000 INFO o.a.j.e.StandardJMeterEngine: Running the test!",
+		"2020-01-01 00:00:01,000 ERROR o.a.j.t.JMeterThread: Test failed!",
+		"java.lang.IllegalStateException: broken",
+		"	at org.apache.jmeter.threads.JMeterThread.run(JMeterThread.java:1)",
+		"2020/01/01 00:00:02 shibuya-agent: Start to run plan",
+		"2020-01-01 00:00:03,000 WARN o.a.j.s.FileServer: Stopping",
+	}
+	f := NewLogLevelFilter("warn")
+	kept := []string{}
+	for _, line := range logs {
+		if f.Keep(line) {
+			kept = append(kept, line)
+		}
+	}
+	expected := []string{logs[1], logs[2], logs[3], logs[5]}
+	if strings.Join(kept, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines kept %v", kept)
+	}
+}
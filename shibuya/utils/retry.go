@@ -11,15 +11,18 @@ import (
 const RETRY_LIMIT int = 5
 const RETRY_INTERVAL int = 10
 
-func Retry(attempt func() error, exempt error) error {
+// Retry gives up immediately on the exempt errors
+func Retry(attempt func() error, exempts ...error) error {
 	var err error
 	for i := 0; i < RETRY_LIMIT; i++ {
 		err = attempt()
 		if err == nil {
 			return nil
 		}
-		if errors.Is(err, exempt) {
-			return err
+		for _, exempt := range exempts {
+			if errors.Is(err, exempt) {
+				return err
+			}
 		}
 		pc, file, line, ok := runtime.Caller(1)
 		if ok {
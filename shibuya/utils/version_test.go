@@ -0,0 +1,21 @@
+package utils
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"5.6.3", "5.10", -1},
+		{"5.10", "5.6.3", 1},
+		{"5.6", "5.6.3", -1},
+		{"5.6.3", "5.6.3", 0},
+		{"3.3", "5.0", -1},
+	}
+	for _, c := range cases {
+		if r := CompareVersions(c.a, c.b); r != c.expected {
+			t.Errorf("CompareVersions(%s, %s) is %d, expected %d", c.a, c.b, r, c.expected)
+		}
+	}
+}